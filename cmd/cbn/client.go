@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"github.com/amirylm/cbn/src/core"
+	"io"
+)
+
+var (
+	notSupportedErr = errors.New("command is not supported over libp2p (-peer), use -api")
+)
+
+// bucketInfo is the output of bucket commands
+type bucketInfo struct {
+	Hash     string `json:"hash"`
+	Name     string `json:"name"`
+	Updated  int64  `json:"updated"`
+	Replicas int    `json:"replicas,omitempty"`
+	Pending  bool   `json:"pending,omitempty"`
+}
+
+// domainInfo is the output of domain commands
+type domainInfo struct {
+	Domain string `json:"domain"`
+	Hash   string `json:"hash"`
+}
+
+// client talks to a node, either over the http gateway or over libp2p protocols
+type client interface {
+	CreateBucket(name string) (*bucketInfo, error)
+	// CreateMultisigBucket creates a bucket that is owned by the given signers (peer ids)
+	CreateMultisigBucket(name string, threshold int, signers []string) (*bucketInfo, error)
+	// PendingBucket returns the (raw) pending version of some multisig bucket
+	PendingBucket(hash string) ([]byte, error)
+	// AddSignatures sends the (raw) bucket that was signed offline
+	AddSignatures(hash string, raw []byte) (*bucketInfo, error)
+	ListBuckets() ([]bucketInfo, error)
+	BucketContent(hash, dirPath string) ([]string, error)
+	// Remove removes a file or directory, pending is true if the bucket waits for more signatures (multisig)
+	Remove(hash, name string) (pending bool, err error)
+	// Put uploads the given stream into some bucket, name might be a path within the bucket
+	Put(hash, name, contentType string, r io.Reader) (pending bool, err error)
+	// Get streams the content of some file into the given writer
+	Get(hash, name string, w io.Writer) error
+	RegisterDomain(rec *core.DomainRecord) (*domainInfo, error)
+	ResolveDomain(domain string) (*domainInfo, error)
+	Close() error
+}
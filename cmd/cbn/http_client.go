@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amirylm/cbn/src/core"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// httpClient talks to the http gateway, updates are signed by the given identity of the gateway (if not empty)
+type httpClient struct {
+	api      string
+	identity string
+}
+
+func newHttpClient(api, identity string) *httpClient {
+	c := httpClient{strings.TrimSuffix(api, "/"), identity}
+
+	return &c
+}
+
+// response is the envelope of gateway responses,
+// pending is set once a multisig bucket was updated but waits for more signatures
+type response struct {
+	Data    json.RawMessage `json:"data"`
+	Pending bool            `json:"pending"`
+	Error   string          `json:"error"`
+}
+
+// do sends the request and parses the data of the response into out (if not nil)
+func (hc *httpClient) do(method, p string, contentType string, body io.Reader, out interface{}) error {
+	r, err := hc.send(method, p, contentType, body)
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(r.Data, out)
+}
+
+// send sends the request and returns the envelope of the response
+func (hc *httpClient) send(method, p string, contentType string, body io.Reader) (*response, error) {
+	req, err := http.NewRequest(method, hc.api+p, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	success := res.StatusCode == http.StatusOK || res.StatusCode == http.StatusAccepted
+	var r response
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil && success {
+		return nil, err
+	}
+	if !success {
+		return nil, responseErr(res, r.Error)
+	}
+	return &r, nil
+}
+
+func responseErr(res *http.Response, msg string) error {
+	if len(msg) == 0 {
+		msg = http.StatusText(res.StatusCode)
+	}
+	return errors.New(fmt.Sprintf("%d: %s", res.StatusCode, msg))
+}
+
+// bucketPath returns the escaped path of some file in a bucket
+func bucketPath(hash, name string) (string, error) {
+	name, err := core.CleanPath(name)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{"buckets", url.PathEscape(hash)}
+	for _, part := range strings.Split(name, "/") {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return "/" + strings.Join(parts, "/"), nil
+}
+
+func (hc *httpClient) CreateBucket(name string) (*bucketInfo, error) {
+	body, err := json.Marshal(map[string]string{"name": name, "identity": hc.identity})
+	if err != nil {
+		return nil, err
+	}
+	var b bucketInfo
+	err = hc.do(http.MethodPost, "/buckets", "application/json", bytes.NewReader(body), &b)
+	return &b, err
+}
+
+// bucket sends a request that results in a bucket, which might be pending for signatures
+func (hc *httpClient) bucket(method, p string, body []byte) (*bucketInfo, error) {
+	r, err := hc.send(method, p, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var b bucketInfo
+	if err = json.Unmarshal(r.Data, &b); err != nil {
+		return nil, err
+	}
+	b.Pending = r.Pending
+	return &b, nil
+}
+
+func (hc *httpClient) CreateMultisigBucket(name string, threshold int, signers []string) (*bucketInfo, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"name":      name,
+		"identity":  hc.identity,
+		"threshold": threshold,
+		"signers":   signers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hc.bucket(http.MethodPost, "/buckets", body)
+}
+
+func (hc *httpClient) PendingBucket(hash string) ([]byte, error) {
+	var raw json.RawMessage
+	err := hc.do(http.MethodGet, "/pending/"+url.PathEscape(hash), "", nil, &raw)
+	return raw, err
+}
+
+func (hc *httpClient) AddSignatures(hash string, raw []byte) (*bucketInfo, error) {
+	return hc.bucket(http.MethodPost, "/pending/"+url.PathEscape(hash), raw)
+}
+
+func (hc *httpClient) ListBuckets() ([]bucketInfo, error) {
+	buckets := []bucketInfo{}
+	err := hc.do(http.MethodGet, "/buckets", "", nil, &buckets)
+	return buckets, err
+}
+
+func (hc *httpClient) BucketContent(hash, dirPath string) ([]string, error) {
+	names := []string{}
+	p := fmt.Sprintf("/buckets/%s?path=%s", url.PathEscape(hash), url.QueryEscape(dirPath))
+	err := hc.do(http.MethodGet, p, "", nil, &names)
+	return names, err
+}
+
+func (hc *httpClient) Remove(hash, name string) (bool, error) {
+	p, err := bucketPath(hash, name)
+	if err != nil {
+		return false, err
+	}
+	if len(hc.identity) > 0 {
+		p += "?identity=" + url.QueryEscape(hc.identity)
+	}
+	r, err := hc.send(http.MethodDelete, p, "", nil)
+	if err != nil {
+		return false, err
+	}
+	return r.Pending, nil
+}
+
+// Put streams a multipart form, so large files won't be loaded into memory
+func (hc *httpClient) Put(hash, name, contentType string, r io.Reader) (bool, error) {
+	name, err := core.CleanPath(name)
+	if err != nil {
+		return false, err
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("path", path.Dir(name))
+		if err == nil && len(hc.identity) > 0 {
+			err = mw.WriteField("identity", hc.identity)
+		}
+		if err == nil {
+			h := textproto.MIMEHeader{}
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, path.Base(name)))
+			h.Set("Content-Type", contentType)
+			var part io.Writer
+			if part, err = mw.CreatePart(h); err == nil {
+				_, err = io.Copy(part, r)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	res, err := hc.send(http.MethodPost, fmt.Sprintf("/buckets/%s/files", url.PathEscape(hash)), mw.FormDataContentType(), pr)
+	if err != nil {
+		return false, err
+	}
+	return res.Pending, nil
+}
+
+func (hc *httpClient) Get(hash, name string, w io.Writer) error {
+	p, err := bucketPath(hash, name)
+	if err != nil {
+		return err
+	}
+	res, err := http.Get(hc.api + p)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var r response
+		json.NewDecoder(res.Body).Decode(&r)
+		return responseErr(res, r.Error)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func (hc *httpClient) RegisterDomain(rec *core.DomainRecord) (*domainInfo, error) {
+	raw, err := core.SerializeDomainRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	var d domainInfo
+	err = hc.do(http.MethodPost, "/domains", "application/cbor", bytes.NewReader(raw), &d)
+	return &d, err
+}
+
+func (hc *httpClient) ResolveDomain(domain string) (*domainInfo, error) {
+	var d domainInfo
+	err := hc.do(http.MethodGet, "/domains/"+url.PathEscape(domain), "", nil, &d)
+	return &d, err
+}
+
+func (hc *httpClient) Close() error {
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/amirylm/cbn/src/api"
+	libp2p_handlers "github.com/amirylm/cbn/src/api/libp2p"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/core/p2p"
+	p2pfacade "github.com/amirylm/libp2p-facade/core"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-multiaddr"
+	"io"
+	"log"
+	"time"
+)
+
+var (
+	// libp2pTimeout limits the time of connecting the node and opening streams
+	libp2pTimeout = 30 * time.Second
+)
+
+// libp2pClient talks to a node over its libp2p protocols, only read commands are supported
+// as updates of buckets must be signed by the owner (the node).
+// the bytes of data streams are accounted, and a receipt is sent to the node once the client is closed
+type libp2pClient struct {
+	peer   *p2pfacade.BasePeer
+	ldg    *p2p.Ledger
+	target peer.ID
+}
+
+// newLibp2pClient creates an ephemeral peer that connects to the given node address ('/.../p2p/<id>')
+func newLibp2pClient(addr string, psk []byte, priv libp2pcrypto.PrivKey) (*libp2pClient, error) {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	pi, err := peer.AddrInfoFromP2pAddr(ma)
+	if err != nil {
+		return nil, err
+	}
+	base := p2pfacade.NewBasePeer(context.Background(), p2pfacade.NewConfig(priv, psk, nil))
+	ctx, cancel := context.WithTimeout(base.Context(), libp2pTimeout)
+	defer cancel()
+	if err = base.Host().Connect(ctx, *pi); err != nil {
+		base.Close()
+		return nil, err
+	}
+	lc := libp2pClient{base, p2p.NewLedger(base), pi.ID}
+
+	return &lc, nil
+}
+
+func (lc *libp2pClient) newStream(pid protocol.ID) (network.Stream, error) {
+	ctx, cancel := context.WithTimeout(lc.peer.Context(), libp2pTimeout)
+	defer cancel()
+	return lc.ldg.NewStream(ctx, lc.target, pid)
+}
+
+func (lc *libp2pClient) CreateBucket(name string) (*bucketInfo, error) {
+	return nil, notSupportedErr
+}
+
+func (lc *libp2pClient) CreateMultisigBucket(name string, threshold int, signers []string) (*bucketInfo, error) {
+	return nil, notSupportedErr
+}
+
+func (lc *libp2pClient) PendingBucket(hash string) ([]byte, error) {
+	return nil, notSupportedErr
+}
+
+func (lc *libp2pClient) AddSignatures(hash string, raw []byte) (*bucketInfo, error) {
+	return nil, notSupportedErr
+}
+
+func (lc *libp2pClient) ListBuckets() ([]bucketInfo, error) {
+	stream, err := lc.newStream(p2p.ListBucketsProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	buckets, err := libp2p_handlers.ReadBuckets(stream)
+	if err != nil {
+		return nil, err
+	}
+	res := []bucketInfo{}
+	for _, b := range buckets {
+		res = append(res, bucketInfo{b.Hash(), b.Name(), b.Updated(), b.Replicas(), false})
+	}
+	return res, nil
+}
+
+func (lc *libp2pClient) BucketContent(hash, dirPath string) ([]string, error) {
+	stream, err := lc.newStream(p2p.GetBucketProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	// pointer name is used as the directory path
+	if err = libp2p_handlers.WritePointer(stream, api.NewPointer(hash, dirPath)); err != nil {
+		return nil, err
+	}
+	msg, err := msgio.NewReader(stream).ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	var content map[string][]string
+	if err = json.Unmarshal(msg, &content); err != nil {
+		return nil, err
+	}
+	return content["Items"], nil
+}
+
+func (lc *libp2pClient) Remove(hash, name string) (bool, error) {
+	return false, notSupportedErr
+}
+
+func (lc *libp2pClient) Put(hash, name, contentType string, r io.Reader) (bool, error) {
+	return false, notSupportedErr
+}
+
+func (lc *libp2pClient) Get(hash, name string, w io.Writer) error {
+	name, err := core.CleanPath(name)
+	if err != nil {
+		return err
+	}
+	stream, err := lc.newStream(p2p.DownProtocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if err = libp2p_handlers.WritePointer(stream, api.NewPointer(hash, name)); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, stream)
+	return err
+}
+
+func (lc *libp2pClient) RegisterDomain(rec *core.DomainRecord) (*domainInfo, error) {
+	return nil, notSupportedErr
+}
+
+func (lc *libp2pClient) ResolveDomain(domain string) (*domainInfo, error) {
+	return nil, notSupportedErr
+}
+
+func (lc *libp2pClient) Close() error {
+	if err := lc.ldg.SendReceipts(); err != nil {
+		log.Println("could not send receipts:", err)
+	}
+	return lc.peer.Close()
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amirylm/cbn/src/cipher"
+	"github.com/amirylm/cbn/src/core"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	exitOK    = 0
+	exitErr   = 1
+	exitUsage = 2
+)
+
+var (
+	usageErr = errors.New("invalid usage")
+)
+
+const usage = `Usage: cbn [flags] <command> [args]
+
+Commands:
+  bucket create <name>             create a new bucket (owned by the gateway)
+  bucket ls                        list buckets
+  bucket content <hash> [path]     list bucket (or sub directory) content
+  bucket rm <hash> <name>          remove a file or directory from a bucket
+  bucket multisig <name> <threshold> <peer-id>...
+                                   create a bucket that requires signatures of threshold signers
+  bucket pending <hash> [file]     get the pending version of a multisig bucket (stdout if file is missing or '-')
+  bucket sign <file>               sign a pending bucket offline with -key (or -identity of the keystore)
+  bucket push <hash> <file>        send the signatures of a pending bucket
+  put <hash> <name> [file]         upload a file (stdin if file is missing or '-')
+  get <hash> <name> [file]         download a file (stdout if file is missing or '-')
+  domain register <domain> <hash>  register a domain of a bucket, signed with -key (or -identity of the keystore)
+  domain resolve <domain>          resolve a domain
+  key gen <name> [type]            generate an identity in the keystore (ed25519, secp256k1, rsa, ecdsa)
+  key import <name> <file>         import an identity from a key file
+  key export <name> [file]         export an identity into a key file (stdout if file is missing or '-')
+  key ls                           list the identities in the keystore
+  key rm <name>                    delete an identity from the keystore
+
+Bucket updates are signed by the gateway, -identity selects one of its identities.
+Over libp2p (-peer) only 'bucket ls', 'bucket content' and 'get' are supported.
+The passphrase of the keystore is read from KEYSTORE_PASSPHRASE.
+
+Flags:
+`
+
+// options are the global flags
+type options struct {
+	api      string
+	peer     string
+	psk      string
+	key      string
+	json     bool
+	fileType string
+	keystore string
+	identity string
+}
+
+func main() {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var opts options
+	fs := flag.NewFlagSet("cbn", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.api, "api", os.Getenv("CBN_API"), "url of the http gateway (env CBN_API)")
+	fs.StringVar(&opts.peer, "peer", os.Getenv("CBN_PEER"), "multiaddr of a node (env CBN_PEER), used if -api is not set")
+	fs.StringVar(&opts.psk, "psk", os.Getenv("PSK"), "private network key, required with -peer (env PSK)")
+	fs.StringVar(&opts.key, "key", os.Getenv("PK_PATH"), "path of the private key (env PK_PATH), used to sign records")
+	fs.StringVar(&opts.keystore, "keystore", os.Getenv("KEYSTORE_PATH"), "directory of the local keystore (env KEYSTORE_PATH)")
+	fs.StringVar(&opts.identity, "identity", os.Getenv("IDENTITY"), "name of the identity that signs updates (env IDENTITY)")
+	fs.BoolVar(&opts.json, "json", false, "print json output")
+	fs.StringVar(&opts.fileType, "type", "", "content type of uploaded files, detected by extension if empty")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	err := execute(&opts, fs.Args(), stdin, stdout)
+	if err == usageErr {
+		fs.Usage()
+		return exitUsage
+	} else if err == notSupportedErr {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	} else if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitErr
+	}
+	return exitOK
+}
+
+func newClient(opts *options) (client, error) {
+	if len(opts.api) > 0 {
+		return newHttpClient(opts.api, opts.identity), nil
+	}
+	if len(opts.peer) > 0 {
+		if len(opts.psk) == 0 {
+			return nil, errors.New("psk is required to connect a node")
+		}
+		// an ephemeral key is used unless a key was given
+		priv, _, err := libp2pcrypto.GenerateKeyPair(libp2pcrypto.Ed25519, -1)
+		if len(opts.key) > 0 {
+			priv, err = loadKey(opts.key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newLibp2pClient(opts.peer, []byte(opts.psk), priv)
+	}
+	return nil, errors.New("either -api or -peer must be set")
+}
+
+func execute(opts *options, args []string, stdin io.Reader, stdout io.Writer) error {
+	cmd := args[0]
+	args = args[1:]
+	if cmd == "bucket" || cmd == "domain" || cmd == "key" {
+		if len(args) == 0 {
+			return usageErr
+		}
+		cmd = cmd + " " + args[0]
+		args = args[1:]
+	}
+	minArgs := map[string]int{
+		"bucket create":   1,
+		"bucket ls":       0,
+		"bucket content":  1,
+		"bucket rm":       2,
+		"bucket multisig": 3,
+		"bucket pending":  1,
+		"bucket sign":     1,
+		"bucket push":     2,
+		"put":             2,
+		"get":             2,
+		"domain register": 2,
+		"domain resolve":  1,
+		"key gen":         1,
+		"key import":      2,
+		"key export":      1,
+		"key ls":          0,
+		"key rm":          1,
+	}
+	if n, ok := minArgs[cmd]; !ok || len(args) < n {
+		return usageErr
+	}
+
+	out := printer{stdout, opts.json}
+	if strings.HasPrefix(cmd, "key ") {
+		return executeKey(opts, cmd, args, out)
+	}
+	if cmd == "bucket sign" {
+		return signBucket(opts, args[0], stdin, out)
+	}
+
+	// the libp2p client supports read commands only, others are rejected before connecting
+	libp2pCommands := map[string]bool{"bucket ls": true, "bucket content": true, "get": true}
+	if len(opts.api) == 0 && len(opts.peer) > 0 && !libp2pCommands[cmd] {
+		return notSupportedErr
+	}
+
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	switch cmd {
+	case "bucket create":
+		b, err := c.CreateBucket(args[0])
+		if err != nil {
+			return err
+		}
+		return out.print(b, b.Hash)
+	case "bucket multisig":
+		threshold, err := strconv.Atoi(args[1])
+		if err != nil {
+			return usageErr
+		}
+		b, err := c.CreateMultisigBucket(args[0], threshold, args[2:])
+		if err != nil {
+			return err
+		}
+		return out.print(b, b.Hash)
+	case "bucket pending":
+		raw, err := c.PendingBucket(args[0])
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 && args[1] != "-" {
+			return ioutil.WriteFile(args[1], raw, 0644)
+		}
+		_, err = fmt.Fprintln(stdout, string(raw))
+		return err
+	case "bucket push":
+		raw, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		b, err := c.AddSignatures(args[0], raw)
+		if err != nil {
+			return err
+		}
+		status := "saved"
+		if b.Pending {
+			status = "pending"
+		}
+		return out.print(b, status+" "+b.Hash)
+	case "bucket ls":
+		buckets, err := c.ListBuckets()
+		if err != nil {
+			return err
+		}
+		lines := []string{}
+		for _, b := range buckets {
+			lines = append(lines, fmt.Sprintf("%s\t%s", b.Hash, b.Name))
+		}
+		return out.print(buckets, lines...)
+	case "bucket content":
+		dirPath := ""
+		if len(args) > 1 {
+			dirPath = args[1]
+		}
+		names, err := c.BucketContent(args[0], dirPath)
+		if err != nil {
+			return err
+		}
+		return out.print(names, names...)
+	case "bucket rm":
+		pending, err := c.Remove(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return out.print(map[string]interface{}{"removed": args[1], "pending": pending}, pendingLine("removed "+args[1], pending))
+	case "put":
+		r := stdin
+		if len(args) > 2 && args[2] != "-" {
+			f, err := os.Open(args[2])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		fileType := opts.fileType
+		if len(fileType) == 0 {
+			fileType = mime.TypeByExtension(path.Ext(args[1]))
+		}
+		pending, err := c.Put(args[0], args[1], fileType, r)
+		if err != nil {
+			return err
+		}
+		return out.print(map[string]interface{}{"uploaded": args[1], "pending": pending}, pendingLine("uploaded "+args[1], pending))
+	case "get":
+		w := stdout
+		if len(args) > 2 && args[2] != "-" {
+			f, err := os.Create(args[2])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return c.Get(args[0], args[1], w)
+	case "domain register":
+		priv, err := signingKey(opts)
+		if err != nil {
+			return err
+		}
+		pkraw, err := libp2pcrypto.MarshalPublicKey(priv.GetPublic())
+		if err != nil {
+			return err
+		}
+		rec := core.NewDomainRecord(args[1], args[0], pkraw)
+		if err = rec.Sign(priv); err != nil {
+			return err
+		}
+		d, err := c.RegisterDomain(rec)
+		if err != nil {
+			return err
+		}
+		return out.print(d, fmt.Sprintf("%s\t%s", d.Domain, d.Hash))
+	case "domain resolve":
+		d, err := c.ResolveDomain(args[0])
+		if err != nil {
+			return err
+		}
+		return out.print(d, d.Hash)
+	}
+	return usageErr
+}
+
+// pendingLine notes that an update of a multisig bucket waits for signatures
+func pendingLine(line string, pending bool) string {
+	if pending {
+		return line + " (pending signatures)"
+	}
+	return line
+}
+
+// signBucket adds a partial signature to a pending (multisig) bucket, the file is updated in place
+// or read from stdin and written to stdout if '-'
+func signBucket(opts *options, file string, stdin io.Reader, out printer) error {
+	var raw []byte
+	var err error
+	if file == "-" {
+		raw, err = ioutil.ReadAll(stdin)
+	} else {
+		raw, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	bucket, err := core.ParsePendingBucket("", raw)
+	if err != nil {
+		return err
+	}
+	priv, err := signingKey(opts)
+	if err != nil {
+		return err
+	}
+	if err = bucket.SignPartial(priv); err != nil {
+		return err
+	}
+	if raw, err = core.SerializePendingBucket(bucket); err != nil {
+		return err
+	}
+	if file == "-" {
+		_, err = fmt.Fprintln(out.w, string(raw))
+		return err
+	}
+	if err = ioutil.WriteFile(file, raw, 0644); err != nil {
+		return err
+	}
+	signatures := len(bucket.PartialSignatures())
+	return out.print(map[string]int{"signatures": signatures}, fmt.Sprintf("signatures: %d/%d", signatures, bucket.Multisig().Threshold))
+}
+
+// executeKey executes the commands of the local keystore
+func executeKey(opts *options, cmd string, args []string, out printer) error {
+	ks, err := openKeystore(opts)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "key gen":
+		keyType := ""
+		if len(args) > 1 {
+			keyType = args[1]
+		}
+		t, err := cipher.ParseKeyType(keyType)
+		if err != nil {
+			return err
+		}
+		priv, err := ks.Generate(args[0], t)
+		if err != nil {
+			return err
+		}
+		id, err := peer.IDFromPrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		return out.print(map[string]string{"name": args[0], "id": id.Pretty()}, id.Pretty())
+	case "key import":
+		priv, err := loadKey(args[1])
+		if err != nil {
+			return err
+		}
+		if err = ks.Import(args[0], priv); err != nil {
+			return err
+		}
+		return out.print(map[string]string{"imported": args[0]}, "imported "+args[0])
+	case "key export":
+		raw, err := ks.Export(args[0])
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 && args[1] != "-" {
+			return ioutil.WriteFile(args[1], raw, 0400)
+		}
+		_, err = out.w.Write(raw)
+		return err
+	case "key ls":
+		keys, err := ks.List()
+		if err != nil {
+			return err
+		}
+		lines := []string{}
+		for _, k := range keys {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s", k.Name, k.Type, k.ID))
+		}
+		return out.print(keys, lines...)
+	case "key rm":
+		if err := ks.Delete(args[0]); err != nil {
+			return err
+		}
+		return out.print(map[string]string{"removed": args[0]}, "removed "+args[0])
+	}
+	return usageErr
+}
+
+func openKeystore(opts *options) (*cipher.Keystore, error) {
+	if len(opts.keystore) == 0 {
+		return nil, errors.New("-keystore is required")
+	}
+	return cipher.NewKeystore(opts.keystore, os.Getenv("KEYSTORE_PASSPHRASE"))
+}
+
+// signingKey returns the identity of the local keystore if configured, otherwise the key file (-key)
+func signingKey(opts *options) (libp2pcrypto.PrivKey, error) {
+	if len(opts.keystore) > 0 && len(opts.identity) > 0 {
+		ks, err := openKeystore(opts)
+		if err != nil {
+			return nil, err
+		}
+		return ks.Get(opts.identity)
+	}
+	return loadKey(opts.key)
+}
+
+// loadKey loads an existing private key, records must be signed with a persisted key
+func loadKey(keyPath string) (libp2pcrypto.PrivKey, error) {
+	if len(keyPath) == 0 {
+		return nil, errors.New("-key is required")
+	}
+	raw, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return libp2pcrypto.UnmarshalPrivateKey(raw)
+}
+
+// printer prints the output of commands as json or as lines of text
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func (p printer) print(v interface{}, lines ...string) error {
+	if p.json {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(p.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newGateway returns a fake http gateway that holds the uploaded files in memory
+func newGateway(t *testing.T) *httptest.Server {
+	files := map[string][]byte{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/buckets", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": bucketInfo{Hash: "h1", Name: "mybucket", Updated: 1}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": []bucketInfo{{Hash: "h1", Name: "mybucket", Updated: 1}}})
+	})
+	mux.HandleFunc("/buckets/h1/files", func(w http.ResponseWriter, r *http.Request) {
+		f, h, err := r.FormFile("files")
+		if !assert.Nil(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		files[r.FormValue("path")+"/"+h.Filename] = data
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": []string{h.Filename}})
+	})
+	mux.HandleFunc("/buckets/h1/", func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[strings.TrimPrefix(r.URL.Path, "/buckets/h1/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+			return
+		}
+		w.Write(data)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestRun(t *testing.T) {
+	gw := newGateway(t)
+	defer gw.Close()
+
+	exec := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, _, stderr := exec("")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, "Usage:")
+	code, _, _ = exec("", "-api", gw.URL, "bucket", "unknown")
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = exec("", "-api", gw.URL, "put", "h1")
+	assert.Equal(t, exitUsage, code)
+
+	code, stdout, _ := exec("", "-api", gw.URL, "bucket", "create", "mybucket")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "h1\n", stdout)
+
+	code, stdout, _ = exec("", "-api", gw.URL, "-json", "bucket", "ls")
+	assert.Equal(t, exitOK, code)
+	var buckets []bucketInfo
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &buckets))
+	assert.Equal(t, []bucketInfo{{Hash: "h1", Name: "mybucket", Updated: 1}}, buckets)
+
+	code, stdout, _ = exec("some content", "-api", gw.URL, "put", "h1", "docs/a.txt")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "uploaded docs/a.txt\n", stdout)
+	code, stdout, _ = exec("", "-api", gw.URL, "get", "h1", "docs/a.txt")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "some content", stdout)
+
+	code, stdout, stderr = exec("", "-api", gw.URL, "get", "h1", "docs/missing.txt")
+	assert.Equal(t, exitErr, code)
+	assert.Empty(t, stdout)
+	assert.Equal(t, "Error: 404: not found\n", stderr)
+
+	// write commands are rejected over libp2p before connecting
+	code, _, stderr = exec("", "-api=", "-peer", "/ip4/127.0.0.1/tcp/1", "-psk", "secret", "bucket", "create", "mybucket")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, notSupportedErr.Error())
+	code, _, _ = exec("", "-api=", "-peer", "/ip4/127.0.0.1/tcp/1", "-psk", "secret", "domain", "resolve", "example.com")
+	assert.Equal(t, exitUsage, code)
+}
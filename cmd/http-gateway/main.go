@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	httpapi "github.com/amirylm/cbn/src/api/http"
+	"github.com/amirylm/cbn/src/cipher"
 	"github.com/amirylm/cbn/src/commons"
+	"github.com/amirylm/cbn/src/core"
 	"github.com/amirylm/cbn/src/core/p2p"
+	"github.com/amirylm/cbn/src/metrics"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -27,7 +30,7 @@ func init() {
 }
 
 func main() {
-	cfg, _ := commons.LoadConfig()
+	cfg, ndCfg := commons.LoadConfig()
 	cfg.Discovery = p2pfacade.NewDiscoveryConfig(func(pi peer.AddrInfo) bool {
 		go func(pi peer.AddrInfo) {
 			id := pi.ID.Pretty()
@@ -54,21 +57,74 @@ func main() {
 	log.Println("peer is ready:")
 	log.Println(p2pfacade.SerializePeer(nodePeer.Host()))
 
+	if ndCfg.ShardingThreshold > 0 {
+		p2p.BucketShardingThreshold = ndCfg.ShardingThreshold
+	}
+	hashAlg, err := cipher.ParseHashAlg(ndCfg.BucketHash)
+	if err != nil {
+		log.Fatal("could not use bucket hash: ", err)
+	}
+	core.BucketHashAlg = hashAlg
+	core.LegacyCutoff = ndCfg.LegacyCutoff.Unix()
 	ctrl := p2p.NewP2PController(nodePeer)
+	// the index is set on the sources of the controller, before any goroutine uses them
+	prov := p2p.NewProviderIndex(ctrl)
+	if err := ctrl.UseKeystore(commons.NewKeystore(ndCfg), ndCfg.Identity); err != nil {
+		log.Fatal("could not use identity: ", err)
+	}
+	domains := p2p.NewP2PDomainRegistry(nodePeer)
+	pins := core.NewPinManager(ctrl, domains)
+	pins.Declare(ndCfg.Pins)
+	go pins.Start()
+	prov.AddRoots(pins.Roots)
+	go func() {
+		if err := prov.Start(); err != nil {
+			log.Println("could not start provider index:", err)
+		}
+	}()
+	repl := p2p.NewReplicator(ctrl, pins)
+	repl.Accept = ndCfg.AcceptReplicas
+	repl.MaxSize = ndCfg.ReplicasMaxSize
+	repl.PeerQuota = ndCfg.ReplicasPeerQuota
+	nodePeer.Host().SetStreamHandler(p2p.HoldingsProtocol, repl.HoldingsHandler())
+	nodePeer.Host().SetStreamHandler(p2p.ReplicateProtocol, repl.ReplicateHandler())
+	deals := p2p.NewP2PDealRegistry(nodePeer)
 
 	router := gin.Default()
 
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 
+	if err := metrics.RegisterPeers(nodePeer.Host()); err != nil {
+		log.Println("could not register peers metrics:", err)
+	}
+	httpapi.RegisterMetricsRoutes(router)
 	httpapi.RegisterBucketRoutes(router, ctrl)
 	httpapi.RegisterDownloadRoutes(router, ctrl)
 	httpapi.RegisterUploadRoutes(router, ctrl)
+	httpapi.RegisterEventRoutes(router, ctrl)
+	httpapi.RegisterCarRoutes(router, ctrl)
+	httpapi.RegisterPinRoutes(router, pins)
+	httpapi.RegisterReplicationRoutes(router, repl)
+	httpapi.RegisterDealRoutes(router, deals)
+	httpapi.RegisterDomainRoutes(router, domains)
+	httpapi.RegisterRegistryRoutes(router, ctrl.BucketRegistry().(*p2p.P2PBucketRegistry))
 
 	go func() {
 		log.Fatal(router.Run(":3010"))
 	}()
 
+	// routes that modify the node are only served on the local admin server
+	if len(ndCfg.AdminAddr) > 0 {
+		admin := gin.New()
+		admin.Use(gin.Recovery())
+		httpapi.RegisterPinAdminRoutes(admin, pins)
+		httpapi.RegisterRegistryAdminRoutes(admin, ctrl.BucketRegistry().(*p2p.P2PBucketRegistry))
+		go func() {
+			log.Println("admin server stopped:", admin.Run(ndCfg.AdminAddr))
+		}()
+	}
+
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
@@ -2,20 +2,40 @@ package main
 
 import (
 	"context"
+	httpapi "github.com/amirylm/cbn/src/api/http"
 	libp2p_handlers "github.com/amirylm/cbn/src/api/libp2p"
+	"github.com/amirylm/cbn/src/cipher"
 	"github.com/amirylm/cbn/src/commons"
+	"github.com/amirylm/cbn/src/core"
 	"github.com/amirylm/cbn/src/core/p2p"
+	"github.com/amirylm/cbn/src/metrics"
 	p2pfacade "github.com/amirylm/libp2p-facade/core"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/gin-gonic/gin"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/joho/godotenv"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
+// node holds the components of the running node
+type node struct {
+	ctrl *core.Controller
+	gc   *p2p.GarbageCollector
+	pins *core.PinManager
+	repl *p2p.Replicator
+	prov *p2p.ProviderIndex
+	dm   *p2p.DealMaker
+	aud  *p2p.Auditor
+	ldg  *p2p.Ledger
+}
+
 func init() {
 	err := godotenv.Load()
 	if err != nil {
@@ -59,16 +79,109 @@ func main() {
 	log.Println("peer is ready:")
 	log.Println(p2pfacade.SerializePeer(nodePeer.Host()))
 
+	if ndCfg.ShardingThreshold > 0 {
+		p2p.BucketShardingThreshold = ndCfg.ShardingThreshold
+	}
+	hashAlg, err := cipher.ParseHashAlg(ndCfg.BucketHash)
+	if err != nil {
+		log.Fatal("could not use bucket hash: ", err)
+	}
+	core.BucketHashAlg = hashAlg
+	core.LegacyCutoff = ndCfg.LegacyCutoff.Unix()
 	ctrl := p2p.NewP2PController(nodePeer)
+	// the index is set on the sources of the controller, before any goroutine uses them
+	prov := p2p.NewProviderIndex(ctrl)
+	if err := ctrl.UseKeystore(commons.NewKeystore(ndCfg), ndCfg.Identity); err != nil {
+		log.Fatal("could not use identity: ", err)
+	}
+
+	if len(ndCfg.MetricsAddr) > 0 {
+		if err := metrics.RegisterPeers(nodePeer.Host()); err != nil {
+			log.Println("could not register peers metrics:", err)
+		}
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			log.Println("metrics server stopped:", http.ListenAndServe(ndCfg.MetricsAddr, mux))
+		}()
+	}
+
+	ldg := p2p.NewLedger(nodePeer)
+	ldg.DebtLimit = ndCfg.DebtLimit
+	setStreamHandler(nodePeer, p2p.ReceiptProtocol, ldg.ReceiptHandler())
+	if ndCfg.ReceiptInterval > 0 {
+		go ldg.Start(ndCfg.ReceiptInterval)
+	}
+
+	setStreamHandler(nodePeer, p2p.ListBucketsProtocol, ldg.Handler(libp2p_handlers.ListBucketsHandler(ctrl)))
+	setStreamHandler(nodePeer, p2p.GetBucketProtocol, ldg.Handler(libp2p_handlers.GetBucketContentHandler(ctrl)))
+	setStreamHandler(nodePeer, p2p.SaveBucketProtocol, libp2p_handlers.SaveBucketHandler(ctrl))
+	setStreamHandler(nodePeer, p2p.DownProtocol, ldg.Handler(libp2p_handlers.DownloadHandler(ctrl)))
+	setStreamHandler(nodePeer, p2p.SubscribeBucketsProtocol, libp2p_handlers.SubscribeBucketsHandler(ctrl))
+
+	gc := p2p.NewGarbageCollector(ctrl)
+	gc.RetainVersions = ndCfg.GCRetainVersions
+	if ndCfg.GCInterval > 0 {
+		go gc.Start(ndCfg.GCInterval)
+	}
+
+	pins := core.NewPinManager(ctrl, p2p.NewP2PDomainRegistry(nodePeer))
+	pins.Declare(ndCfg.Pins)
+	gc.SetRetention(pins.Retention)
+	gc.AddRoots(pins.Roots)
+	go pins.Start()
 
-	nodePeer.Host().SetStreamHandler(p2p.ListBucketsProtocol, libp2p_handlers.ListBucketsHandler(ctrl))
-	nodePeer.Host().SetStreamHandler(p2p.GetBucketProtocol, libp2p_handlers.GetBucketContentHandler(ctrl))
-	nodePeer.Host().SetStreamHandler(p2p.SaveBucketProtocol, libp2p_handlers.SaveBucketHandler(ctrl))
-	nodePeer.Host().SetStreamHandler(p2p.DownProtocol, libp2p_handlers.DownloadHandler(ctrl))
+	repl := p2p.NewReplicator(ctrl, pins)
+	repl.Accept = ndCfg.AcceptReplicas
+	repl.MaxSize = ndCfg.ReplicasMaxSize
+	repl.PeerQuota = ndCfg.ReplicasPeerQuota
+	setStreamHandler(nodePeer, p2p.HoldingsProtocol, repl.HoldingsHandler())
+	setStreamHandler(nodePeer, p2p.ReplicateProtocol, repl.ReplicateHandler())
+	if ndCfg.ReplicationInterval > 0 {
+		go repl.Start(ndCfg.ReplicationInterval)
+	}
+
+	prov.AddRoots(pins.Roots)
+	go func() {
+		if err := prov.Start(); err != nil {
+			log.Println("could not start provider index:", err)
+		}
+	}()
+
+	dm := p2p.NewDealMaker(ctrl, p2p.NewP2PDealRegistry(nodePeer), pins)
+	if ndCfg.AcceptDeals {
+		dm.Policy = p2p.NewDealPolicy(ndCfg.DealsMaxSize, ndCfg.DealsMaxDuration, ndCfg.DealsMinPrice)
+	}
+	setStreamHandler(nodePeer, p2p.DealProtocol, dm.ProposalHandler())
+
+	aud := p2p.NewAuditor(ctrl, dm.Registry())
+	setStreamHandler(nodePeer, p2p.ChallengeProtocol, p2p.ChallengeHandler(nodePeer))
+	if ndCfg.AuditInterval > 0 {
+		go aud.Start(ndCfg.AuditInterval)
+	}
+
+	n := node{ctrl, gc, pins, repl, prov, dm, aud, ldg}
+
+	if len(ndCfg.AdminAddr) > 0 {
+		router := gin.New()
+		router.Use(gin.Recovery())
+		heads, err := p2p.NewHeadTracker(nodePeer)
+		if err != nil {
+			log.Fatal("could not track crdt heads:", err)
+		}
+		httpapi.RegisterAdminRoutes(router, ctrl, gc, heads, ndCfg.ReadyMinPeers)
+		httpapi.RegisterPinRoutes(router, pins)
+		httpapi.RegisterPinAdminRoutes(router, pins)
+		httpapi.RegisterRegistryRoutes(router, ctrl.BucketRegistry().(*p2p.P2PBucketRegistry))
+		httpapi.RegisterRegistryAdminRoutes(router, ctrl.BucketRegistry().(*p2p.P2PBucketRegistry))
+		go func() {
+			log.Println("admin server stopped:", router.Run(ndCfg.AdminAddr))
+		}()
+	}
 
 	if ndCfg.Terminal {
 		go func() {
-			startTerminal(ctrl)
+			startTerminal(&n)
 		}()
 	}
 
@@ -76,3 +189,8 @@ func main() {
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 }
+
+// setStreamHandler registers the given handler, latency and errors of the handler are measured
+func setStreamHandler(nodePeer *p2pstorage.MultiStorePeer, pid protocol.ID, h network.StreamHandler) {
+	nodePeer.Host().SetStreamHandler(pid, metrics.StreamHandler(pid, h))
+}
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/amirylm/cbn/src/cipher"
 	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/core/p2p"
 	"github.com/c-bata/go-prompt"
+	"github.com/ipfs/go-cid"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func startTerminal(ctrl *core.Controller) error  {
+func startTerminal(n *node) error {
 	for {
 		t := prompt.Input("> ", completer)
 
@@ -23,7 +36,7 @@ func startTerminal(ctrl *core.Controller) error  {
 				action := fields[0]
 				fields = fields[1:]
 
-				err := handler(ctrl, action, fields...)
+				err := handler(n, action, fields...)
 				if err != nil {
 					log.Println("Error:", err)
 				}
@@ -36,39 +49,73 @@ func startTerminal(ctrl *core.Controller) error  {
 func completer(d prompt.Document) []prompt.Suggest {
 	s := []prompt.Suggest{
 		{Text: "create_bucket <name>", Description: "Create a new bucket"},
-		{Text: "bucket_content <hash>", Description: "Get bucket content names"},
+		{Text: "bucket_content <hash> <path>", Description: "Get bucket (or sub directory) content names"},
 		{Text: "buckets", Description: "List buckets"},
-		{Text: "upload <bucket> <filepath> <filetype>", Description: "Upload a file"},
+		{Text: "upload <bucket> <filepath> <filetype> <name>", Description: "Upload a file, name is optional and might be a path"},
+		{Text: "upload_dir <bucket> <dirpath> <path>", Description: "Upload a directory with a single commit, path within the bucket is optional"},
 		{Text: "download <bucket> <name> <targetpath>", Description: "Download a file"},
+		{Text: "export_car <bucket> <targetpath>", Description: "Export a bucket as a car file"},
+		{Text: "import_car <filepath>", Description: "Import a bucket from a car file"},
+		{Text: "snapshot <targetpath>", Description: "Export the records of all buckets as a car file"},
+		{Text: "restore <filepath>", Description: "Restore the records of buckets from a snapshot"},
+		{Text: "reindex", Description: "Rebuild the local index of buckets"},
+		{Text: "move <bucket> <from> <to>", Description: "Move or rename a file or directory"},
+		{Text: "remove <bucket> <name>", Description: "Remove a file or directory"},
+		{Text: "gc <dry>", Description: "Remove unreachable blocks, use 'gc dry' to only report"},
+		{Text: "pin <hash|owner|domain> <value> <keep>", Description: "Pin buckets, keep is the amount of previous versions to keep"},
+		{Text: "unpin <hash|owner|domain> <value>", Description: "Remove a pin"},
+		{Text: "pins", Description: "List pins and the status of pinned buckets"},
+		{Text: "set_replicas <bucket> <replicas>", Description: "Set the desired amount of replicas of a bucket"},
+		{Text: "replication <bucket>", Description: "Check the replicas of a bucket and replicate if needed"},
+		{Text: "providers <cid>", Description: "List the known providers of a cid"},
+		{Text: "propose_deal <peer> <bucket> <duration> <price>", Description: "Propose a storage deal of a bucket to some node"},
+		{Text: "deals", Description: "List storage deals"},
+		{Text: "audit <peer> <cid>", Description: "Challenge a node to prove that it stores some data"},
+		{Text: "audits <peer>", Description: "List audit results, peer is optional"},
+		{Text: "ledger", Description: "List the bandwidth accounts of peers"},
+		{Text: "keys", Description: "List the identities in the keystore"},
+		{Text: "key_gen <name> <type>", Description: "Generate a new identity, type is optional (ed25519, secp256k1, rsa, ecdsa)"},
+		{Text: "key_import <name> <filepath>", Description: "Import an identity from a key file"},
+		{Text: "key_export <name> <targetpath>", Description: "Export an identity into a key file"},
+		{Text: "key_delete <name>", Description: "Delete an identity"},
+		{Text: "identity <name>", Description: "Select the identity that signs buckets, without name resets to the peer key"},
+		{Text: "rotate_key <bucket> <identity>", Description: "Delegate the signing authority of a bucket to another identity"},
 	}
 	return prompt.FilterHasPrefix(s, d.GetWordBeforeCursor(), true)
 }
 
-func handler(ctrl *core.Controller, action string, fields ...string) error {
+func handler(n *node, action string, fields ...string) error {
+	ctrl := n.ctrl
 	switch action {
 	case "create_bucket":
 		name := fields[0]
-		b, err := ctrl.CreateBucket(name, ctrl.Peer().PrivKey())
+		b, err := ctrl.CreateBucket(name, nil)
 		if err != nil {
 			return err
 		}
-		raw, err := core.SerializeBucket(b)
+		raw, err := json.Marshal(core.ToBucketMsg(b))
 		fmt.Println("new bucket was created:", string(raw))
 		break
 	case "buckets":
 		ctrl.ListBuckets(func(b *core.Bucket) bool {
-			raw, _ := core.SerializeBucket(b)
+			raw, _ := json.Marshal(core.ToBucketMsg(b))
 			fmt.Println(string(raw))
 			return false // don't collect
 		})
 		break
 	case "bucket_content":
 		hash := fields[0]
-		names, err := ctrl.GetBucketContent(hash)
+		dirPath := ""
+		if len(fields) > 1 {
+			dirPath = fields[1]
+		}
+		err := ctrl.ForEachBucketEntry(hash, dirPath, func(name string) (bool, error) {
+			fmt.Println(name)
+			return true, nil
+		})
 		if err != nil {
 			return err
 		}
-		fmt.Println(names)
 		break
 	case "upload":
 		bucket := fields[0]
@@ -79,12 +126,310 @@ func handler(ctrl *core.Controller, action string, fields ...string) error {
 			return err
 		}
 		stats, _ := f.Stat()
-		err = ctrl.Upload(bucket, *core.NewFileHeader(stats.Name(), filetype), f, ctrl.Peer().PrivKey())
+		name := stats.Name()
+		if len(fields) > 3 {
+			name = fields[3]
+		}
+		err = ctrl.Upload(bucket, *core.NewFileHeader(name, filetype), f, nil)
 		if err != nil {
 			return err
 		}
 		fmt.Println("file was uploaded!")
 		break
+	case "upload_dir":
+		bucket := fields[0]
+		dirpath := fields[1]
+		target := ""
+		if len(fields) > 2 {
+			target = fields[2]
+		}
+		n, err := uploadDir(ctrl, bucket, dirpath, target)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d files were uploaded!\n", n)
+		break
+	case "export_car":
+		bucket := fields[0]
+		f, err := os.Create(fields[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err = ctrl.ExportBucket(bucket, f); err != nil {
+			return err
+		}
+		fmt.Println("bucket was exported!")
+		break
+	case "import_car":
+		f, err := os.Open(fields[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		b, err := ctrl.ImportBucket(f)
+		if err != nil {
+			return err
+		}
+		fmt.Println("bucket was imported:", b.Hash())
+		break
+	case "snapshot":
+		f, err := os.Create(fields[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		count, err := registry(ctrl).Snapshot(f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d buckets were exported!\n", count)
+		break
+	case "restore":
+		f, err := os.Open(fields[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		report, err := registry(ctrl).Restore(f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %d buckets, skipped %d buckets\n", report.Restored, report.Skipped)
+		break
+	case "reindex":
+		count, err := registry(ctrl).Reindex()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d buckets were indexed!\n", count)
+		break
+	case "gc":
+		dryRun := len(fields) > 0 && fields[0] == "dry"
+		report, err := n.gc.Run(dryRun)
+		if err != nil {
+			return err
+		}
+		for _, c := range report.Removed {
+			fmt.Println(c.String())
+		}
+		fmt.Printf("removed %d blocks (%d bytes), kept %d blocks, dry-run: %v\n",
+			len(report.Removed), report.Freed, report.Marked, report.DryRun)
+		break
+	case "pin":
+		p, err := core.ParsePin(strings.Join(fields, ":"))
+		if err != nil {
+			return err
+		}
+		if err = n.pins.Pin(*p); err != nil {
+			return err
+		}
+		fmt.Println("pinned:", p.String())
+		break
+	case "unpin":
+		if len(fields) < 2 {
+			return core.PinNotValidErr
+		}
+		if err := n.pins.Unpin(core.PinKind(fields[0]), fields[1]); err != nil {
+			return err
+		}
+		break
+	case "pins":
+		for _, p := range n.pins.Pins() {
+			fmt.Println("pin:", p.String())
+		}
+		for _, st := range n.pins.Status() {
+			fmt.Printf("%s %s blocks: %d, size: %d %s\n", st.Hash, st.State, st.Blocks, st.Size, st.Error)
+		}
+		break
+	case "set_replicas":
+		replicas, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return err
+		}
+		return ctrl.SetReplicas(fields[0], replicas, nil)
+	case "replication":
+		st, err := n.repl.Check(fields[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("replicas: %d, under-replicated: %d\n", st.Replicas, st.UnderReplicated)
+		for _, ref := range st.Refs {
+			fmt.Printf("%s (%s) holders: %v, requested: %v\n", ref.Path, ref.Cid, ref.Holders, ref.Requested)
+		}
+		break
+	case "providers":
+		c, err := cid.Decode(fields[0])
+		if err != nil {
+			return err
+		}
+		for _, pi := range n.prov.FindProviders(c) {
+			fmt.Println(pi.String())
+		}
+		break
+	case "propose_deal":
+		pid, err := peer.Decode(fields[0])
+		if err != nil {
+			return err
+		}
+		duration, err := time.ParseDuration(fields[2])
+		if err != nil {
+			return err
+		}
+		price, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return err
+		}
+		d, err := n.dm.ProposeBucket(pid, fields[1], duration, price)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deal %s was accepted, expires at %s\n", d.ID(), time.Unix(d.Expires(), 0))
+		break
+	case "deals":
+		return n.dm.Registry().ForEach(func(id string, d *core.Deal) (bool, error) {
+			dp := d.Proposal()
+			fmt.Printf("%s bucket: %s, cids: %d, size: %d, price: %d, provider: %s, active: %v\n",
+				id, dp.Bucket(), len(dp.Cids()), dp.Size(), dp.Price(), dp.Provider(), d.Active(time.Now()))
+			return true, nil
+		})
+	case "audit":
+		pid, err := peer.Decode(fields[0])
+		if err != nil {
+			return err
+		}
+		c, err := cid.Decode(fields[1])
+		if err != nil {
+			return err
+		}
+		res, err := n.aud.Audit(pid, c)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("passed: %v, latency: %s %s\n", res.Passed, res.Latency, res.Error)
+		break
+	case "audits":
+		holder := ""
+		if len(fields) > 0 {
+			holder = fields[0]
+		}
+		results, err := n.aud.Results(holder)
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			fmt.Printf("%s %s %s passed: %v, latency: %s %s\n",
+				time.Unix(res.Time, 0), res.Peer, res.Cid, res.Passed, res.Latency, res.Error)
+		}
+		break
+	case "ledger":
+		for _, a := range n.ldg.Accounts() {
+			fmt.Printf("%s sent: %d, received: %d, acknowledged: %d, debt: %d\n",
+				a.Peer, a.Sent, a.Received, a.Acknowledged, a.Debt())
+		}
+		break
+	case "keys":
+		ks, err := keystore(ctrl)
+		if err != nil {
+			return err
+		}
+		keys, err := ks.List()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			fmt.Printf("%s %s %s\n", k.Name, k.Type, k.ID)
+		}
+		break
+	case "key_gen":
+		ks, err := keystore(ctrl)
+		if err != nil {
+			return err
+		}
+		keyType := ""
+		if len(fields) > 1 {
+			keyType = fields[1]
+		}
+		t, err := cipher.ParseKeyType(keyType)
+		if err != nil {
+			return err
+		}
+		priv, err := ks.Generate(fields[0], t)
+		if err != nil {
+			return err
+		}
+		id, _ := peer.IDFromPrivateKey(priv)
+		fmt.Println("new identity was created:", id.Pretty())
+		break
+	case "key_import":
+		ks, err := keystore(ctrl)
+		if err != nil {
+			return err
+		}
+		raw, err := ioutil.ReadFile(fields[1])
+		if err != nil {
+			return err
+		}
+		priv, err := libp2pcrypto.UnmarshalPrivateKey(raw)
+		if err != nil {
+			return err
+		}
+		return ks.Import(fields[0], priv)
+	case "key_export":
+		ks, err := keystore(ctrl)
+		if err != nil {
+			return err
+		}
+		raw, err := ks.Export(fields[0])
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(fields[1], raw, 0400)
+	case "key_delete":
+		ks, err := keystore(ctrl)
+		if err != nil {
+			return err
+		}
+		return ks.Delete(fields[0])
+	case "identity":
+		name := ""
+		if len(fields) > 0 {
+			name = fields[0]
+		}
+		if err := ctrl.SetIdentity(name); err != nil {
+			return err
+		}
+		priv, _ := ctrl.Identity("")
+		id, _ := peer.IDFromPrivateKey(priv)
+		fmt.Println("buckets are signed by:", id.Pretty())
+		break
+	case "rotate_key":
+		next, err := ctrl.Identity(fields[1])
+		if err != nil {
+			return err
+		}
+		b, err := ctrl.RotateKey(fields[0], next, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("bucket is signed by %s, rotations: %d\n", fields[1], len(b.Rotations()))
+		break
+	case "move":
+		bucket := fields[0]
+		err := ctrl.Move(bucket, fields[1], fields[2], nil)
+		if err != nil {
+			return err
+		}
+		fmt.Println("moved!")
+		break
+	case "remove":
+		bucket := fields[0]
+		err := ctrl.Remove(bucket, fields[1], nil)
+		if err != nil {
+			return err
+		}
+		fmt.Println("removed!")
+		break
 	case "download":
 		bucket := fields[0]
 		name := fields[1]
@@ -114,3 +459,48 @@ func handler(ctrl *core.Controller, action string, fields ...string) error {
 	}
 	return nil
 }
+
+// keystore returns the keystore of the controller, which is configured with KEYSTORE_PATH
+func keystore(ctrl *core.Controller) (*cipher.Keystore, error) {
+	ks := ctrl.Keystore()
+	if ks == nil {
+		return nil, errors.New("keystore is not configured, set KEYSTORE_PATH")
+	}
+	return ks, nil
+}
+
+// registry returns the p2p bucket registry of the node
+func registry(ctrl *core.Controller) *p2p.P2PBucketRegistry {
+	return ctrl.BucketRegistry().(*p2p.P2PBucketRegistry)
+}
+
+// uploadDir uploads all the files in the given directory into the bucket with a single commit
+func uploadDir(ctrl *core.Controller, bucket, dirpath, target string) (int, error) {
+	batch, err := ctrl.NewBatch(bucket)
+	if err != nil {
+		return 0, err
+	}
+	err = filepath.Walk(dirpath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dirpath, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		name := path.Join(target, filepath.ToSlash(rel))
+		_, err = batch.Add(*core.NewFileHeader(name, mime.TypeByExtension(filepath.Ext(p))), f)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := batch.Len()
+	_, err = batch.Commit(nil)
+	return n, err
+}
@@ -0,0 +1,165 @@
+package http
+
+import (
+	"context"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/core/p2p"
+	"github.com/gin-gonic/gin"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"net/http"
+	"time"
+)
+
+var (
+	// AdminConnectTimeout limits the time of connecting a peer
+	AdminConnectTimeout = 30 * time.Second
+)
+
+// peerInfoMsg describes a connected peer
+type peerInfoMsg struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+// connectRequest is the body of connect requests, the address must include the peer id ('/p2p/<id>')
+type connectRequest struct {
+	Addr string `json:"addr"`
+}
+
+// RegisterAdminRoutes registers the routes that are used to manage a node,
+// readiness requires minPeers connected peers and synced crdt stores, i.e. all the heads that
+// remote peers announced are available locally. until remote heads were announced for every store,
+// the node is not ready for CrdtSyncGracePeriod
+func RegisterAdminRoutes(router *gin.Engine, ctrl *core.Controller, gc *p2p.GarbageCollector, heads *p2p.HeadTracker, minPeers int) error {
+	node := ctrl.Peer()
+	started := time.Now()
+
+	// liveness
+	router.GET("/healthz", func(c *gin.Context) {
+		if node.Context().Err() != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "closed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// readiness, the result of each check is returned
+	router.GET("/readyz", func(c *gin.Context) {
+		checks := map[string]string{}
+		ready := true
+		fail := func(check, reason string) {
+			checks[check] = reason
+			ready = false
+		}
+
+		if _, err := node.Store().Has(ds.NewKey("/readyz")); err != nil {
+			fail("datastore", err.Error())
+		} else {
+			checks["datastore"] = "ok"
+		}
+
+		if peers := len(node.Host().Network().Peers()); peers < minPeers {
+			fail("peers", "not enough peers")
+		} else {
+			checks["peers"] = "ok"
+		}
+
+		statuses, err := heads.Status()
+		if err != nil {
+			fail("crdt", err.Error())
+		} else {
+			checks["crdt"] = "ok"
+			for _, st := range statuses {
+				if !st.Synced() {
+					fail("crdt", st.Name+" is not synced")
+				} else if st.LastAnnounce == 0 && time.Since(started) < p2p.CrdtSyncGracePeriod {
+					fail("crdt", "waiting for remote heads of "+st.Name)
+				}
+			}
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"ready": ready, "checks": checks})
+	})
+
+	// list connected peers
+	router.GET("/peers", func(c *gin.Context) {
+		h := node.Host()
+		items := []peerInfoMsg{}
+		for _, pid := range h.Network().Peers() {
+			msg := peerInfoMsg{ID: pid.Pretty(), Addrs: []string{}}
+			for _, conn := range h.Network().ConnsToPeer(pid) {
+				msg.Addrs = append(msg.Addrs, conn.RemoteMultiaddr().String())
+			}
+			items = append(items, msg)
+		}
+		respond(c, items)
+	})
+
+	// connect a peer
+	router.POST("/peers", func(c *gin.Context) {
+		var req connectRequest
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse request: " + err.Error()})
+			return
+		}
+		ma, err := multiaddr.NewMultiaddr(req.Addr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse address: " + err.Error()})
+			return
+		}
+		pi, err := peer.AddrInfoFromP2pAddr(ma)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse address: " + err.Error()})
+			return
+		}
+		ctx, cancel := context.WithTimeout(node.Context(), AdminConnectTimeout)
+		defer cancel()
+		if err = node.Host().Connect(ctx, *pi); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "could not connect peer: " + err.Error()})
+			return
+		}
+		respond(c, pi.ID.Pretty())
+	})
+
+	// disconnect a peer
+	router.DELETE("/peers/:id", func(c *gin.Context) {
+		pid, err := peer.Decode(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse peer id: " + err.Error()})
+			return
+		}
+		if err = node.Host().Network().ClosePeer(pid); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not disconnect peer: " + err.Error()})
+			return
+		}
+		respond(c, pid.Pretty())
+	})
+
+	// sync status of crdt stores
+	router.GET("/crdt", func(c *gin.Context) {
+		statuses, err := heads.Status()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not get crdt status: " + err.Error()})
+			return
+		}
+		respond(c, statuses)
+	})
+
+	// trigger GC, 'dry=true' query param only reports unreachable blocks
+	router.POST("/gc", func(c *gin.Context) {
+		report, err := gc.Run(c.Query("dry") == "true")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not run gc: " + err.Error()})
+			return
+		}
+		respond(c, report)
+	})
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package http
+
+import (
+	"fmt"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+// archiveBucket streams an entire bucket as an archive, 'format' query param: tar (default), tar.gz or zip.
+// served as 'GET /buckets/:hash/archive' (see RegisterDownloadRoutes)
+func archiveBucket(c *gin.Context, ctrl *core.Controller, hash string) {
+	format, err := core.ParseArchiveFormat(c.Query("format"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if has, err := ctrl.BucketRegistry().Has(hash); err != nil || !has {
+		c.JSON(http.StatusNotFound, gin.H{"error": "could not find bucket"})
+		return
+	}
+	c.Header("Content-Type", format.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", hash, format))
+	c.Status(http.StatusOK)
+	if err := ctrl.ArchiveBucket(hash, format, c.Writer); err != nil {
+		// headers were already sent
+		log.Println("could not archive bucket:", err)
+	}
+}
@@ -1,8 +1,14 @@
 package http
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/amirylm/cbn/src/cipher"
+	"github.com/amirylm/cbn/src/commons"
 	"github.com/amirylm/cbn/src/core"
 	"github.com/gin-gonic/gin"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -13,6 +19,43 @@ func respond(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusOK, gin.H{"data": data, "time": time.Now().Unix()})
 }
 
+// respondPending responds once a multisig bucket was updated but waits for more signatures
+func respondPending(c *gin.Context, data interface{}) {
+	c.JSON(http.StatusAccepted, gin.H{"data": data, "pending": true, "time": time.Now().Unix()})
+}
+
+// multisigOwner creates a multisig owner out of the encoded peer ids of the signers,
+// the ids must embed the public keys (e.g. ed25519 or secp256k1 keys)
+func multisigOwner(threshold int, signers []string) (*cipher.MultisigOwner, error) {
+	keys := []libp2pcrypto.PubKey{}
+	for _, s := range signers {
+		pid, err := peer.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		pk, err := pid.ExtractPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pk)
+	}
+	return cipher.NewMultisigOwner(threshold, keys...)
+}
+
+// identityKey returns the key of the requested identity, or nil (the default identity) if no identity was requested.
+// the request is aborted if the identity could not be used
+func identityKey(c *gin.Context, ctrl *core.Controller, name string) (libp2pcrypto.PrivKey, bool) {
+	if len(name) == 0 {
+		return nil, true
+	}
+	priv, err := ctrl.Identity(name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not use identity: " + err.Error()})
+		return nil, false
+	}
+	return priv, true
+}
+
 func RegisterBucketRoutes(router *gin.Engine, ctrl *core.Controller) error {
 	// list all buckets
 	router.GET("/buckets", func(c *gin.Context) {
@@ -25,14 +68,131 @@ func RegisterBucketRoutes(router *gin.Engine, ctrl *core.Controller) error {
 		respond(c, items)
 	})
 
-	// list bucket content (names)
+	// list bucket content (names), 'path' query param can be used to list a sub directory
+	// names are streamed so large buckets won't be loaded into memory
 	router.GET("/buckets/:hash", func(c *gin.Context) {
 		hash := c.Param("hash")
-		content, err := ctrl.GetBucketContent(hash)
+		if has, err := ctrl.BucketRegistry().Has(hash); err != nil || !has {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find bucket"})
+			return
+		}
+		// the response starts streaming with the first entry, so errors of resolving the directory
+		// are returned with a proper status
+		started := false
+		start := func() {
+			started = true
+			c.Status(http.StatusOK)
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			c.Writer.WriteString(`{"data":[`)
+		}
+		err := ctrl.ForEachBucketEntry(hash, c.Query("path"), func(name string) (bool, error) {
+			raw, err := json.Marshal(name)
+			if err != nil {
+				return false, err
+			}
+			if started {
+				c.Writer.WriteString(",")
+			} else {
+				start()
+			}
+			_, err = c.Writer.Write(raw)
+			return err == nil, err
+		})
+		if err != nil && !started {
+			if err == commons.NotFoundErr {
+				c.JSON(http.StatusNotFound, gin.H{"error": "could not find " + c.Query("path")})
+			} else if err == commons.BadInputErr || err == core.InvalidPathErr {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid path " + c.Query("path")})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "could not get bucket content: " + err.Error()})
+			}
+			return
+		} else if err != nil {
+			// headers were already sent
+			log.Println("could not get bucket content:", err)
+		} else if !started {
+			start()
+		}
+		c.Writer.WriteString(fmt.Sprintf(`],"time":%d}`, time.Now().Unix()))
+	})
+
+	// create a new bucket, owned by the gateway (or by the given identity of the gateway),
+	// or by a multisig owner if signers (peer ids) are given
+	router.POST("/buckets", func(c *gin.Context) {
+		var req struct {
+			Name      string   `json:"name"`
+			Identity  string   `json:"identity"`
+			Threshold int      `json:"threshold"`
+			Signers   []string `json:"signers"`
+		}
+		if err := c.BindJSON(&req); err != nil || len(req.Name) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse request"})
+			return
+		}
+		priv, ok := identityKey(c, ctrl, req.Identity)
+		if !ok {
+			return
+		}
+		if len(req.Signers) > 0 {
+			owner, err := multisigOwner(req.Threshold, req.Signers)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse signers: " + err.Error()})
+				return
+			}
+			bucket, err := ctrl.CreateMultisigBucket(req.Name, owner, priv)
+			if err == core.PendingSignaturesErr {
+				respondPending(c, core.ToBucketMsg(bucket))
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create bucket: " + err.Error()})
+				return
+			}
+			respond(c, core.ToBucketMsg(bucket))
+			return
+		}
+		bucket, err := ctrl.CreateBucket(req.Name, priv)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create bucket: " + err.Error()})
+			return
+		}
+		respond(c, core.ToBucketMsg(bucket))
+	})
+
+	// the pending version of a multisig bucket, to be signed offline
+	router.GET("/pending/:hash", func(c *gin.Context) {
+		bucket, err := ctrl.Pending(c.Param("hash"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find pending bucket"})
+			return
+		}
+		respond(c, core.ToBucketMsg(bucket))
+	})
+
+	// add the partial signatures of a (signed offline) multisig bucket,
+	// the bucket is saved once enough signatures were collected
+	router.POST("/pending/:hash", func(c *gin.Context) {
+		hash := c.Param("hash")
+		payload, err := ioutil.ReadAll(c.Request.Body)
 		if err != nil {
-			log.Panic("could not get bucket content")
+			log.Panic("could not read payload")
 		}
-		respond(c, content)
+		signed, err := core.ParsePendingBucket(hash, payload)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse bucket: " + err.Error()})
+			return
+		}
+		bucket, err := ctrl.AddSignatures(hash, signed)
+		if err == core.PendingSignaturesErr {
+			respondPending(c, core.ToBucketMsg(bucket))
+			return
+		} else if err == commons.NotFoundErr {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find pending bucket"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not add signatures: " + err.Error()})
+			return
+		}
+		respond(c, core.ToBucketMsg(bucket))
 	})
 
 	// TODO: add api to update bucket source (to be called before upload of signed bucket)
@@ -50,15 +210,14 @@ func RegisterBucketRoutes(router *gin.Engine, ctrl *core.Controller) error {
 			return
 		}
 		err = ctrl.SaveSignedBucket(bucket)
-		if err != nil {
+		if err == core.SeqConflictErr || err == core.SupersededKeyErr {
+			c.JSON(http.StatusConflict, gin.H{"error": "could not save bucket: " + err.Error()})
+			return
+		} else if err != nil {
 			log.Panic("could not save bucket")
 		}
-		raw, err := core.SerializeBucket(bucket)
-		if err != nil {
-			log.Panic("could not serialize bucket")
-		}
-		respond(c, string(raw))
+		respond(c, core.ToBucketMsg(bucket))
 	})
 
 	return nil
-}
\ No newline at end of file
+}
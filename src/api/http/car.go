@@ -0,0 +1,40 @@
+package http
+
+import (
+	"fmt"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+const carContentType = "application/vnd.ipld.car"
+
+// exportCar streams a bucket as a car file, served as 'GET /buckets/:hash/car' (see RegisterDownloadRoutes)
+func exportCar(c *gin.Context, ctrl *core.Controller, hash string) {
+	if has, err := ctrl.BucketRegistry().Has(hash); err != nil || !has {
+		c.JSON(http.StatusNotFound, gin.H{"error": "could not find bucket"})
+		return
+	}
+	c.Header("Content-Type", carContentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.car\"", hash))
+	c.Status(http.StatusOK)
+	if err := ctrl.ExportBucket(hash, c.Writer); err != nil {
+		// headers were already sent
+		log.Println("could not export bucket:", err)
+	}
+}
+
+func RegisterCarRoutes(router *gin.Engine, ctrl *core.Controller) error {
+	// import a bucket from a car file (request body)
+	router.POST("/car", func(c *gin.Context) {
+		bucket, err := ctrl.ImportBucket(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not import car: " + err.Error()})
+			return
+		}
+		respond(c, core.ToBucketMsg(bucket))
+	})
+
+	return nil
+}
@@ -1,25 +1,81 @@
 package http
 
 import (
+	"github.com/amirylm/cbn/src/cipher"
+	"github.com/amirylm/cbn/src/commons"
 	"github.com/amirylm/cbn/src/core"
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
+	"path"
 )
 
 func RegisterDownloadRoutes(router *gin.Engine, ctrl *core.Controller) error {
-	// download data from some bucket
-	router.GET("/buckets/:hash/:name", func(c *gin.Context) {
+	// download data from some bucket, name might be a path within the bucket.
+	// '/car' and '/archive' (at the root of the bucket) export the entire bucket, as gin allows no other routes under '/buckets/:hash/'
+	router.GET("/buckets/:hash/*name", func(c *gin.Context) {
 		hash := c.Param("hash")
-		name := c.Param("name")
+		switch c.Param("name") {
+		case "/car":
+			exportCar(c, ctrl, hash)
+			return
+		case "/archive":
+			archiveBucket(c, ctrl, hash)
+			return
+		}
+		name, err := core.CleanPath(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file name"})
+			return
+		}
+
+		if len(name) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing file name"})
+			return
+		}
 
-		reader, ref,  err := ctrl.Download(hash, name)
+		reader, ref, err := ctrl.Download(hash, name)
 		if err != nil {
 			log.Panic("could not download data:", err)
 		}
 
 		c.DataFromReader(http.StatusOK, int64(ref.Header.Size), ref.Header.Type, reader, map[string]string{})
 	})
+
+	// remove a file or directory from some bucket, optional 'identity' query param selects the signing identity
+	// NOTE: the bucket is signed with the gateway key, therefore it must be the owner
+	router.DELETE("/buckets/:hash/*name", func(c *gin.Context) {
+		hash := c.Param("hash")
+		name, err := core.CleanPath(c.Param("name"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file name"})
+			return
+		}
+
+		if len(name) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing file name"})
+			return
+		}
+		priv, ok := identityKey(c, ctrl, c.Query("identity"))
+		if !ok {
+			return
+		}
+		err = ctrl.Remove(hash, name, priv)
+		if err == core.PendingSignaturesErr {
+			respondPending(c, name)
+			return
+		} else if err == commons.NotFoundErr {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find " + name})
+			return
+		} else if err == cipher.NotVerifiedErr {
+			c.JSON(http.StatusForbidden, gin.H{"error": "bucket is not owned by the gateway"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not remove: " + err.Error()})
+			return
+		}
+		respond(c, name)
+	})
 	return nil
 }
 
@@ -39,6 +95,62 @@ func RegisterUploadRoutes(router *gin.Engine, ctrl *core.Controller) error {
 		respond(c, dr)
 	})
 
+	// upload multiple files ('files' form field) into some bucket with a single commit,
+	// optional 'path' form field is the target directory within the bucket,
+	// optional 'identity' form field selects the signing identity.
+	// NOTE: the bucket is signed with the gateway key, therefore it must be the owner
+	router.POST("/buckets/:hash/files", func(c *gin.Context) {
+		hash := c.Param("hash")
+		form, err := c.MultipartForm()
+		if err != nil || len(form.File["files"]) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not read files"})
+			return
+		}
+		priv, ok := identityKey(c, ctrl, c.PostForm("identity"))
+		if !ok {
+			return
+		}
+		batch, err := ctrl.NewBatch(hash)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find bucket"})
+			return
+		}
+		dirPath := c.PostForm("path")
+		refs := []*core.DataRef{}
+		for _, fh := range form.File["files"] {
+			file, err := fh.Open()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "could not read file " + fh.Filename})
+				return
+			}
+			name, err := core.CleanPath(path.Join(dirPath, fh.Filename))
+			if err != nil {
+				file.Close()
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file name " + fh.Filename})
+				return
+			}
+			dr, err := batch.Add(*core.NewFileHeader(name, fh.Header.Get("Content-Type")), file)
+			file.Close()
+			if err == commons.AlreadyExistsErr {
+				c.JSON(http.StatusConflict, gin.H{"error": name + " is a directory"})
+				return
+			} else if err != nil {
+				log.Panic("could not upload file:", err)
+			}
+			refs = append(refs, dr)
+		}
+		if _, err = batch.Commit(priv); err == core.PendingSignaturesErr {
+			respondPending(c, refs)
+			return
+		} else if err == cipher.NotVerifiedErr {
+			c.JSON(http.StatusForbidden, gin.H{"error": "bucket is not owned by the gateway"})
+			return
+		} else if err != nil {
+			log.Panic("could not commit bucket:", err)
+		}
+		respond(c, refs)
+	})
+
 	// upload any payload
 	router.POST("/data/:name", func(c *gin.Context) {
 		name := c.Param("name")
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"github.com/amirylm/cbn/src/commons"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+func RegisterDealRoutes(router *gin.Engine, deals core.DealRegistry) error {
+	// list deals, 'active=true' query param returns only deals that are not expired
+	router.GET("/deals", func(c *gin.Context) {
+		activeOnly := c.Query("active") == "true"
+		now := time.Now()
+		items := []interface{}{}
+		err := deals.ForEach(func(id string, d *core.Deal) (bool, error) {
+			if !activeOnly || d.Active(now) {
+				items = append(items, core.ToDealMsg(d))
+			}
+			return true, nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list deals: " + err.Error()})
+			return
+		}
+		respond(c, items)
+	})
+
+	// get a single deal
+	router.GET("/deals/:id", func(c *gin.Context) {
+		d, err := deals.Load(c.Param("id"))
+		if err == commons.NotFoundErr {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find deal"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load deal: " + err.Error()})
+			return
+		}
+		respond(c, core.ToDealMsg(d))
+	})
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package http
+
+import (
+	"github.com/amirylm/cbn/src/core"
+	"github.com/gin-gonic/gin"
+	ds "github.com/ipfs/go-datastore"
+	"io/ioutil"
+	"net/http"
+)
+
+func RegisterDomainRoutes(router *gin.Engine, domains core.DomainRegistry) error {
+	// resolve a domain into its record
+	router.GET("/domains/:domain", func(c *gin.Context) {
+		rec, err := domains.Resolve(c.Param("domain"))
+		if err == ds.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find domain"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not resolve domain: " + err.Error()})
+			return
+		}
+		respond(c, gin.H{"domain": rec.Domain(), "hash": rec.Hash()})
+	})
+
+	// register a signed domain record
+	router.POST("/domains", func(c *gin.Context) {
+		payload, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not read payload"})
+			return
+		}
+		rec, err := core.ParseDomainRecord(payload)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse domain record"})
+			return
+		}
+		if err = domains.Register(rec); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "could not register domain: " + err.Error()})
+			return
+		}
+		respond(c, gin.H{"domain": rec.Domain(), "hash": rec.Hash()})
+	})
+
+	return nil
+}
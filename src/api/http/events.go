@@ -0,0 +1,43 @@
+package http
+
+import (
+	"github.com/amirylm/cbn/src/core"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+)
+
+func RegisterEventRoutes(router *gin.Engine, ctrl *core.Controller) error {
+	// stream bucket changes as server-sent events,
+	// optional query params: 'hash' (repeated) and 'owner' (peer id)
+	router.GET("/events/buckets", func(c *gin.Context) {
+		filter, err := core.NewBucketEventFilter(c.QueryArray("hash"), c.Query("owner"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse filter"})
+			return
+		}
+		events, cancel := ctrl.SubscribeBuckets(filter)
+		defer cancel()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case evt, ok := <-events:
+				if !ok {
+					return false
+				}
+				data := gin.H{"type": evt.Type, "hash": evt.Hash}
+				if evt.Bucket != nil {
+					data["bucket"] = core.ToBucketMsg(evt.Bucket)
+				}
+				c.SSEvent(string(evt.Type), data)
+				return true
+			}
+		})
+		log.Println("events subscriber disconnected")
+	})
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package http
+
+import (
+	"github.com/amirylm/cbn/src/metrics"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterMetricsRoutes exposes prometheus metrics, and counts the bytes that are served by the router.
+// it should be called before the other routes are registered, otherwise their responses are not counted
+func RegisterMetricsRoutes(router *gin.Engine) error {
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		if size := c.Writer.Size(); size > 0 {
+			metrics.BytesServed.WithLabelValues("http").Add(float64(size))
+		}
+	})
+
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"github.com/amirylm/cbn/src/core"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func RegisterPinRoutes(router *gin.Engine, pins *core.PinManager) error {
+	// list pins and the status of pinned buckets
+	router.GET("/pins", func(c *gin.Context) {
+		respond(c, gin.H{"pins": pins.Pins(), "status": pins.Status()})
+	})
+
+	// status of a single pinned bucket
+	router.GET("/pins/status/:hash", func(c *gin.Context) {
+		st, ok := pins.StatusOf(c.Param("hash"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "bucket is not pinned"})
+			return
+		}
+		respond(c, st)
+	})
+
+	return nil
+}
+
+// RegisterPinAdminRoutes registers the routes that add or remove pins,
+// they should be served only on the admin server
+func RegisterPinAdminRoutes(router *gin.Engine, pins *core.PinManager) error {
+	// add a pin, expects json body: {"kind": "hash|owner|domain", "value": "...", "keep": 0}
+	router.POST("/pins", func(c *gin.Context) {
+		var p core.Pin
+		if err := c.BindJSON(&p); err != nil {
+			return
+		}
+		if err := pins.Pin(p); err != nil {
+			if err == core.PinNotValidErr {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not pin: " + err.Error()})
+			return
+		}
+		respond(c, p)
+	})
+
+	// remove a pin
+	router.DELETE("/pins/:kind/:value", func(c *gin.Context) {
+		if err := pins.Unpin(core.PinKind(c.Param("kind")), c.Param("value")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not unpin: " + err.Error()})
+			return
+		}
+		respond(c, gin.H{"kind": c.Param("kind"), "value": c.Param("value")})
+	})
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"fmt"
+	"github.com/amirylm/cbn/src/core/p2p"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RegisterRegistryRoutes registers the read-only routes of the registry
+func RegisterRegistryRoutes(router *gin.Engine, reg *p2p.P2PBucketRegistry) error {
+	// list the indexed metadata of buckets, records are not read
+	router.GET("/registry/index", func(c *gin.Context) {
+		entries := []*p2p.BucketIndexEntry{}
+		err := reg.ForEachIndexed(func(e *p2p.BucketIndexEntry) (bool, error) {
+			entries = append(entries, e)
+			return true, nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not read index: " + err.Error()})
+			return
+		}
+		respond(c, entries)
+	})
+
+	// export the records of all buckets as a car file
+	router.GET("/registry/snapshot", func(c *gin.Context) {
+		c.Header("Content-Type", carContentType)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"registry-%d.car\"", time.Now().Unix()))
+		c.Status(http.StatusOK)
+		if _, err := reg.Snapshot(c.Writer); err != nil {
+			// headers were already sent
+			log.Println("could not snapshot registry:", err)
+		}
+	})
+
+	return nil
+}
+
+// RegisterRegistryAdminRoutes registers the routes that rebuild or restore the registry,
+// they should be served only on the admin server
+func RegisterRegistryAdminRoutes(router *gin.Engine, reg *p2p.P2PBucketRegistry) error {
+	// rebuild the index out of the crdt store
+	router.POST("/registry/reindex", func(c *gin.Context) {
+		n, err := reg.Reindex()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not rebuild index: " + err.Error()})
+			return
+		}
+		respond(c, n)
+	})
+
+	// restore the records of buckets from a snapshot (request body)
+	router.POST("/registry/restore", func(c *gin.Context) {
+		report, err := reg.Restore(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not restore snapshot: " + err.Error()})
+			return
+		}
+		respond(c, report)
+	})
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package http
+
+import (
+	"github.com/amirylm/cbn/src/commons"
+	"github.com/amirylm/cbn/src/core/p2p"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func RegisterReplicationRoutes(router *gin.Engine, repl *p2p.Replicator) error {
+	// replication status of a bucket, 'refresh' query param forces a new inspection
+	router.GET("/replication/:hash", func(c *gin.Context) {
+		hash := c.Param("hash")
+		var st *p2p.ReplicationStatus
+		var err error
+		if c.Query("refresh") == "true" {
+			st, err = repl.Inspect(hash)
+		} else {
+			st, err = repl.Status(hash)
+		}
+		if err == commons.NotFoundErr {
+			c.JSON(http.StatusNotFound, gin.H{"error": "could not find bucket"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not get replication status: " + err.Error()})
+			return
+		}
+		respond(c, st)
+	})
+
+	return nil
+}
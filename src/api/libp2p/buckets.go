@@ -25,11 +25,16 @@ func SaveBucketHandler(ctrl *core.Controller) network.StreamHandler {
 			log.Panic("could not parse bucket", err)
 		}
 		err = ctrl.SaveSignedBucket(bucket)
-		if err != nil {
+		if err == core.SeqConflictErr || err == core.SupersededKeyErr {
+			// replays or rollbacks of remote peers are rejected
+			log.Println("could not save bucket:", err)
+			stream.Reset()
+			return
+		} else if err != nil {
 			log.Panic("could not save bucket", err)
 		}
 		w := msgio.NewWriter(stream)
-		err = w.WriteMsg([]byte(core.BucketHash(bucket.Name(), bucket.PK())))
+		err = w.WriteMsg([]byte(bucket.Hash()))
 		if err != nil {
 			log.Panic("could not send response", err)
 		}
@@ -43,23 +48,36 @@ func GetBucketContentHandler(ctrl *core.Controller) network.StreamHandler {
 		mr := msgio.NewReader(bufio.NewReader(stream))
 		msg, err := mr.ReadMsg()
 		if err != nil {
-			log.Panic("could not read message", err)
+			log.Println("could not read message:", err)
+			stream.Reset()
+			return
 		}
 		p, err := api.ParsePointer(string(msg))
 		if err != nil {
-			log.Panic("could not parse pointer", err)
+			log.Println("could not parse pointer:", err)
+			stream.Reset()
+			return
+		}
+		// pointer name is used as the directory path, which is chosen by the remote peer
+		content, err := ctrl.GetBucketDirContent(p.Bucket, p.Name)
+		if err != nil {
+			log.Println("could not get bucket content:", err)
+			stream.Reset()
+			return
 		}
-		content, err := ctrl.GetBucketContent(p.Bucket)
 		raw, err := json.Marshal(map[string][]string{
 			"Items": content,
 		})
 		if err != nil {
-			log.Panic("could not marshal content")
+			log.Println("could not marshal content:", err)
+			stream.Reset()
+			return
 		}
 		w := msgio.NewWriter(stream)
 		err = w.WriteMsg(raw)
 		if err != nil {
-			log.Panic("could not send response", err)
+			log.Println("could not send response:", err)
+			stream.Reset()
 		}
 	}
 }
@@ -92,3 +110,96 @@ func ReadBuckets(stream network.Stream) ([]core.Bucket, error) {
 	}
 	return buckets.Items, nil
 }
+
+// SubscribeRequest is sent by the subscriber to select the desired events
+type SubscribeRequest struct {
+	// Hashes of the desired buckets, empty to get all buckets
+	Hashes []string
+	// Owner is the encoded peer id of the buckets owner, empty to get all owners
+	Owner string
+}
+
+// SubscribeBucketsHandler streams bucket events to the remote peer until the stream is closed
+func SubscribeBucketsHandler(ctrl *core.Controller) network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		mr := msgio.NewReader(bufio.NewReader(stream))
+		msg, err := mr.ReadMsg()
+		if err != nil {
+			log.Println("could not read subscribe request:", err)
+			stream.Reset()
+			return
+		}
+		var req SubscribeRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			log.Println("could not parse subscribe request:", err)
+			stream.Reset()
+			return
+		}
+		filter, err := core.NewBucketEventFilter(req.Hashes, req.Owner)
+		if err != nil {
+			log.Println("could not create filter:", err)
+			stream.Reset()
+			return
+		}
+		events, cancel := ctrl.SubscribeBuckets(filter)
+		defer cancel()
+
+		// detect that the subscriber closed the stream
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			mr.ReadMsg()
+		}()
+
+		w := msgio.NewWriter(stream)
+		for {
+			select {
+			case <-done:
+				return
+			case evt := <-events:
+				raw, err := core.SerializeBucketEvent(&evt)
+				if err != nil {
+					log.Println("could not serialize event:", err)
+					continue
+				}
+				if err := w.WriteMsg(raw); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// WriteSubscribeRequest sends the subscription request to the remote peer
+func WriteSubscribeRequest(stream network.Stream, req *SubscribeRequest) error {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return msgio.NewWriter(stream).WriteMsg(raw)
+}
+
+// ReadBucketEvents reads bucket events from the given stream, the returned channel is closed once the stream ends
+func ReadBucketEvents(stream network.Stream) <-chan core.BucketEvent {
+	events := make(chan core.BucketEvent)
+	go func() {
+		defer close(events)
+
+		r := msgio.NewReader(stream)
+		for {
+			raw, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			evt, err := core.ParseBucketEvent(raw)
+			if err != nil {
+				log.Println("could not parse event:", err)
+				continue
+			}
+			events <- *evt
+		}
+	}()
+	return events
+}
@@ -13,14 +13,22 @@ func DownloadHandler(ctrl *core.Controller) network.StreamHandler {
 
 		ptr, err := ReadPointer(stream)
 		if err != nil {
-			log.Fatal("could not read pointer:", err)
+			log.Println("could not read pointer:", err)
+			stream.Reset()
+			return
 		}
 
 		rsc, _, err := ctrl.Download(ptr.Bucket, ptr.Name)
+		if err != nil {
+			log.Println("could not download:", err)
+			stream.Reset()
+			return
+		}
 
 		_, err = io.Copy(stream, rsc)
 		if err != nil {
-			log.Fatal("could not write stream:", err)
+			log.Println("could not write stream:", err)
+			stream.Reset()
 		}
 	}
 }
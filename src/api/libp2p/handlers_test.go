@@ -32,7 +32,7 @@ func TestLibp2pHandlers(t *testing.T) {
 	assert.Nil(t, err)
 	err = ctrls[1].Commit(bucket, nil)
 	assert.Nil(t, err)
-	bucketHash := core.BucketHash(bucket.Name(), bucket.PK())
+	bucketHash := bucket.Hash()
 	b2, err := ctrls[2].CreateBucket(bucketName+"2", nil)
 	assert.Nil(t, err)
 	err = ctrls[2].Commit(b2, nil)
@@ -98,12 +98,22 @@ Do am he horrible distance marriage so although. Afraid assure square so happen
 		assert.Equal(t, 1, len(parsed["Items"]))
 	}()
 	wg.Wait()
+
+	// invalid directory paths of remote peers reset the stream
+	for _, dirPath := range []string{"../other", "missing", name} {
+		stream, err := ctrls[0].Peer().Host().NewStream(context.Background(), ctrls[1].Peer().Host().ID(), p2p.GetBucketProtocol)
+		assert.Nil(t, err)
+		assert.Nil(t, WritePointer(stream, api.NewPointer(bucketHash, dirPath)))
+		_, err = msgio.NewReader(stream).ReadMsg()
+		assert.NotNil(t, err)
+		stream.Close()
+	}
 }
 
 func setupGroup(n int, psk pnet.PSK) ([]*core.Controller, error) {
 	ctrls := []*core.Controller{}
 	_, err := p2pfacade.SetupGroup(n, func() p2pfacade.LibP2PPeer {
-		priv, _, _ := crypto.GenerateKeyPair(crypto.RSA, 2048)
+		priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
 
 		cfg := p2pfacade.NewConfig(priv, psk, nil)
 		base := p2pfacade.NewBasePeer(context.Background(), cfg)
@@ -117,6 +127,7 @@ func setupGroup(n int, psk pnet.PSK) ([]*core.Controller, error) {
 		mspeer.Host().SetStreamHandler(p2p.ListBucketsProtocol, ListBucketsHandler(ctrl))
 		mspeer.Host().SetStreamHandler(p2p.GetBucketProtocol, GetBucketContentHandler(ctrl))
 		mspeer.Host().SetStreamHandler(p2p.DownProtocol, DownloadHandler(ctrl))
+		mspeer.Host().SetStreamHandler(p2p.SubscribeBucketsProtocol, SubscribeBucketsHandler(ctrl))
 
 		return mspeer
 	})
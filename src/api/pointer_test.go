@@ -33,3 +33,12 @@ func TestNewPointer(t *testing.T) {
 	assert.Equal(t, bh, parsed.Bucket)
 	assert.Equal(t, cn, parsed.Name)
 }
+
+func TestNestedPointer(t *testing.T) {
+	bh := hex.EncodeToString(cipher.Hash([]byte("mybucket")))
+	parsed, err := ParsePointer("/bucket/" + bh + "/a/b/c.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, bh, parsed.Bucket)
+	assert.Equal(t, "a/b/c.txt", parsed.Name)
+	assert.Equal(t, "/bucket/"+bh+"/a/b/c.txt", parsed.String())
+}
@@ -0,0 +1,181 @@
+// Package car implements reading and writing of CAR (content addressable archive) files,
+// see https://ipld.io/specs/transport/car/
+// CARv1 is written, both CARv1 and CARv2 are readable.
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"io"
+)
+
+const (
+	// maxSectionSize limits the size of a single header or block
+	maxSectionSize = 8 << 20
+	v2HeaderSize   = 40
+)
+
+var (
+	// v2Pragma is the fixed prefix of CARv2 files
+	v2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+	UnsupportedVersionErr = errors.New("unsupported car version")
+	NoRootsErr            = errors.New("car has no roots")
+	SectionTooLargeErr    = errors.New("car section is too large")
+	BadBlockErr           = errors.New("block data does not match cid")
+)
+
+func init() {
+	cbor.RegisterCborType(Header{})
+}
+
+// Header is the CARv1 header
+type Header struct {
+	Roots   []cid.Cid `refmt:"roots"`
+	Version uint64    `refmt:"version"`
+}
+
+// Writer writes blocks in CARv1 format
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the header with the given roots and returns a writer for the blocks
+func NewWriter(w io.Writer, roots []cid.Cid) (*Writer, error) {
+	if len(roots) == 0 {
+		return nil, NoRootsErr
+	}
+	raw, err := cbor.DumpObject(&Header{roots, 1})
+	if err != nil {
+		return nil, err
+	}
+	cw := Writer{w}
+	if err = cw.writeSection(raw); err != nil {
+		return nil, err
+	}
+	return &cw, nil
+}
+
+// WriteBlock writes a single block
+func (cw *Writer) WriteBlock(c cid.Cid, data []byte) error {
+	return cw.writeSection(c.Bytes(), data)
+}
+
+func (cw *Writer) writeSection(parts ...[]byte) error {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(size))
+	if _, err := cw.w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := cw.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader reads blocks out of CARv1 or CARv2 data
+type Reader struct {
+	r *bufio.Reader
+
+	Header Header
+}
+
+// NewReader reads the header of the given car data
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(len(v2Pragma))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, v2Pragma) {
+		if br, err = readV2Payload(br); err != nil {
+			return nil, err
+		}
+	}
+	cr := Reader{r: br}
+	raw, err := cr.readSection()
+	if err != nil {
+		return nil, err
+	}
+	if err = cbor.DecodeInto(raw, &cr.Header); err != nil {
+		return nil, err
+	}
+	if cr.Header.Version != 1 {
+		return nil, UnsupportedVersionErr
+	}
+	if len(cr.Header.Roots) == 0 {
+		return nil, NoRootsErr
+	}
+	return &cr, nil
+}
+
+// readV2Payload skips the CARv2 header and returns a reader of the inner CARv1 payload
+func readV2Payload(br *bufio.Reader) (*bufio.Reader, error) {
+	if _, err := br.Discard(len(v2Pragma)); err != nil {
+		return nil, err
+	}
+	h := make([]byte, v2HeaderSize)
+	if _, err := io.ReadFull(br, h); err != nil {
+		return nil, err
+	}
+	// characteristics (16 bytes) are followed by data offset and data size (little endian)
+	offset := binary.LittleEndian.Uint64(h[16:24])
+	size := binary.LittleEndian.Uint64(h[24:32])
+	read := uint64(len(v2Pragma) + v2HeaderSize)
+	if offset < read {
+		return nil, UnsupportedVersionErr
+	}
+	if _, err := br.Discard(int(offset - read)); err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(io.LimitReader(br, int64(size))), nil
+}
+
+// Next returns the next block, the block data is verified against its cid.
+// io.EOF is returned once there are no more blocks
+func (cr *Reader) Next() (blocks.Block, error) {
+	raw, err := cr.readSection()
+	if err != nil {
+		return nil, err
+	}
+	n, c, err := cid.CidFromBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	data := raw[n:]
+	expected, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !expected.Equals(c) {
+		return nil, fmt.Errorf("%w: %s", BadBlockErr, c.String())
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (cr *Reader) readSection() ([]byte, error) {
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSectionSize {
+		return nil, SectionTooLargeErr
+	}
+	raw := make([]byte, size)
+	if _, err = io.ReadFull(cr.r, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
@@ -0,0 +1,73 @@
+package car
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	data := [][]byte{[]byte("block 1"), []byte("block 2"), []byte("block 3")}
+	cids := []cid.Cid{}
+	for _, d := range data {
+		c, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}.Sum(d)
+		assert.Nil(t, err)
+		cids = append(cids, c)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, cids[:1])
+	assert.Nil(t, err)
+	for i, d := range data {
+		assert.Nil(t, w.WriteBlock(cids[i], d))
+	}
+	raw := buf.Bytes()
+
+	r, err := NewReader(bytes.NewReader(raw))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(r.Header.Roots))
+	assert.True(t, cids[0].Equals(r.Header.Roots[0]))
+	for i := range data {
+		b, err := r.Next()
+		assert.Nil(t, err)
+		assert.True(t, cids[i].Equals(b.Cid()))
+		assert.Equal(t, data[i], b.RawData())
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// tampered block
+	tampered := bytes.Replace(raw, []byte("block 2"), []byte("block X"), 1)
+	r, err = NewReader(bytes.NewReader(tampered))
+	assert.Nil(t, err)
+	_, err = r.Next()
+	assert.Nil(t, err)
+	_, err = r.Next()
+	assert.True(t, errors.Is(err, BadBlockErr))
+
+	// wrapped as CARv2
+	v2 := bytes.NewBuffer(append([]byte{}, v2Pragma...))
+	h := make([]byte, v2HeaderSize)
+	binary.LittleEndian.PutUint64(h[16:24], uint64(len(v2Pragma)+v2HeaderSize))
+	binary.LittleEndian.PutUint64(h[24:32], uint64(len(raw)))
+	v2.Write(h)
+	v2.Write(raw)
+	v2.Write([]byte("index..."))
+	r, err = NewReader(v2)
+	assert.Nil(t, err)
+	count := 0
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, len(data), count)
+}
@@ -0,0 +1,77 @@
+package cipher
+
+import (
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"testing"
+)
+
+var benchKeyTypes = []string{"ed25519", "secp256k1", "ecdsa", "rsa"}
+
+func benchKey(b *testing.B, keyType string) crypto.PrivKey {
+	kt, err := ParseKeyType(keyType)
+	if err != nil {
+		b.Fatal(err)
+	}
+	priv, err := GenerateKey(kt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return priv
+}
+
+func BenchmarkSign(b *testing.B) {
+	so := signableObj{Hash([]byte("some dummy data")), []byte{}}
+	for _, keyType := range benchKeyTypes {
+		priv := benchKey(b, keyType)
+		b.Run(keyType, func(b *testing.B) {
+			var sig []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if sig, err = Sign(&so, priv); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(sig)), "sig-bytes")
+		})
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	for _, keyType := range benchKeyTypes {
+		priv := benchKey(b, keyType)
+		so := signableObj{Hash([]byte("some dummy data")), []byte{}}
+		sig, err := Sign(&so, priv)
+		if err != nil {
+			b.Fatal(err)
+		}
+		so.sig = sig
+		pk := priv.GetPublic()
+		b.Run(keyType, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := Verify(&so, pk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPublicKey measures the (un)marshaling of public keys, which are part of every bucket
+func BenchmarkPublicKey(b *testing.B) {
+	for _, keyType := range benchKeyTypes {
+		pk := benchKey(b, keyType).GetPublic()
+		b.Run(keyType, func(b *testing.B) {
+			var raw []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if raw, err = crypto.MarshalPublicKey(pk); err != nil {
+					b.Fatal(err)
+				}
+				if _, err = crypto.UnmarshalPublicKey(raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(raw)), "pk-bytes")
+		})
+	}
+}
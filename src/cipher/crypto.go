@@ -3,8 +3,12 @@ package cipher
 import (
 	cryptorand "crypto/rand"
 	"crypto/sha256"
+	"github.com/libp2p/go-libp2p-core/crypto"
 )
 
+// RSAKeyBits is the size of generated RSA keys
+var RSAKeyBits = 2048
+
 func Hash(data []byte) []byte {
 	hash := sha256.Sum256(data)
 	return hash[:]
@@ -18,3 +22,13 @@ func NewRandKey(keySize int) ([]byte, error) {
 	}
 	return key, nil
 }
+
+// GenerateKey generates a new key of the given type (e.g. crypto.Ed25519)
+func GenerateKey(keyType int) (crypto.PrivKey, error) {
+	bits := -1
+	if keyType == crypto.RSA {
+		bits = RSAKeyBits
+	}
+	priv, _, err := crypto.GenerateKeyPair(keyType, bits)
+	return priv, err
+}
@@ -0,0 +1,278 @@
+package cipher
+
+import (
+	"crypto/aes"
+	gocipher "crypto/cipher"
+	"encoding/json"
+	"errors"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyFileExt = ".key"
+
+var (
+	KeyNotFoundErr     = errors.New("key not found")
+	KeyExistErr        = errors.New("key already exist")
+	KeyNameNotValidErr = errors.New("key name is not valid")
+	WrongPassphraseErr = errors.New("wrong passphrase")
+	KeyTypeNotValidErr = errors.New("key type is not valid")
+	EmptyPassphraseErr = errors.New("keystore passphrase is empty")
+
+	// ScryptN is the cost parameter of the passphrase derivation
+	ScryptN = 1 << 15
+
+	keyNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
+)
+
+// KeyInfo describes a key in the keystore
+type KeyInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+}
+
+// keyFile is the persisted (encrypted) form of a key
+type keyFile struct {
+	KeyInfo
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// Keystore holds named private keys (identities) in a directory, one file per key.
+// keys are encrypted at rest with a key that is derived from the passphrase
+type Keystore struct {
+	lock       sync.Mutex
+	dir        string
+	passphrase []byte
+	// decrypted keys are cached to avoid the derivation of the passphrase on each use
+	cache map[string]crypto.PrivKey
+}
+
+// NewKeystore opens (or creates) the keystore in the given directory, an empty passphrase is refused
+func NewKeystore(dir, passphrase string) (*Keystore, error) {
+	if len(passphrase) == 0 {
+		return nil, EmptyPassphraseErr
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ks := Keystore{dir: dir, passphrase: []byte(passphrase), cache: map[string]crypto.PrivKey{}}
+
+	return &ks, nil
+}
+
+// ParseKeyType parses the name of a key type (e.g. 'ed25519'), empty name defaults to Ed25519
+func ParseKeyType(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "", "ed25519":
+		return crypto.Ed25519, nil
+	case "secp256k1":
+		return crypto.Secp256k1, nil
+	case "rsa":
+		return crypto.RSA, nil
+	case "ecdsa":
+		return crypto.ECDSA, nil
+	}
+	return 0, KeyTypeNotValidErr
+}
+
+// Generate creates a new key of the given type (e.g. crypto.Ed25519) and saves it under the given name
+func (ks *Keystore) Generate(name string, keyType int) (crypto.PrivKey, error) {
+	priv, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if err = ks.Import(name, priv); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// Import saves the given key under the given name
+func (ks *Keystore) Import(name string, priv crypto.PrivKey) error {
+	if !keyNameRegex.MatchString(name) {
+		return KeyNameNotValidErr
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	p := ks.keyPath(name)
+	if _, err := os.Stat(p); err == nil {
+		return KeyExistErr
+	}
+	kf, err := ks.encrypt(name, priv)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, raw, 0600)
+}
+
+// Export returns the (decrypted) marshaled key, the same format that is used for key files of peers
+func (ks *Keystore) Export(name string) ([]byte, error) {
+	priv, err := ks.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.MarshalPrivateKey(priv)
+}
+
+// Get loads and decrypts the key with the given name
+func (ks *Keystore) Get(name string) (crypto.PrivKey, error) {
+	ks.lock.Lock()
+	priv, ok := ks.cache[name]
+	ks.lock.Unlock()
+	if ok {
+		return priv, nil
+	}
+	kf, err := ks.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if priv, err = ks.decrypt(kf); err != nil {
+		return nil, err
+	}
+	ks.lock.Lock()
+	ks.cache[name] = priv
+	ks.lock.Unlock()
+	return priv, nil
+}
+
+// List returns the info of all the keys, sorted by name
+func (ks *Keystore) List() ([]KeyInfo, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+	res := []KeyInfo{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), keyFileExt) {
+			continue
+		}
+		kf, err := readKeyFile(filepath.Join(ks.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, kf.KeyInfo)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+// Delete removes the key with the given name
+func (ks *Keystore) Delete(name string) error {
+	if !keyNameRegex.MatchString(name) {
+		return KeyNameNotValidErr
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	delete(ks.cache, name)
+	err := os.Remove(ks.keyPath(name))
+	if os.IsNotExist(err) {
+		return KeyNotFoundErr
+	}
+	return err
+}
+
+func (ks *Keystore) keyPath(name string) string {
+	return filepath.Join(ks.dir, name+keyFileExt)
+}
+
+func (ks *Keystore) load(name string) (*keyFile, error) {
+	if !keyNameRegex.MatchString(name) {
+		return nil, KeyNameNotValidErr
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	kf, err := readKeyFile(ks.keyPath(name))
+	if os.IsNotExist(err) {
+		return nil, KeyNotFoundErr
+	}
+	return kf, err
+}
+
+func readKeyFile(p string) (*keyFile, error) {
+	raw, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var kf keyFile
+	if err = json.Unmarshal(raw, &kf); err != nil {
+		return nil, err
+	}
+	return &kf, nil
+}
+
+func (ks *Keystore) encrypt(name string, priv crypto.PrivKey) (*keyFile, error) {
+	raw, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := NewRandKey(16)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := ks.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := NewRandKey(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	info := KeyInfo{name, priv.Type().String(), id.Pretty(), time.Now().Unix()}
+	kf := keyFile{info, salt, nonce, aead.Seal(nil, nonce, raw, []byte(name))}
+
+	return &kf, nil
+}
+
+func (ks *Keystore) decrypt(kf *keyFile) (crypto.PrivKey, error) {
+	aead, err := ks.aead(kf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := aead.Open(nil, kf.Nonce, kf.Data, []byte(kf.Name))
+	if err != nil {
+		return nil, WrongPassphraseErr
+	}
+	return crypto.UnmarshalPrivateKey(raw)
+}
+
+// aead derives the encryption key from the passphrase and the given salt
+func (ks *Keystore) aead(salt []byte) (gocipher.AEAD, error) {
+	key, err := scrypt.Key(ks.passphrase, salt, ScryptN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return gocipher.NewGCM(block)
+}
@@ -0,0 +1,62 @@
+package cipher
+
+import (
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestKeystore(t *testing.T) {
+	ScryptN = 1 << 10
+	dir, err := ioutil.TempDir("", "keystore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewKeystore(dir, "")
+	assert.Equal(t, EmptyPassphraseErr, err)
+	ks, err := NewKeystore(dir, "secret")
+	assert.Nil(t, err)
+
+	priv, err := ks.Generate("alice", libp2pcrypto.Ed25519)
+	assert.Nil(t, err)
+	_, err = ks.Generate("alice", libp2pcrypto.Ed25519)
+	assert.Equal(t, KeyExistErr, err)
+	_, err = ks.Generate("../alice", libp2pcrypto.Ed25519)
+	assert.Equal(t, KeyNameNotValidErr, err)
+
+	loaded, err := ks.Get("alice")
+	assert.Nil(t, err)
+	assert.True(t, priv.Equals(loaded))
+
+	// export and import under another name
+	raw, err := ks.Export("alice")
+	assert.Nil(t, err)
+	imported, err := libp2pcrypto.UnmarshalPrivateKey(raw)
+	assert.Nil(t, err)
+	assert.Nil(t, ks.Import("bob", imported))
+
+	keys, err := ks.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, "alice", keys[0].Name)
+	assert.Equal(t, "bob", keys[1].Name)
+	assert.Equal(t, keys[0].ID, keys[1].ID)
+
+	// keys are encrypted at rest
+	data, err := ioutil.ReadFile(ks.keyPath("alice"))
+	assert.Nil(t, err)
+	privRaw, _ := priv.Raw()
+	assert.NotContains(t, string(data), string(privRaw))
+
+	wrong, err := NewKeystore(dir, "wrong")
+	assert.Nil(t, err)
+	_, err = wrong.Get("alice")
+	assert.Equal(t, WrongPassphraseErr, err)
+
+	assert.Nil(t, ks.Delete("bob"))
+	assert.Equal(t, KeyNotFoundErr, ks.Delete("bob"))
+	_, err = ks.Get("bob")
+	assert.Equal(t, KeyNotFoundErr, err)
+}
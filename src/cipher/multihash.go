@@ -0,0 +1,142 @@
+package cipher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
+	"sort"
+	"strings"
+)
+
+// multicodec codes of the supported hash algorithms
+const (
+	SHA2_256    uint64 = mh.SHA2_256
+	BLAKE2B_256 uint64 = mh.BLAKE2B_MIN + 31
+	BLAKE3      uint64 = 0x1e
+)
+
+var (
+	HashNotSupportedErr = errors.New("hash algorithm is not supported")
+	HashNotValidErr     = errors.New("hash is not valid")
+
+	hashAlgNames = map[uint64]string{
+		SHA2_256:    "sha2-256",
+		BLAKE2B_256: "blake2b-256",
+		BLAKE3:      "blake3",
+	}
+)
+
+// ParseHashAlg parses the name of a hash algorithm (e.g. 'blake3'), empty name defaults to sha2-256
+func ParseHashAlg(name string) (uint64, error) {
+	name = strings.ToLower(name)
+	if len(name) == 0 {
+		return SHA2_256, nil
+	}
+	for code, n := range hashAlgNames {
+		if n == name {
+			return code, nil
+		}
+	}
+	return 0, HashNotSupportedErr
+}
+
+// HashAlgs returns the supported hash algorithms, sorted by code
+func HashAlgs() []uint64 {
+	algs := []uint64{}
+	for code := range hashAlgNames {
+		algs = append(algs, code)
+	}
+	sort.Slice(algs, func(i, j int) bool {
+		return algs[i] < algs[j]
+	})
+	return algs
+}
+
+// HashAlgName returns the name of the given hash algorithm
+func HashAlgName(alg uint64) string {
+	return hashAlgNames[alg]
+}
+
+// Digest returns the (bare) digest of the given data with the given algorithm
+func Digest(data []byte, alg uint64) ([]byte, error) {
+	switch alg {
+	case SHA2_256:
+		return Hash(data), nil
+	case BLAKE2B_256:
+		d := blake2b.Sum256(data)
+		return d[:], nil
+	case BLAKE3:
+		d := blake3.Sum256(data)
+		return d[:], nil
+	}
+	return nil, HashNotSupportedErr
+}
+
+// Multihash returns the multihash of the given data, which self-describes the algorithm
+func Multihash(data []byte, alg uint64) ([]byte, error) {
+	d, err := Digest(data, alg)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(d))
+	n := binary.PutUvarint(buf, alg)
+	n += binary.PutUvarint(buf[n:], uint64(len(d)))
+	return append(buf[:n], d...), nil
+}
+
+// DecodeMultihash returns the algorithm and the digest of the given multihash, only supported algorithms are accepted
+func DecodeMultihash(raw []byte) (uint64, []byte, error) {
+	dm, err := mh.Decode(raw)
+	if err != nil {
+		return 0, nil, HashNotValidErr
+	}
+	if _, ok := hashAlgNames[dm.Code]; !ok {
+		return 0, nil, HashNotSupportedErr
+	}
+	return dm.Code, dm.Digest, nil
+}
+
+// HexHash returns the hex encoded multihash of the given data.
+// alg 0 returns the legacy form, which is a bare (hex) sha2-256 digest
+func HexHash(data []byte, alg uint64) (string, error) {
+	if alg == 0 {
+		return hex.EncodeToString(Hash(data)), nil
+	}
+	raw, err := Multihash(data, alg)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// VerifyHexHash checks that the given (hex) hash matches the data, with the algorithm that is described in the hash.
+// legacy hashes (bare sha2-256 digests) are accepted as well
+func VerifyHexHash(data []byte, hash string) error {
+	raw, err := hex.DecodeString(hash)
+	if err != nil {
+		return HashNotValidErr
+	}
+	if len(raw) == sha256.Size {
+		if !bytes.Equal(raw, Hash(data)) {
+			return HashNotValidErr
+		}
+		return nil
+	}
+	alg, digest, err := DecodeMultihash(raw)
+	if err != nil {
+		return err
+	}
+	expected, err := Digest(data, alg)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, expected) {
+		return HashNotValidErr
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package cipher
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMultihash(t *testing.T) {
+	data := []byte("mybucket")
+	for _, name := range []string{"sha2-256", "blake2b-256", "blake3"} {
+		alg, err := ParseHashAlg(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, HashAlgName(alg))
+
+		raw, err := Multihash(data, alg)
+		assert.Nil(t, err)
+		decodedAlg, digest, err := DecodeMultihash(raw)
+		assert.Nil(t, err)
+		assert.Equal(t, alg, decodedAlg)
+		assert.Equal(t, 32, len(digest))
+
+		hash, err := HexHash(data, alg)
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyHexHash(data, hash))
+		assert.Equal(t, HashNotValidErr, VerifyHexHash([]byte("other"), hash))
+	}
+	_, err := ParseHashAlg("md5")
+	assert.Equal(t, HashNotSupportedErr, err)
+	assert.Equal(t, []uint64{SHA2_256, BLAKE3, BLAKE2B_256}, HashAlgs())
+
+	// sha2-256 multihashes are prefixed with the code and length
+	hash, err := HexHash(data, SHA2_256)
+	assert.Nil(t, err)
+	assert.Equal(t, "1220"+hex.EncodeToString(Hash(data)), hash)
+
+	// legacy hashes are bare sha2-256 digests
+	legacy, err := HexHash(data, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, hex.EncodeToString(Hash(data)), legacy)
+	assert.Nil(t, VerifyHexHash(data, legacy))
+
+	assert.Equal(t, HashNotValidErr, VerifyHexHash(data, "not-hex"))
+	unknown, _ := Multihash(data, SHA2_256)
+	unknown[0] = 0x13 // sha2-512
+	assert.Equal(t, HashNotSupportedErr, VerifyHexHash(data, hex.EncodeToString(unknown)))
+}
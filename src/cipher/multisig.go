@@ -0,0 +1,164 @@
+package cipher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"sort"
+)
+
+const multisigOwnerDomain = "cbn/multisig-owner"
+
+var (
+	MultisigNotValidErr = errors.New("multisig owner is not valid")
+	ThresholdNotMetErr  = errors.New("threshold of signatures was not met")
+	NotASignerErr       = errors.New("key is not a signer")
+)
+
+// MultisigOwner is an owner that is composed of a set of keys,
+// where signatures of at least Threshold keys are required
+type MultisigOwner struct {
+	Threshold int
+	// Keys are the marshaled public keys of the signers, sorted
+	Keys [][]byte
+}
+
+// PartialSignature is a signature of a single signer of some MultisigOwner
+type PartialSignature struct {
+	PK  []byte
+	Sig []byte
+}
+
+func NewMultisigOwner(threshold int, keys ...crypto.PubKey) (*MultisigOwner, error) {
+	raws := [][]byte{}
+	for _, pk := range keys {
+		raw, err := crypto.MarshalPublicKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+	}
+	sort.Slice(raws, func(i, j int) bool {
+		return bytes.Compare(raws[i], raws[j]) < 0
+	})
+	mo := MultisigOwner{threshold, raws}
+	if err := mo.Validate(); err != nil {
+		return nil, err
+	}
+	return &mo, nil
+}
+
+// Validate checks that the threshold is within the amount of keys, and that keys are sorted and unique
+func (mo *MultisigOwner) Validate() error {
+	if mo.Threshold < 1 || mo.Threshold > len(mo.Keys) {
+		return MultisigNotValidErr
+	}
+	for i, raw := range mo.Keys {
+		if _, err := crypto.UnmarshalPublicKey(raw); err != nil {
+			return MultisigNotValidErr
+		}
+		if i > 0 && bytes.Compare(mo.Keys[i-1], raw) >= 0 {
+			return MultisigNotValidErr
+		}
+	}
+	return nil
+}
+
+// Hash returns the hash of the descriptor, which identifies the owner.
+// the threshold and each key are length prefixed (uvarint), following a domain tag and a zero byte
+func (mo *MultisigOwner) Hash() []byte {
+	data := append([]byte(multisigOwnerDomain), 0)
+	data = appendUvarint(data, uint64(mo.Threshold))
+	for _, raw := range mo.Keys {
+		data = appendUvarint(data, uint64(len(raw)))
+		data = append(data, raw...)
+	}
+	return Hash(data)
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(data, buf[:n]...)
+}
+
+// Has returns true if the given (marshaled) public key is one of the signers
+func (mo *MultisigOwner) Has(pkraw []byte) bool {
+	for _, raw := range mo.Keys {
+		if bytes.Equal(raw, pkraw) {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseMultisigOwner(raw []byte) (*MultisigOwner, error) {
+	var mo MultisigOwner
+	if err := json.Unmarshal(raw, &mo); err != nil {
+		return nil, err
+	}
+	if err := mo.Validate(); err != nil {
+		return nil, err
+	}
+	return &mo, nil
+}
+
+func SerializeMultisigOwner(mo *MultisigOwner) ([]byte, error) {
+	return json.Marshal(mo)
+}
+
+// SignPartial signs the given object with a single key of some MultisigOwner
+func SignPartial(s Signable, mo *MultisigOwner, priv crypto.PrivKey) (*PartialSignature, error) {
+	pkraw, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	if !mo.Has(pkraw) {
+		return nil, NotASignerErr
+	}
+	data, err := s.Data()
+	if err != nil {
+		return nil, GetDataToSignErr
+	}
+	sig, err := priv.Sign(data)
+	if err != nil {
+		return nil, SignErr
+	}
+	return &PartialSignature{pkraw, sig}, nil
+}
+
+// VerifyPartial verifies a single signature of some MultisigOwner
+func VerifyPartial(s Signable, mo *MultisigOwner, ps PartialSignature) error {
+	if !mo.Has(ps.PK) {
+		return NotASignerErr
+	}
+	pk, err := crypto.UnmarshalPublicKey(ps.PK)
+	if err != nil {
+		return err
+	}
+	data, err := s.Data()
+	if err != nil {
+		return err
+	}
+	verified, err := pk.Verify(data, ps.Sig)
+	if err != nil || !verified {
+		return NotVerifiedErr
+	}
+	return nil
+}
+
+// VerifyMultisig succeeds only if the given signatures contain valid signatures of at least threshold distinct signers
+func VerifyMultisig(s Signable, mo *MultisigOwner, sigs []PartialSignature) error {
+	signers := map[string]bool{}
+	for _, ps := range sigs {
+		if err := VerifyPartial(s, mo, ps); err == nil {
+			signers[string(ps.PK)] = true
+		}
+	}
+	if len(signers) < mo.Threshold {
+		return ThresholdNotMetErr
+	}
+	return nil
+}
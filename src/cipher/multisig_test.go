@@ -0,0 +1,59 @@
+package cipher
+
+import (
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMultisig(t *testing.T) {
+	privs := []libp2pcrypto.PrivKey{}
+	pks := []libp2pcrypto.PubKey{}
+	for i := 0; i < 3; i++ {
+		priv, _, _ := libp2pcrypto.GenerateKeyPair(libp2pcrypto.Ed25519, -1)
+		privs = append(privs, priv)
+		pks = append(pks, priv.GetPublic())
+	}
+	_, err := NewMultisigOwner(4, pks...)
+	assert.Equal(t, MultisigNotValidErr, err)
+	_, err = NewMultisigOwner(1, pks[0], pks[0])
+	assert.Equal(t, MultisigNotValidErr, err)
+
+	mo, err := NewMultisigOwner(2, pks...)
+	assert.Nil(t, err)
+	// the order of keys doesn't change the owner
+	mo2, err := NewMultisigOwner(2, pks[2], pks[0], pks[1])
+	assert.Nil(t, err)
+	assert.Equal(t, mo.Hash(), mo2.Hash())
+
+	raw, err := SerializeMultisigOwner(mo)
+	assert.Nil(t, err)
+	parsed, err := ParseMultisigOwner(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, mo.Hash(), parsed.Hash())
+	// the threshold and keys are length prefixed, moving bytes between them changes the owner
+	shifted := MultisigOwner{12, [][]byte{mo.Keys[0]}}
+	prefixed := MultisigOwner{1, [][]byte{append([]byte("2"), mo.Keys[0]...)}}
+	assert.NotEqual(t, prefixed.Hash(), shifted.Hash())
+	joined := MultisigOwner{2, [][]byte{append(append([]byte{}, mo.Keys[0]...), mo.Keys[1]...), mo.Keys[2]}}
+	assert.NotEqual(t, mo.Hash(), joined.Hash())
+
+	so := signableObj{[]byte("some dummy data"), []byte{}}
+	outsider, _, _ := libp2pcrypto.GenerateKeyPair(libp2pcrypto.Ed25519, -1)
+	_, err = SignPartial(&so, mo, outsider)
+	assert.Equal(t, NotASignerErr, err)
+
+	ps0, err := SignPartial(&so, mo, privs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, ThresholdNotMetErr, VerifyMultisig(&so, mo, []PartialSignature{*ps0}))
+	// signatures of the same signer are counted once
+	assert.Equal(t, ThresholdNotMetErr, VerifyMultisig(&so, mo, []PartialSignature{*ps0, *ps0}))
+
+	ps2, err := SignPartial(&so, mo, privs[2])
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyMultisig(&so, mo, []PartialSignature{*ps0, *ps2}))
+
+	// signatures of other data are not valid
+	other := signableObj{[]byte("other data"), []byte{}}
+	assert.Equal(t, ThresholdNotMetErr, VerifyMultisig(&other, mo, []PartialSignature{*ps0, *ps2}))
+}
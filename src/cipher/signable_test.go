@@ -2,26 +2,30 @@ package cipher
 
 import (
 	"bytes"
-	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 func TestSignVerify(t *testing.T) {
-	priv, _, _ := libp2pcrypto.GenerateKeyPair(libp2pcrypto.RSA, 2048)
-	so := signableObj{[]byte("some dummy data"), []byte{}}
+	for _, keyType := range []string{"ed25519", "secp256k1", "ecdsa", "rsa"} {
+		kt, err := ParseKeyType(keyType)
+		assert.Nil(t, err)
+		priv, err := GenerateKey(kt)
+		assert.Nil(t, err)
+		so := signableObj{[]byte("some dummy data"), []byte{}}
 
-	signed, err := Sign(&so, priv)
-	assert.Nil(t, err)
+		signed, err := Sign(&so, priv)
+		assert.Nil(t, err)
 
-	so.sig = signed
+		so.sig = signed
 
-	err = Verify(&so, priv.GetPublic())
-	assert.Nil(t, err)
+		err = Verify(&so, priv.GetPublic())
+		assert.Nil(t, err, keyType)
 
-	priv2, _, _ := libp2pcrypto.GenerateKeyPair(libp2pcrypto.RSA, 2048)
-	err = Verify(&so, priv2.GetPublic())
-	assert.Equal(t, NotVerifiedErr, err)
+		priv2, _ := GenerateKey(kt)
+		err = Verify(&so, priv2.GetPublic())
+		assert.Equal(t, NotVerifiedErr, err, keyType)
+	}
 }
 
 type signableObj struct {
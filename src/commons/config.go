@@ -1,12 +1,17 @@
 package commons
 
 import (
+	"github.com/amirylm/cbn/src/cipher"
 	p2pfacade "github.com/amirylm/libp2p-facade/core"
 	"github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	badger "github.com/ipfs/go-ds-badger"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"io/ioutil"
 	"log"
+	"os"
+	"time"
 )
 
 type Peers struct {
@@ -20,7 +25,51 @@ type NodeConfig struct {
 	Addrs             []string `envconfig:"ADDRS", default:""`
 	Peers             []string `envconfig:"PEERS", default:""`
 	ConnectToRegistry bool     `envconfig:"CONNECT_TO_REGISTRY", default:false`
-	Terminal bool     `envconfig:"TERMINAL", default:false`
+	Terminal          bool     `envconfig:"TERMINAL", default:false`
+	// ShardingThreshold is the amount of entries in a bucket directory that triggers HAMT sharding
+	ShardingThreshold int `envconfig:"BUCKET_SHARDING_THRESHOLD" default:"0"`
+	// BucketHash is the hash algorithm of new buckets (sha2-256, blake2b-256 or blake3)
+	BucketHash string `envconfig:"BUCKET_HASH" default:"sha2-256"`
+	// LegacyCutoff is the time (RFC3339) this node switched to the versioned encoding, legacy buckets updated later are rejected
+	LegacyCutoff time.Time `envconfig:"LEGACY_CUTOFF" default:"2026-10-19T00:00:00Z"`
+	// GCInterval is the interval of garbage collection, 0 to disable
+	GCInterval time.Duration `envconfig:"GC_INTERVAL" default:"0"`
+	// GCRetainVersions is the amount of previous versions that GC keeps for each bucket
+	GCRetainVersions int `envconfig:"GC_RETAIN_VERSIONS" default:"0"`
+	// Pins are buckets that the node must replicate, in the format '<hash|owner|domain>:<value>[:<keep>]'
+	Pins []string `envconfig:"PINS" default:""`
+	// ReplicationInterval is the interval of checking the replicas of owned buckets, 0 to disable
+	ReplicationInterval time.Duration `envconfig:"REPLICATION_INTERVAL" default:"0"`
+	// AcceptReplicas determines whether to accept replication requests of other nodes
+	AcceptReplicas bool `envconfig:"ACCEPT_REPLICAS" default:"false"`
+	// ReplicasMaxSize is the max size of a single replicated data ref, ReplicasPeerQuota is the max amount
+	// of bytes that are replicated on behalf of a single peer (0 for no limit)
+	ReplicasMaxSize   uint64 `envconfig:"REPLICAS_MAX_SIZE" default:"104857600"`
+	ReplicasPeerQuota uint64 `envconfig:"REPLICAS_PEER_QUOTA" default:"1073741824"`
+	// AcceptDeals determines whether to accept storage deals, within the limits below (0 for no limit)
+	AcceptDeals      bool          `envconfig:"DEALS_ACCEPT" default:"false"`
+	DealsMaxSize     uint64        `envconfig:"DEALS_MAX_SIZE" default:"0"`
+	DealsMaxDuration time.Duration `envconfig:"DEALS_MAX_DURATION" default:"0"`
+	DealsMinPrice    uint64        `envconfig:"DEALS_MIN_PRICE" default:"0"`
+	// AuditInterval is the interval of challenging the storage nodes of deals, 0 to disable
+	AuditInterval time.Duration `envconfig:"AUDIT_INTERVAL" default:"0"`
+	// ReceiptInterval is the interval of sending bandwidth receipts to the peers that served data
+	ReceiptInterval time.Duration `envconfig:"RECEIPT_INTERVAL" default:"1m"`
+	// DebtLimit is the max amount of bytes that are served to a peer without receipts, 0 for no limit
+	DebtLimit uint64 `envconfig:"DEBT_LIMIT" default:"0"`
+	// MetricsAddr is the address of the prometheus metrics server of the node, empty to disable
+	MetricsAddr string `envconfig:"METRICS_ADDR" default:""`
+	// AdminAddr is the address of the local admin (http) server of the node, empty to disable
+	AdminAddr string `envconfig:"ADMIN_ADDR" default:""`
+	// ReadyMinPeers is the minimum amount of connected peers of a ready node
+	ReadyMinPeers int `envconfig:"READY_MIN_PEERS" default:"1"`
+	// KeystorePath is the directory of named identities, keys are encrypted with KeystorePassphrase
+	KeystorePath       string `envconfig:"KEYSTORE_PATH" default:""`
+	KeystorePassphrase string `envconfig:"KEYSTORE_PASSPHRASE" default:""`
+	// Identity is the name of the default identity that signs buckets, empty for the key of the peer
+	Identity string `envconfig:"IDENTITY" default:""`
+	// PKeyType is the type of the key that is generated for the peer if PK_PATH doesn't exist (ed25519, secp256k1, rsa, ecdsa)
+	PKeyType string `envconfig:"PK_TYPE" default:"ed25519"`
 }
 
 func LoadConfig() (*p2pfacade.Config, *NodeConfig) {
@@ -29,10 +78,14 @@ func LoadConfig() (*p2pfacade.Config, *NodeConfig) {
 	if err != nil {
 		log.Fatal("could not process env")
 	}
-	log.Println("config:", nc)
+	printed := nc
+	if len(printed.KeystorePassphrase) > 0 {
+		printed.KeystorePassphrase = "***"
+	}
+	log.Println("config:", printed)
 
 	ds := NewDS(nc.DataPath)
-	priv := p2pfacade.PrivKey(nc.PKeyPath)
+	priv := newPrivKey(nc.PKeyPath, nc.PKeyType)
 	psk := newPsk(nc.PSK)
 	log.Println("psk:", string(psk))
 	cfg := p2pfacade.NewConfig(priv, psk, ds)
@@ -43,6 +96,48 @@ func LoadConfig() (*p2pfacade.Config, *NodeConfig) {
 	return cfg, &nc
 }
 
+// NewKeystore opens the keystore of the given config, nil if not configured
+func NewKeystore(nc *NodeConfig) *cipher.Keystore {
+	if len(nc.KeystorePath) == 0 {
+		return nil
+	}
+	ks, err := cipher.NewKeystore(nc.KeystorePath, nc.KeystorePassphrase)
+	if err != nil {
+		log.Fatal("could not open keystore: ", err)
+	}
+	return ks
+}
+
+// newPrivKey loads the key of the peer, a new key of the given type is generated (and saved) if the file doesn't exist
+func newPrivKey(keyPath, keyType string) crypto.PrivKey {
+	if len(keyPath) > 0 {
+		if _, err := os.Stat(keyPath); !os.IsNotExist(err) {
+			return p2pfacade.PrivKey(keyPath)
+		}
+	}
+	t, err := cipher.ParseKeyType(keyType)
+	if err != nil {
+		log.Fatal("could not parse key type: ", err)
+	}
+	priv, err := cipher.GenerateKey(t)
+	if err != nil {
+		log.Fatal("could not generate key: ", err)
+	}
+	if len(keyPath) == 0 { // will not be persisted
+		log.Printf("generated a new %s peer key, which is not persisted (PK_PATH is not set)", priv.Type())
+		return priv
+	}
+	raw, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		log.Fatal("could not marshal key: ", err)
+	}
+	if err = ioutil.WriteFile(keyPath, raw, 0600); err != nil {
+		log.Fatal("could not save key: ", err)
+	}
+	log.Printf("generated a new %s peer key in %s", priv.Type(), keyPath)
+	return priv
+}
+
 func newPsk(s string) []byte {
 	var psk []byte
 	if len(s) == 0 {
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"time"
+)
+
+// ArchiveFormat is the format of a bucket archive
+type ArchiveFormat string
+
+const (
+	ArchiveTar   ArchiveFormat = "tar"
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	ArchiveZip   ArchiveFormat = "zip"
+
+	// archiveContentTypeKey is the PAX record that holds the content type of tar entries
+	archiveContentTypeKey = "CBN.content_type"
+)
+
+var (
+	UnsupportedArchiveFormatErr = errors.New("unsupported archive format")
+)
+
+// ParseArchiveFormat returns the format matching the given string, tar is the default
+func ParseArchiveFormat(s string) (ArchiveFormat, error) {
+	switch ArchiveFormat(s) {
+	case "", ArchiveTar:
+		return ArchiveTar, nil
+	case ArchiveTarGz, "tgz":
+		return ArchiveTarGz, nil
+	case ArchiveZip:
+		return ArchiveZip, nil
+	}
+	return "", UnsupportedArchiveFormatErr
+}
+
+// ContentType returns the mime type of the archive format
+func (f ArchiveFormat) ContentType() string {
+	switch f {
+	case ArchiveTarGz:
+		return "application/gzip"
+	case ArchiveZip:
+		return "application/zip"
+	}
+	return "application/x-tar"
+}
+
+// archiveWriter abstracts tar and zip writers
+type archiveWriter interface {
+	WriteEntry(name string, fh FileHeader, r io.Reader) error
+	Close() error
+}
+
+// ArchiveBucket streams all the files of the given bucket into an archive,
+// entries are written one by one w/o buffering the entire content.
+// entries get the time of the last bucket update, so archives of the same version are identical
+func (ctrl *Controller) ArchiveBucket(hash string, format ArchiveFormat, w io.Writer) error {
+	bucket, err := ctrl.bucketReg.Load(hash)
+	if err != nil {
+		return err
+	}
+	modTime := time.Unix(bucket.Updated(), 0)
+	var aw archiveWriter
+	switch format {
+	case ArchiveTar:
+		aw = &tarWriter{tar.NewWriter(w), nil, modTime}
+	case ArchiveTarGz:
+		gw := gzip.NewWriter(w)
+		gw.ModTime = modTime
+		aw = &tarWriter{tar.NewWriter(gw), gw, modTime}
+	case ArchiveZip:
+		aw = &zipWriter{zip.NewWriter(w), modTime}
+	default:
+		return UnsupportedArchiveFormatErr
+	}
+	err = ctrl.bucketSrc.Walk(bucket.NodeCid(), func(p string, dr *DataRef) (bool, error) {
+		// names might come from remote buckets, entries must not escape the extraction dir
+		if name, err := CleanPath(p); err != nil || name != p {
+			return false, InvalidPathErr
+		}
+		reader, err := ctrl.dataSrc.Get(dr.NodeCid())
+		if err != nil {
+			return false, err
+		}
+		if c, ok := reader.(io.Closer); ok {
+			defer c.Close()
+		}
+		fh := dr.Header
+		if size, ok := readerSize(reader); ok {
+			fh.Size = size
+		}
+		return true, aw.WriteEntry(p, fh, reader)
+	})
+	if err != nil {
+		aw.Close()
+		return err
+	}
+	return aw.Close()
+}
+
+// readerSize returns the actual size of seekable readers
+func readerSize(r io.Reader) (uint64, bool) {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	size, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err = s.Seek(0, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return uint64(size), true
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	// gw is the optional gzip writer
+	gw      *gzip.Writer
+	modTime time.Time
+}
+
+func (w *tarWriter) WriteEntry(name string, fh FileHeader, r io.Reader) error {
+	h := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(fh.Size),
+		Mode:     0644,
+		ModTime:  w.modTime,
+		Format:   tar.FormatPAX,
+	}
+	if len(fh.Type) > 0 {
+		h.PAXRecords = map[string]string{archiveContentTypeKey: fh.Type}
+	}
+	if err := w.tw.WriteHeader(&h); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w.tw, r, h.Size)
+	return err
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if w.gw != nil {
+		return w.gw.Close()
+	}
+	return nil
+}
+
+type zipWriter struct {
+	zw      *zip.Writer
+	modTime time.Time
+}
+
+func (w *zipWriter) WriteEntry(name string, fh FileHeader, r io.Reader) error {
+	h := zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		UncompressedSize64: fh.Size,
+		// content type is kept as the entry comment
+		Comment:  fh.Type,
+		Modified: w.modTime,
+	}
+	fw, err := w.zw.CreateHeader(&h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
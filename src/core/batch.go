@@ -0,0 +1,102 @@
+package core
+
+import (
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"io"
+	"sync"
+)
+
+// BucketBatch stages changes to the bucket DAG,
+// the bucket record is signed and saved only once Commit is called
+type BucketBatch struct {
+	lock sync.Mutex
+
+	ctrl   *Controller
+	bucket *Bucket
+	// changes is the amount of staged changes
+	changes int
+}
+
+// NewBatch creates a new batch for the given bucket
+func (ctrl *Controller) NewBatch(bucketHash string) (*BucketBatch, error) {
+	bucket, err := ctrl.bucketReg.Load(bucketHash)
+	if err != nil {
+		return nil, err
+	}
+	b := BucketBatch{ctrl: ctrl, bucket: bucket}
+
+	return &b, nil
+}
+
+// Add uploads the given stream and stages it in the bucket, file name might be a path
+func (b *BucketBatch) Add(fh FileHeader, r io.Reader) (*DataRef, error) {
+	dr, err := b.ctrl.UploadData(fh, r)
+	if err != nil {
+		return nil, err
+	}
+	return dr, b.AddRef(dr)
+}
+
+// AddRef stages an existing data ref in the bucket
+func (b *BucketBatch) AddRef(dr *DataRef) error {
+	return b.apply(func(bucketCid cid.Cid) (ipld.Node, error) {
+		return b.ctrl.bucketSrc.AddChild(bucketCid, dr.Header.Filename, dr)
+	})
+}
+
+// Remove stages the removal of the given file or directory
+func (b *BucketBatch) Remove(name string) error {
+	return b.apply(func(bucketCid cid.Cid) (ipld.Node, error) {
+		return b.ctrl.bucketSrc.RemoveChild(bucketCid, name)
+	})
+}
+
+// Move stages moving (or renaming) the given file or directory
+func (b *BucketBatch) Move(from, to string) error {
+	return b.apply(func(bucketCid cid.Cid) (ipld.Node, error) {
+		return b.ctrl.bucketSrc.MoveChild(bucketCid, from, to)
+	})
+}
+
+// Len returns the amount of staged changes
+func (b *BucketBatch) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.changes
+}
+
+// Commit seals and persists the bucket with all the staged changes
+func (b *BucketBatch) Commit(priv libp2pcrypto.PrivKey) (*Bucket, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	defer b.ctrl.writeLock()()
+
+	if b.changes == 0 {
+		return b.bucket, nil
+	}
+	if err := b.ctrl.Commit(b.bucket, priv); err != nil {
+		return nil, err
+	}
+	b.changes = 0
+	return b.bucket, nil
+}
+
+func (b *BucketBatch) apply(change func(cid.Cid) (ipld.Node, error)) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	defer b.ctrl.writeLock()()
+
+	nd, err := change(b.bucket.NodeCid())
+	if err != nil {
+		return err
+	}
+	if !b.bucket.setNode(nd) {
+		return CouldNotUpdateBucketNodeErr
+	}
+	b.ctrl.recent.add(nd.Cid())
+	b.changes++
+	return nil
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"bytes"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"github.com/amirylm/cbn/src/cipher"
@@ -20,11 +19,16 @@ var (
 	BucketNotExistErr           = errors.New("could not find bucket hash")
 	CouldNotUpdateBucketNodeErr = errors.New("could not update bucket ref node")
 	PKConflictErr               = errors.New("pub key conflict")
+	PendingSignaturesErr        = errors.New("bucket is pending for signatures")
+	SeqConflictErr              = errors.New("bucket sequence is not greater than the stored one")
+
+	// BucketHashAlg is the hash algorithm (multicodec) of new buckets, 0 for legacy (hex sha2-256) hashes
+	BucketHashAlg = cipher.SHA2_256
 )
 
 func CreateBucket(bucketReg BucketRegistry, bucketSrc BucketSource, bucketName string, pubkey libp2pcrypto.PubKey) (*Bucket, error) {
-	hash := BucketHashPK(bucketName, pubkey)
-	has, err := bucketReg.Has(hash)
+	pkraw, _ := libp2pcrypto.MarshalPublicKey(pubkey)
+	has, err := hasBucket(bucketReg, bucketName, pkraw)
 	if err != nil {
 		return nil, err
 	}
@@ -39,6 +43,34 @@ func CreateBucket(bucketReg BucketRegistry, bucketSrc BucketSource, bucketName s
 	return NewBucket(bucketName, pubkey, nd.Cid())
 }
 
+// CreateMultisigBucket creates a new bucket that is owned by the given multisig owner, the bucket is not signed
+func CreateMultisigBucket(bucketReg BucketRegistry, bucketSrc BucketSource, bucketName string, owner *cipher.MultisigOwner) (*Bucket, error) {
+	has, err := hasBucket(bucketReg, bucketName, owner.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return nil, commons.AlreadyExistsErr
+	}
+
+	nd, err := bucketSrc.NewBucket()
+	if err != nil {
+		return nil, err
+	}
+	return NewMultisigBucket(bucketName, owner, nd.Cid())
+}
+
+// hasBucket checks whether a bucket with the given name and owner exists, either with a legacy hash or with any supported algorithm
+func hasBucket(bucketReg BucketRegistry, name string, pk []byte) (bool, error) {
+	for _, alg := range append([]uint64{0}, cipher.HashAlgs()...) {
+		has, err := bucketReg.Has(BucketHash(name, pk, alg))
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
 func AddToBucket(bucketReg BucketRegistry, bucketSrc BucketSource, bucketHash string, dr *DataRef) (*Bucket, error) {
 	bucket, err := bucketReg.Load(bucketHash)
 	if err != nil {
@@ -54,6 +86,36 @@ func AddToBucket(bucketReg BucketRegistry, bucketSrc BucketSource, bucketHash st
 	return bucket, nil
 }
 
+func RemoveFromBucket(bucketReg BucketRegistry, bucketSrc BucketSource, bucketHash string, name string) (*Bucket, error) {
+	bucket, err := bucketReg.Load(bucketHash)
+	if err != nil {
+		return nil, err
+	}
+	newBucketNd, err := bucketSrc.RemoveChild(bucket.NodeCid(), name)
+	if err != nil {
+		return nil, err
+	}
+	if !bucket.setNode(newBucketNd) {
+		return nil, CouldNotUpdateBucketNodeErr
+	}
+	return bucket, nil
+}
+
+func MoveInBucket(bucketReg BucketRegistry, bucketSrc BucketSource, bucketHash string, from, to string) (*Bucket, error) {
+	bucket, err := bucketReg.Load(bucketHash)
+	if err != nil {
+		return nil, err
+	}
+	newBucketNd, err := bucketSrc.MoveChild(bucket.NodeCid(), from, to)
+	if err != nil {
+		return nil, err
+	}
+	if !bucket.setNode(newBucketNd) {
+		return nil, CouldNotUpdateBucketNodeErr
+	}
+	return bucket, nil
+}
+
 func ListBuckets(bucketReg BucketRegistry, filter BucketFilter) []Bucket {
 	buckets := []Bucket{}
 	bucketReg.ForEach(func(hash string, b *Bucket) (bool, error) {
@@ -73,6 +135,8 @@ func ListBuckets(bucketReg BucketRegistry, filter BucketFilter) []Bucket {
 // https://github.com/ipfs/go-ds-crdt/blob/v0.1.17/crdt.go#L348
 // therefore, buckets are signed before they get stored, in addition pubkey namespaces are applied
 type Bucket struct {
+	// version of the encoding, see EncodingVersion
+	version uint64
 	// name of the current bucket
 	name string
 	// node cid of the underlying unixfs bucket
@@ -83,6 +147,18 @@ type Bucket struct {
 	salt []byte
 	// pubkey is the marshaled public key related to this bucket
 	pubkey []byte
+	// hashAlg is the hash algorithm (multicodec) of the bucket hash, 0 for legacy (hex sha2-256) hashes
+	hashAlg uint64
+	// replicas is the desired amount of nodes that should hold the bucket data, 0 means no requirement
+	replicas int
+	// seq is a monotonic sequence number of versions, incremented on each signing
+	seq uint64
+	// rotations is the chain of key rotations, the last rotated key signs the bucket
+	rotations []*KeyRotation
+	// multisig is the owner of multisig buckets, its hash is used as the pubkey
+	multisig *cipher.MultisigOwner
+	// sigs are the partial signatures of multisig buckets
+	sigs []cipher.PartialSignature
 	// sig is the signature made with the corresponding private key
 	sig []byte
 }
@@ -91,13 +167,15 @@ type Buckets struct {
 	Items []Bucket
 }
 
-func BucketHash(name string, pk []byte) string {
-	return hex.EncodeToString(cipher.Hash(append([]byte(name), pk...)))
+// BucketHash returns the (hex) multihash of the bucket with the given name and owner, alg 0 returns legacy hashes
+func BucketHash(name string, pk []byte, alg uint64) string {
+	hash, _ := cipher.HexHash(append([]byte(name), pk...), alg)
+	return hash
 }
 
-func BucketHashPK(name string, pk libp2pcrypto.PubKey) string {
+func BucketHashPK(name string, pk libp2pcrypto.PubKey, alg uint64) string {
 	pkraw, _ := libp2pcrypto.MarshalPublicKey(pk)
-	return BucketHash(name, pkraw)
+	return BucketHash(name, pkraw, alg)
 }
 
 func NewBucket(name string, pubkey libp2pcrypto.PubKey, nodeCid cid.Cid) (*Bucket, error) {
@@ -108,32 +186,90 @@ func NewBucket(name string, pubkey libp2pcrypto.PubKey, nodeCid cid.Cid) (*Bucke
 	pkraw, _ := libp2pcrypto.MarshalPublicKey(pubkey)
 	cidraw, _ := nodeCid.MarshalText()
 
-	dref := Bucket{name, cidraw, 0, salt, pkraw, []byte{}}
+	dref := Bucket{EncodingVersion, name, cidraw, 0, salt, pkraw, BucketHashAlg, 0, 0, nil, nil, nil, []byte{}}
 
 	return &dref, nil
 }
 
+// NewMultisigBucket creates a bucket that is owned by the given multisig owner,
+// the hash of the owner descriptor takes the place of the pubkey (and therefore is part of the bucket hash)
+func NewMultisigBucket(name string, owner *cipher.MultisigOwner, nodeCid cid.Cid) (*Bucket, error) {
+	if len(name) == 0 || owner == nil || owner.Validate() != nil {
+		return nil, commons.BadInputErr
+	}
+	salt, _ := cipher.NewRandKey(32)
+	cidraw, _ := nodeCid.MarshalText()
+
+	dref := Bucket{EncodingVersion, name, cidraw, 0, salt, owner.Hash(), BucketHashAlg, 0, 0, nil, owner, nil, []byte{}}
+
+	return &dref, nil
+}
+
+// ParseBucket decodes and verifies the given raw bucket, legacy JSON buckets are supported
 func ParseBucket(hash string, raw []byte) (*Bucket, error) {
-	var bmsg bucketMsg
-	err := json.Unmarshal(raw, &bmsg)
-	bucket := fromBucketMsg(&bmsg)
-	if err == nil {
-		if err := bucket.Verify(); err != nil {
+	bucket, err := DecodeBucket(hash, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := bucket.Verify(); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// DecodeBucket decodes the given raw bucket and checks the hash (if given), w/o verifying the signatures.
+// it should be used only for records that were already verified
+func DecodeBucket(hash string, raw []byte) (*Bucket, error) {
+	bucket, err := decodeBucket(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) > 0 {
+		if err := bucket.VerifyHash(hash); err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+// ParsePendingBucket parses a multisig bucket that might not have enough signatures yet,
+// the signatures that were collected must be valid
+func ParsePendingBucket(hash string, raw []byte) (*Bucket, error) {
+	bucket, err := decodeBucket(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := bucket.verifyMultisigOwner(); err != nil {
+		return nil, err
+	}
+	for _, ps := range bucket.sigs {
+		if err := cipher.VerifyPartial(bucket, bucket.multisig, ps); err != nil {
 			return nil, err
 		}
-		if err = bucket.VerifyHash(hash); len(hash) > 0 && err != nil {
+	}
+	if len(hash) > 0 {
+		if err := bucket.VerifyHash(hash); err != nil {
 			return nil, err
 		}
 	}
-	return bucket, err
+	return bucket, nil
 }
 
+// SerializePendingBucket serializes a multisig bucket regardless of the threshold of signatures,
+// the JSON form is used so pending buckets can be inspected before they are signed offline
+func SerializePendingBucket(bucket *Bucket) ([]byte, error) {
+	if err := bucket.verifyMultisigOwner(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(ToBucketMsg(bucket))
+}
+
+// SerializeBucket verifies the given bucket and returns its canonical encoding
 func SerializeBucket(bucket *Bucket) ([]byte, error) {
 	if err := bucket.Verify(); err != nil {
 		return nil, err
 	}
-	bmsg := ToBucketMsg(bucket)
-	return json.Marshal(bmsg)
+	return encodeBucket(bucket)
 }
 
 func (b *Bucket) setNode(nd ipld.Node) bool {
@@ -149,10 +285,134 @@ func (b *Bucket) Name() string {
 	return b.name
 }
 
+// Hash returns the hash of the bucket, which is derived from the name and the owner
+func (b *Bucket) Hash() string {
+	return BucketHash(b.name, b.pubkey, b.hashAlg)
+}
+
+// HashAlg returns the hash algorithm (multicodec) of the bucket hash, 0 for legacy hashes
+func (b *Bucket) HashAlg() uint64 {
+	return b.hashAlg
+}
+
 func (b *Bucket) PK() []byte {
 	return b.pubkey
 }
 
+// Replicas returns the desired amount of replicas
+func (b *Bucket) Replicas() int {
+	return b.replicas
+}
+
+// SetReplicas sets the desired amount of replicas, the bucket must be signed afterwards
+func (b *Bucket) SetReplicas(replicas int) {
+	if replicas < 0 {
+		replicas = 0
+	}
+	b.replicas = replicas
+}
+
+// Rotations returns the chain of key rotations
+func (b *Bucket) Rotations() []*KeyRotation {
+	return b.rotations
+}
+
+// Authority returns the marshaled public key that signs the bucket, the owner key unless it was rotated
+func (b *Bucket) Authority() []byte {
+	if len(b.rotations) == 0 {
+		return b.pubkey
+	}
+	return b.rotations[len(b.rotations)-1].next
+}
+
+// Rotate delegates the signing authority to the given key, priv must be the current authority.
+// the bucket must be signed afterwards with the new key. multisig buckets can't be rotated
+func (b *Bucket) Rotate(priv libp2pcrypto.PrivKey, next libp2pcrypto.PubKey) error {
+	if b.multisig != nil {
+		return RotationNotValidErr
+	}
+	pkraw, err := libp2pcrypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pkraw, b.Authority()) {
+		return SupersededKeyErr
+	}
+	kr, err := NewKeyRotation(b.Hash(), uint64(len(b.rotations)+1), next)
+	if err != nil {
+		return err
+	}
+	if err = kr.Sign(priv); err != nil {
+		return err
+	}
+	rotations := make([]*KeyRotation, len(b.rotations), len(b.rotations)+1)
+	copy(rotations, b.rotations)
+	b.rotations = append(rotations, kr)
+	return nil
+}
+
+// Multisig returns the owner of multisig buckets, nil for buckets that are owned by a single key
+func (b *Bucket) Multisig() *cipher.MultisigOwner {
+	return b.multisig
+}
+
+// PartialSignatures returns the signatures that were collected for a multisig bucket
+func (b *Bucket) PartialSignatures() []cipher.PartialSignature {
+	return b.sigs
+}
+
+// Touch starts a new version of a multisig bucket, the signatures of the previous version are dropped
+func (b *Bucket) Touch() {
+	b.version = EncodingVersion
+	b.updated = time.Now().Unix()
+	b.seq++
+	b.sigs = nil
+}
+
+// SignPartial adds the signature of one of the signers of a multisig bucket, the version (updated) is not changed
+func (b *Bucket) SignPartial(priv libp2pcrypto.PrivKey) error {
+	if b.multisig == nil {
+		return cipher.MultisigNotValidErr
+	}
+	ps, err := cipher.SignPartial(b, b.multisig, priv)
+	if err != nil {
+		return err
+	}
+	b.addPartialSignature(*ps)
+	return nil
+}
+
+// addPartialSignature adds the given signature, replacing an existing signature of the same signer
+func (b *Bucket) addPartialSignature(ps cipher.PartialSignature) {
+	sigs := []cipher.PartialSignature{}
+	for _, existing := range b.sigs {
+		if !bytes.Equal(existing.PK, ps.PK) {
+			sigs = append(sigs, existing)
+		}
+	}
+	b.sigs = append(sigs, ps)
+}
+
+// Pending returns true for multisig buckets that didn't collect enough signatures
+func (b *Bucket) Pending() bool {
+	return b.multisig != nil && cipher.VerifyMultisig(b, b.multisig, b.sigs) != nil
+}
+
+// Seq returns the sequence number of the version
+func (b *Bucket) Seq() uint64 {
+	return b.seq
+}
+
+// Version returns the version of the encoding, LegacyEncoding for buckets that were not signed since the encoding was versioned
+func (b *Bucket) Version() uint64 {
+	return b.version
+}
+
+// Updated returns the timestamp of the last update
+func (b *Bucket) Updated() int64 {
+	return b.updated
+}
+
 func (b *Bucket) NodeCid() cid.Cid {
 	ndCid, err := cid.Decode(string(b.node))
 	if err != nil {
@@ -161,9 +421,13 @@ func (b *Bucket) NodeCid() cid.Cid {
 	return ndCid
 }
 
+// Sign signs a new version of the bucket, the sequence is incremented.
+// legacy buckets are migrated to the current version of the encoding
 func (b *Bucket) Sign(priv libp2pcrypto.PrivKey) error {
 	bcopy := *b
+	bcopy.version = EncodingVersion
 	bcopy.updated = time.Now().Unix()
+	bcopy.seq = b.seq + 1
 	sig, err := cipher.Sign(&bcopy, priv)
 	if err != nil {
 		return err
@@ -172,23 +436,54 @@ func (b *Bucket) Sign(priv libp2pcrypto.PrivKey) error {
 	if err = bcopy.Verify(); err != nil {
 		return err
 	}
+	b.version = bcopy.version
 	b.updated = bcopy.updated
+	b.seq = bcopy.seq
 	b.sig = sig
 	return nil
 }
 
+// Verify follows the chain of rotations and verifies the bucket with the current authority,
+// multisig buckets are verified only if the threshold of signatures was met
 func (b *Bucket) Verify() error {
-	pk, err := libp2pcrypto.UnmarshalPublicKey(b.pubkey)
+	if b.multisig != nil {
+		if err := b.verifyMultisigOwner(); err != nil {
+			return err
+		}
+		return cipher.VerifyMultisig(b, b.multisig, b.sigs)
+	}
+	authority, err := VerifyRotations(b.Hash(), b.pubkey, b.rotations)
+	if err != nil {
+		return err
+	}
+	pk, err := libp2pcrypto.UnmarshalPublicKey(authority)
 	if err != nil {
 		return err
 	}
 	return cipher.Verify(b, pk)
 }
 
+// verifyMultisigOwner checks that the owner descriptor matches the pubkey (hash) of the bucket
+func (b *Bucket) verifyMultisigOwner() error {
+	if b.multisig == nil {
+		return cipher.MultisigNotValidErr
+	}
+	if err := b.multisig.Validate(); err != nil {
+		return err
+	}
+	if !bytes.Equal(b.multisig.Hash(), b.pubkey) {
+		return PKConflictErr
+	}
+	if len(b.rotations) > 0 {
+		return RotationNotValidErr
+	}
+	return nil
+}
+
+// VerifyHash checks that the given hash was derived from the name and the owner of the bucket,
+// with any of the supported algorithms or as a legacy hash
 func (b *Bucket) VerifyHash(hash string) error {
-	drh := ds.NewKey(BucketHash(b.name, b.pubkey))
-	dsh := ds.NewKey(hash)
-	if dsh.String() != drh.String() {
+	if err := cipher.VerifyHexHash(append([]byte(b.name), b.pubkey...), ds.NewKey(hash).Name()); err != nil {
 		return PKConflictErr
 	}
 	return nil
@@ -198,7 +493,22 @@ func (b *Bucket) Signature() []byte {
 	return b.sig
 }
 
+// Data returns the signing input, which is the canonical encoding of the bucket without signatures
 func (b *Bucket) Data() ([]byte, error) {
+	if b.version == LegacyEncoding {
+		return b.legacyData(), nil
+	}
+	if err := checkVersion(b.version); err != nil {
+		return nil, err
+	}
+	rec := toBucketRecord(b)
+	rec.Sigs = nil
+	rec.Sig = nil
+	return signingInput(bucketDomain, b.version, rec)
+}
+
+// legacyData returns the signing input of buckets that were signed before the encoding was versioned
+func (b *Bucket) legacyData() []byte {
 	data := bytes.Join([][]byte{
 		[]byte(b.name),
 		b.node,
@@ -206,38 +516,82 @@ func (b *Bucket) Data() ([]byte, error) {
 		b.salt,
 		b.pubkey,
 	}, []byte{})
-	return data, nil
+	return data
 }
 
+// bucketMsg is the JSON form of buckets, used by the api and by legacy records
 type bucketMsg struct {
-	Hash    string
-	Name    string
-	Node    []byte
-	Updated int64
-	Salt    []byte
-	PK      []byte
-	Sig     []byte
+	Version   uint64 `json:",omitempty"`
+	Hash      string
+	Name      string
+	Node      []byte
+	Updated   int64
+	Salt      []byte
+	PK        []byte
+	HashAlg   uint64                    `json:",omitempty"`
+	Replicas  int                       `json:",omitempty"`
+	Seq       uint64                    `json:",omitempty"`
+	Rotations []*keyRotationMsg         `json:",omitempty"`
+	Multisig  *cipher.MultisigOwner     `json:",omitempty"`
+	Sigs      []cipher.PartialSignature `json:",omitempty"`
+	Sig       []byte
 }
 
 func ToBucketMsg(bucket *Bucket) *bucketMsg {
 	return &bucketMsg{
-		BucketHash(bucket.name, bucket.pubkey),
+		bucket.version,
+		bucket.Hash(),
 		bucket.name,
 		bucket.node,
 		bucket.updated,
 		bucket.salt,
 		bucket.pubkey,
+		bucket.hashAlg,
+		bucket.replicas,
+		bucket.seq,
+		toKeyRotationMsgs(bucket.rotations),
+		bucket.multisig,
+		bucket.sigs,
 		bucket.sig,
 	}
 }
 
 func fromBucketMsg(bucket *bucketMsg) *Bucket {
 	return &Bucket{
+		bucket.Version,
 		bucket.Name,
 		bucket.Node,
 		bucket.Updated,
 		bucket.Salt,
 		bucket.PK,
+		bucket.HashAlg,
+		bucket.Replicas,
+		bucket.Seq,
+		fromKeyRotationMsgs(bucket.Rotations),
+		bucket.Multisig,
+		bucket.Sigs,
 		bucket.Sig,
 	}
 }
+
+// decodeLegacyBucket decodes the JSON form of buckets
+func decodeLegacyBucket(raw []byte) (*Bucket, error) {
+	var bmsg bucketMsg
+	if err := json.Unmarshal(raw, &bmsg); err != nil {
+		return nil, err
+	}
+	if bmsg.Version > EncodingVersion {
+		return nil, UnsupportedEncodingErr
+	}
+	if err := checkHashAlg(bmsg.Version, bmsg.HashAlg); err != nil {
+		return nil, err
+	}
+	if bmsg.Version == LegacyEncoding {
+		// legacy buckets have only the fields that were signed before the encoding was versioned
+		if bmsg.Updated > LegacyCutoff || bmsg.Replicas > 0 || bmsg.Seq > 0 ||
+			len(bmsg.Rotations) > 0 || bmsg.Multisig != nil || len(bmsg.Sigs) > 0 {
+			return nil, UnsupportedEncodingErr
+		}
+	}
+	return fromBucketMsg(&bmsg), nil
+}
@@ -1,14 +1,17 @@
 package core
 
 import (
+	"encoding/json"
+	"github.com/amirylm/cbn/src/cipher"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
 func TestNewBucket(t *testing.T) {
-	priv, _, _ := crypto.GenerateKeyPair(crypto.RSA, 2048)
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
 	cb, err := p2pstorage.NewCidBuilder("")
 	assert.Nil(t, err)
 	bucketName := "mybucket"
@@ -24,7 +27,264 @@ func TestNewBucket(t *testing.T) {
 	err = bucket.Verify()
 	assert.Nil(t, err)
 
-	priv2, _, _ := crypto.GenerateKeyPair(crypto.RSA, 2048)
+	priv2, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
 	err = bucket.Sign(priv2)
 	assert.NotNil(t, err)
 }
+
+func TestParseBucket(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+	assert.Nil(t, err)
+	assert.Nil(t, bucket.Sign(priv))
+
+	raw, err := SerializeBucket(bucket)
+	assert.Nil(t, err)
+	parsed, err := ParseBucket("", raw)
+	assert.Nil(t, err)
+	assert.Equal(t, bucket.Name(), parsed.Name())
+	parsed, err = ParseBucket(bucket.Hash(), raw)
+	assert.Nil(t, err)
+	assert.NotNil(t, parsed)
+	_, err = ParseBucket(BucketHash("other", bucket.PK(), bucket.HashAlg()), raw)
+	assert.Equal(t, PKConflictErr, err)
+}
+
+func TestBucketHashAlg(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+
+	defaultAlg := BucketHashAlg
+	BucketHashAlg = cipher.BLAKE3
+	defer func() { BucketHashAlg = defaultAlg }()
+
+	bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+	assert.Nil(t, err)
+	assert.Nil(t, bucket.Sign(priv))
+	assert.Equal(t, cipher.BLAKE3, bucket.HashAlg())
+	assert.Equal(t, BucketHashPK("mybucket", priv.GetPublic(), cipher.BLAKE3), bucket.Hash())
+
+	raw, err := SerializeBucket(bucket)
+	assert.Nil(t, err)
+	parsed, err := ParseBucket(bucket.Hash(), raw)
+	assert.Nil(t, err)
+	assert.Equal(t, bucket.Hash(), parsed.Hash())
+	// the bucket is resolvable by any supported algorithm, and by the legacy hash
+	assert.Nil(t, parsed.VerifyHash(BucketHashPK("mybucket", priv.GetPublic(), cipher.SHA2_256)))
+	assert.Nil(t, parsed.VerifyHash(BucketHashPK("mybucket", priv.GetPublic(), 0)))
+	assert.Equal(t, PKConflictErr, parsed.VerifyHash(BucketHashPK("other", priv.GetPublic(), cipher.BLAKE3)))
+
+	// the algorithm is signed
+	parsed.hashAlg = cipher.BLAKE2B_256
+	assert.NotNil(t, parsed.Verify())
+
+	// a bucket with the same name and owner exists once the node switched to another algorithm
+	BucketHashAlg = cipher.SHA2_256
+	reg := hasRegistry{hashes: map[string]bool{bucket.Hash(): true}}
+	has, err := hasBucket(&reg, "mybucket", bucket.PK())
+	assert.Nil(t, err)
+	assert.True(t, has)
+	has, err = hasBucket(&reg, "other", bucket.PK())
+	assert.Nil(t, err)
+	assert.False(t, has)
+}
+
+// hasRegistry is a registry that knows only the given hashes
+type hasRegistry struct {
+	BucketRegistry
+	hashes map[string]bool
+}
+
+func (r *hasRegistry) Has(hash string) (bool, error) {
+	return r.hashes[hash], nil
+}
+
+func TestBucketKeyTypes(t *testing.T) {
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	for _, keyType := range []string{"ed25519", "secp256k1", "ecdsa", "rsa"} {
+		kt, err := cipher.ParseKeyType(keyType)
+		assert.Nil(t, err)
+		priv, err := cipher.GenerateKey(kt)
+		assert.Nil(t, err)
+
+		bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+		assert.Nil(t, err)
+		assert.Nil(t, bucket.Sign(priv), keyType)
+		raw, err := SerializeBucket(bucket)
+		assert.Nil(t, err, keyType)
+		parsed, err := ParseBucket(bucket.Hash(), raw)
+		assert.Nil(t, err, keyType)
+		assert.Equal(t, bucket.Signature(), parsed.Signature())
+
+		pkraw, _ := crypto.MarshalPublicKey(priv.GetPublic())
+		rec := NewDomainRecord(bucket.Hash(), "mydomain", pkraw)
+		assert.Nil(t, rec.Sign(priv), keyType)
+		raw, err = SerializeDomainRecord(rec)
+		assert.Nil(t, err, keyType)
+		_, err = ParseDomainRecord(raw)
+		assert.Nil(t, err, keyType)
+
+		// a key of another type can't sign on behalf of the owner
+		other, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		assert.NotNil(t, bucket.Sign(other), keyType)
+	}
+}
+
+func TestBucketReplicas(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+	assert.Nil(t, err)
+	assert.Nil(t, bucket.Sign(priv))
+	raw, err := SerializeBucket(bucket)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(raw), "replicas")
+
+	bucket.SetReplicas(3)
+	assert.NotNil(t, bucket.Verify())
+	assert.Nil(t, bucket.Sign(priv))
+	raw, err = SerializeBucket(bucket)
+	assert.Nil(t, err)
+	parsed, err := ParseBucket("", raw)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, parsed.Replicas())
+
+	raw, err = json.Marshal(ToBucketMsg(bucket))
+	assert.Nil(t, err)
+	tampered := strings.Replace(string(raw), `"Replicas":3`, `"Replicas":1`, 1)
+	_, err = ParseBucket("", []byte(tampered))
+	assert.NotNil(t, err)
+}
+
+func TestBucketRotation(t *testing.T) {
+	owner, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	next, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewBucket("mybucket", owner.GetPublic(), c)
+	assert.Nil(t, err)
+	assert.Nil(t, bucket.Sign(owner))
+	hash := bucket.Hash()
+
+	// only the current authority can rotate
+	assert.Equal(t, SupersededKeyErr, bucket.Rotate(next, next.GetPublic()))
+	assert.Nil(t, bucket.Rotate(owner, next.GetPublic()))
+	assert.NotNil(t, bucket.Sign(owner))
+	assert.Nil(t, bucket.Sign(next))
+	nextraw, _ := crypto.MarshalPublicKey(next.GetPublic())
+	assert.Equal(t, nextraw, bucket.Authority())
+
+	// the chain is kept when serialized, and the hash is not changed
+	raw, err := SerializeBucket(bucket)
+	assert.Nil(t, err)
+	parsed, err := ParseBucket(hash, raw)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(parsed.Rotations()))
+	assert.True(t, ExtendsRotations(nil, parsed.Rotations()))
+	assert.False(t, ExtendsRotations(parsed.Rotations(), nil))
+
+	// a rotation of another bucket is not valid
+	other, err := NewBucket("other", owner.GetPublic(), c)
+	assert.Nil(t, err)
+	other.rotations = parsed.Rotations()
+	assert.NotNil(t, other.Sign(next))
+	_, err = VerifyRotations(other.Hash(), other.PK(), other.Rotations())
+	assert.Equal(t, RotationNotValidErr, err)
+
+	// the signing input is domain separated
+	data, err := parsed.Rotations()[0].Data()
+	assert.Nil(t, err)
+	assert.Equal(t, "cbn/key-rotation/v1\x00", string(data[:len(keyRotationDomain)+4]))
+}
+
+func TestMultisigBucket(t *testing.T) {
+	privs := []crypto.PrivKey{}
+	pks := []crypto.PubKey{}
+	for i := 0; i < 3; i++ {
+		priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		privs = append(privs, priv)
+		pks = append(pks, priv.GetPublic())
+	}
+	owner, err := cipher.NewMultisigOwner(2, pks...)
+	assert.Nil(t, err)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewMultisigBucket("mybucket", owner, c)
+	assert.Nil(t, err)
+	hash := bucket.Hash()
+	assert.Equal(t, BucketHash("mybucket", owner.Hash(), BucketHashAlg), hash)
+
+	bucket.Touch()
+	assert.Nil(t, bucket.SignPartial(privs[0]))
+	assert.True(t, bucket.Pending())
+	assert.Equal(t, cipher.ThresholdNotMetErr, bucket.Verify())
+	_, err = SerializeBucket(bucket)
+	assert.NotNil(t, err)
+
+	// offline signing, the pending bucket is passed between signers
+	raw, err := SerializePendingBucket(bucket)
+	assert.Nil(t, err)
+	pending, err := ParsePendingBucket(hash, raw)
+	assert.Nil(t, err)
+	assert.Nil(t, pending.SignPartial(privs[1]))
+	assert.False(t, pending.Pending())
+	assert.Nil(t, pending.Verify())
+	raw, err = SerializeBucket(pending)
+	assert.Nil(t, err)
+	parsed, err := ParseBucket(hash, raw)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(parsed.PartialSignatures()))
+
+	// signatures of a previous version are not valid
+	parsed.SetReplicas(2)
+	assert.Equal(t, cipher.ThresholdNotMetErr, parsed.Verify())
+	assert.Equal(t, RotationNotValidErr, parsed.Rotate(privs[0], pks[1]))
+}
+
+func TestBucketSeq(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), bucket.Seq())
+
+	assert.Nil(t, bucket.Sign(priv))
+	assert.Equal(t, uint64(1), bucket.Seq())
+	assert.Nil(t, bucket.Sign(priv))
+	assert.Equal(t, uint64(2), bucket.Seq())
+
+	// the sequence is signed
+	raw, err := SerializeBucket(bucket)
+	assert.Nil(t, err)
+	parsed, err := ParseBucket("", raw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), parsed.Seq())
+	parsed.seq = 3
+	assert.Equal(t, cipher.NotVerifiedErr, parsed.Verify())
+
+	// seq can't be mixed up with replicas
+	bucket.SetReplicas(1)
+	assert.Nil(t, bucket.Sign(priv))
+	bucket.replicas, bucket.seq = 13, 0
+	assert.Equal(t, cipher.NotVerifiedErr, bucket.Verify())
+}
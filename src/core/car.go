@@ -0,0 +1,161 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/amirylm/cbn/src/car"
+	"github.com/amirylm/cbn/src/commons"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+	"io"
+	"log"
+)
+
+var (
+	CarNotValidErr = errors.New("car does not contain a valid bucket")
+)
+
+// ExportBucket writes the given bucket as a CAR file,
+// the roots are the signed bucket record (raw block) and the bucket DAG root.
+// the car contains all the blocks of the bucket DAG and the referenced data
+func (ctrl *Controller) ExportBucket(hash string, w io.Writer) error {
+	bucket, err := ctrl.bucketReg.Load(hash)
+	if err != nil {
+		return err
+	}
+	raw, err := SerializeBucket(bucket)
+	if err != nil {
+		return err
+	}
+	recordCid, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}.Sum(raw)
+	if err != nil {
+		return err
+	}
+	cw, err := car.NewWriter(w, []cid.Cid{recordCid, bucket.NodeCid()})
+	if err != nil {
+		return err
+	}
+	if err = cw.WriteBlock(recordCid, raw); err != nil {
+		return err
+	}
+
+	visited := cid.NewSet()
+	writeBlock := func(nd ipld.Node) error {
+		return cw.WriteBlock(nd.Cid(), nd.RawData())
+	}
+	ctx := ctrl.peer.Context()
+	if err = ctrl.walkDag(ctx, bucket.NodeCid(), visited, writeBlock); err != nil {
+		return err
+	}
+	return ctrl.bucketSrc.Walk(bucket.NodeCid(), func(p string, dr *DataRef) (bool, error) {
+		return true, ctrl.walkDag(ctx, dr.NodeCid(), visited, writeBlock)
+	})
+}
+
+// walkDag visits all the nodes of the given DAG (depth first), missing blocks are fetched from the network
+func (ctrl *Controller) walkDag(ctx context.Context, root cid.Cid, visited *cid.Set, visit func(ipld.Node) error) error {
+	if !visited.Visit(root) {
+		return nil
+	}
+	nd, err := ctrl.peer.DagService().Get(ctx, root)
+	if err != nil {
+		return err
+	}
+	if err = visit(nd); err != nil {
+		return err
+	}
+	for _, l := range nd.Links() {
+		if err = ctrl.walkDag(ctx, l.Cid, visited, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportBucket reads a CAR file that was created with ExportBucket,
+// the bucket record must be the first block and validly signed, otherwise nothing is stored.
+// every block is verified against its cid, and the imported DAG (including the referenced data)
+// must be complete. the blocks are stored and the bucket is saved in the registry
+func (ctrl *Controller) ImportBucket(r io.Reader) (*Bucket, error) {
+	defer ctrl.writeLock()()
+	cr, err := car.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(cr.Header.Roots) != 2 {
+		return nil, CarNotValidErr
+	}
+	recordCid, nodeCid := cr.Header.Roots[0], cr.Header.Roots[1]
+
+	// the record is verified before any block is stored
+	b, err := cr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !b.Cid().Equals(recordCid) {
+		return nil, CarNotValidErr
+	}
+	bucket, err := ParseBucket("", b.RawData())
+	if err != nil {
+		return nil, err
+	}
+	if !bucket.NodeCid().Equals(nodeCid) {
+		return nil, CarNotValidErr
+	}
+
+	bstore := ctrl.peer.BlockService().Blockstore()
+	// added are the new blocks, which are removed if the import fails
+	added := []cid.Cid{}
+	err = ctrl.importBlocks(cr, bucket, func(b blocks.Block) error {
+		if has, err := bstore.Has(b.Cid()); err != nil || has {
+			return err
+		}
+		if err := bstore.Put(b); err != nil {
+			return err
+		}
+		added = append(added, b.Cid())
+		return nil
+	})
+	if err == nil {
+		err = ctrl.bucketReg.Save(bucket)
+	}
+	if err != nil {
+		for _, c := range added {
+			if err := bstore.DeleteBlock(c); err != nil {
+				log.Println("could not remove imported block:", err)
+			}
+		}
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// importBlocks stores the remaining blocks of the car and checks that the bucket DAG
+// and the DAGs of its DataRefs are complete
+func (ctrl *Controller) importBlocks(cr *car.Reader, bucket *Bucket, put func(blocks.Block) error) error {
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err = put(b); err != nil {
+			return err
+		}
+	}
+	visited := cid.NewSet()
+	err := ctrl.checkLocalDag(bucket.NodeCid(), visited)
+	if err == nil {
+		// the bucket DAG is complete, therefore it is walked locally
+		err = ctrl.bucketSrc.Walk(bucket.NodeCid(), func(p string, dr *DataRef) (bool, error) {
+			return true, ctrl.checkLocalDag(dr.NodeCid(), visited)
+		})
+	}
+	if err == commons.NotFoundErr {
+		return CarNotValidErr
+	}
+	return err
+}
@@ -1,9 +1,16 @@
 package core
 
 import (
+	"github.com/amirylm/cbn/src/cipher"
+	"github.com/amirylm/cbn/src/commons"
+	"github.com/amirylm/cbn/src/metrics"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/ipfs/go-cid"
 	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"io"
+	"sync"
+	"time"
 )
 
 // BucketFilter is used to provide query capability
@@ -18,10 +25,24 @@ type Controller struct {
 	bucketReg BucketRegistry
 	dataSrc   DataSource
 	bucketSrc BucketSource
+
+	recent *recentRoots
+	// gcLock is held (shared) while DAGs are written and (exclusively) by GC,
+	// so blocks that are reused by a write can't be collected before the write is referenced
+	gcLock sync.RWMutex
+
+	// identities are optional, the key of the peer is used by default
+	idLock   sync.RWMutex
+	keys     *cipher.Keystore
+	identity string
+
+	// pending holds versions of multisig buckets that are collecting signatures
+	pending     map[string]*Bucket
+	pendingLock sync.Mutex
 }
 
 func NewController(peer *p2pstorage.MultiStorePeer, br BucketRegistry, bs BucketSource, ds DataSource) *Controller {
-	ctrl := Controller{peer, br, ds, bs}
+	ctrl := Controller{peer: peer, bucketReg: br, dataSrc: ds, bucketSrc: bs, recent: newRecentRoots(), pending: map[string]*Bucket{}}
 
 	return &ctrl
 }
@@ -46,12 +67,120 @@ func (ctrl *Controller) BucketSource() BucketSource {
 	return ctrl.bucketSrc
 }
 
-// Commit seals and persists the given Bucket
+// UseKeystore sets the keystore of identities and the default identity (empty for the key of the peer)
+func (ctrl *Controller) UseKeystore(ks *cipher.Keystore, identity string) error {
+	ctrl.idLock.Lock()
+	ctrl.keys = ks
+	ctrl.idLock.Unlock()
+
+	return ctrl.SetIdentity(identity)
+}
+
+// Keystore returns the keystore of identities, might be nil
+func (ctrl *Controller) Keystore() *cipher.Keystore {
+	ctrl.idLock.RLock()
+	defer ctrl.idLock.RUnlock()
+
+	return ctrl.keys
+}
+
+// SetIdentity sets the default identity that signs buckets, empty name resets to the key of the peer
+func (ctrl *Controller) SetIdentity(name string) error {
+	if len(name) > 0 {
+		if _, err := ctrl.Identity(name); err != nil {
+			return err
+		}
+	}
+	ctrl.idLock.Lock()
+	defer ctrl.idLock.Unlock()
+
+	ctrl.identity = name
+	return nil
+}
+
+// Identity returns the key of the given identity, empty name returns the default identity
+func (ctrl *Controller) Identity(name string) (libp2pcrypto.PrivKey, error) {
+	ctrl.idLock.RLock()
+	ks := ctrl.keys
+	if len(name) == 0 {
+		name = ctrl.identity
+	}
+	ctrl.idLock.RUnlock()
+
+	if len(name) == 0 {
+		return ctrl.peer.PrivKey(), nil
+	}
+	if ks == nil {
+		return nil, cipher.KeyNotFoundErr
+	}
+	return ks.Get(name)
+}
+
+// Owns returns true if the given (marshaled) public key belongs to the peer or to one of the identities
+func (ctrl *Controller) Owns(pkraw []byte) bool {
+	pk, err := libp2pcrypto.UnmarshalPublicKey(pkraw)
+	if err != nil {
+		return false
+	}
+	id, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		return false
+	}
+	if id == ctrl.peer.Host().ID() {
+		return true
+	}
+	ks := ctrl.Keystore()
+	if ks == nil {
+		return false
+	}
+	keys, err := ks.List()
+	if err != nil {
+		return false
+	}
+	for _, k := range keys {
+		if k.ID == id.Pretty() {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKey returns the given key or the key of the default identity if nil
+func (ctrl *Controller) signingKey(priv libp2pcrypto.PrivKey) (libp2pcrypto.PrivKey, error) {
+	if priv != nil {
+		return priv, nil
+	}
+	return ctrl.Identity("")
+}
+
+// GCLock blocks writes of DAGs (uploads, batches, imports and bucket changes), the returned func releases the lock
+func (ctrl *Controller) GCLock() func() {
+	ctrl.gcLock.Lock()
+	return ctrl.gcLock.Unlock
+}
+
+// writeLock is held while some DAG is written, the returned func releases the lock
+func (ctrl *Controller) writeLock() func() {
+	ctrl.gcLock.RLock()
+	return ctrl.gcLock.RUnlock
+}
+
+// Commit seals and persists the given Bucket.
+// a new version of multisig buckets is signed with priv (if it is one of the signers),
+// and kept pending until enough signatures were collected (PendingSignaturesErr)
 func (ctrl *Controller) Commit(bucket *Bucket, priv libp2pcrypto.PrivKey) error {
-	if priv == nil {
-		priv = ctrl.peer.PrivKey()
+	priv, err := ctrl.signingKey(priv)
+	if err != nil {
+		return err
 	}
-	if err := bucket.Sign(priv); err != nil {
+	if bucket.Multisig() != nil {
+		bucket.Touch()
+		if err = bucket.SignPartial(priv); err != nil && err != cipher.NotASignerErr {
+			return err
+		}
+		return ctrl.commitMultisig(bucket)
+	}
+	if err = bucket.Sign(priv); err != nil {
 		return err
 	}
 	return ctrl.bucketReg.Save(bucket)
@@ -59,9 +188,11 @@ func (ctrl *Controller) Commit(bucket *Bucket, priv libp2pcrypto.PrivKey) error
 
 // CreateBucket creates a new bucket and commits it
 func (ctrl *Controller) CreateBucket(bucketName string, priv libp2pcrypto.PrivKey) (*Bucket, error) {
-	if priv == nil {
-		priv = ctrl.peer.PrivKey()
+	priv, err := ctrl.signingKey(priv)
+	if err != nil {
+		return nil, err
 	}
+	defer ctrl.writeLock()()
 	bucket, err := CreateBucket(ctrl.bucketReg, ctrl.bucketSrc, bucketName, priv.GetPublic())
 	if err != nil {
 		return nil, err
@@ -70,10 +201,88 @@ func (ctrl *Controller) CreateBucket(bucketName string, priv libp2pcrypto.PrivKe
 	return bucket, err
 }
 
+// RotateKey delegates the signing authority of some bucket to the next key, priv must be the current authority.
+// the bucket is committed with the next key, afterwards updates that are signed by priv are rejected
+func (ctrl *Controller) RotateKey(bucketHash string, next, priv libp2pcrypto.PrivKey) (*Bucket, error) {
+	priv, err := ctrl.signingKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := ctrl.bucketReg.Load(bucketHash)
+	if err != nil {
+		return nil, err
+	}
+	if err = bucket.Rotate(priv, next.GetPublic()); err != nil {
+		return nil, err
+	}
+	err = ctrl.Commit(bucket, next)
+	return bucket, err
+}
+
+// CreateMultisigBucket creates a new bucket that is owned by the given multisig owner,
+// the bucket is pending (PendingSignaturesErr) until enough signatures were collected
+func (ctrl *Controller) CreateMultisigBucket(bucketName string, owner *cipher.MultisigOwner, priv libp2pcrypto.PrivKey) (*Bucket, error) {
+	defer ctrl.writeLock()()
+	bucket, err := CreateMultisigBucket(ctrl.bucketReg, ctrl.bucketSrc, bucketName, owner)
+	if err != nil {
+		return nil, err
+	}
+	err = ctrl.Commit(bucket, priv)
+	return bucket, err
+}
+
+// Pending returns the version of some multisig bucket that is collecting signatures
+func (ctrl *Controller) Pending(bucketHash string) (*Bucket, error) {
+	ctrl.pendingLock.Lock()
+	defer ctrl.pendingLock.Unlock()
+
+	bucket, ok := ctrl.pending[bucketHash]
+	if !ok {
+		return nil, commons.NotFoundErr
+	}
+	b := *bucket
+	return &b, nil
+}
+
+// AddSignatures adds the partial signatures of the given (signed offline) bucket to the pending version,
+// the bucket is saved once enough signatures were collected
+func (ctrl *Controller) AddSignatures(bucketHash string, signed *Bucket) (*Bucket, error) {
+	pending, err := ctrl.Pending(bucketHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, ps := range signed.PartialSignatures() {
+		if err = cipher.VerifyPartial(pending, pending.Multisig(), ps); err != nil {
+			return nil, err
+		}
+		pending.addPartialSignature(ps)
+	}
+	err = ctrl.commitMultisig(pending)
+	return pending, err
+}
+
+// commitMultisig saves the given multisig bucket if the threshold was met, otherwise it replaces the pending version
+func (ctrl *Controller) commitMultisig(bucket *Bucket) error {
+	hash := bucket.Hash()
+	ctrl.pendingLock.Lock()
+	defer ctrl.pendingLock.Unlock()
+
+	if bucket.Pending() {
+		ctrl.pending[hash] = bucket
+		return PendingSignaturesErr
+	}
+	if err := ctrl.bucketReg.Save(bucket); err != nil {
+		return err
+	}
+	delete(ctrl.pending, hash)
+	return nil
+}
+
 // Upload takes a stream and upload it into some bucket
 func (ctrl *Controller) Upload(bucketHash string, fh FileHeader, r io.Reader, priv libp2pcrypto.PrivKey) error {
-	if priv == nil {
-		priv = ctrl.peer.PrivKey()
+	priv, err := ctrl.signingKey(priv)
+	if err != nil {
+		return err
 	}
 	if has, err := ctrl.bucketReg.Has(bucketHash); err != nil {
 		return err
@@ -81,38 +290,91 @@ func (ctrl *Controller) Upload(bucketHash string, fh FileHeader, r io.Reader, pr
 		return BucketNotExistErr
 	}
 
-	dataNd, err := ctrl.dataSrc.Add(r)
+	batch, err := ctrl.NewBatch(bucketHash)
 	if err != nil {
 		return err
 	}
-	fh.Size, err = dataNd.Size()
+	if _, err = batch.Add(fh, r); err != nil {
+		return err
+	}
+	_, err = batch.Commit(priv)
+	return err
+}
+
+// Remove removes the given file or directory (including its content) from some bucket
+func (ctrl *Controller) Remove(bucketHash, name string, priv libp2pcrypto.PrivKey) error {
+	priv, err := ctrl.signingKey(priv)
 	if err != nil {
 		return err
 	}
-	dr := NewDataRef(dataNd.Cid(), ctrl.dataSrc.ID(), fh)
-	bucket, err := AddToBucket(ctrl.bucketReg, ctrl.bucketSrc, bucketHash, dr)
+	defer ctrl.writeLock()()
+	bucket, err := RemoveFromBucket(ctrl.bucketReg, ctrl.bucketSrc, bucketHash, name)
 	if err != nil {
 		return err
 	}
+	return ctrl.Commit(bucket, priv)
+}
 
+// Move moves (or renames) the given file or directory within some bucket
+func (ctrl *Controller) Move(bucketHash, from, to string, priv libp2pcrypto.PrivKey) error {
+	priv, err := ctrl.signingKey(priv)
+	if err != nil {
+		return err
+	}
+	defer ctrl.writeLock()()
+	bucket, err := MoveInBucket(ctrl.bucketReg, ctrl.bucketSrc, bucketHash, from, to)
+	if err != nil {
+		return err
+	}
 	return ctrl.Commit(bucket, priv)
 }
 
-// Upload takes a stream and upload it into some bucket
-func (ctrl *Controller) UploadData(fh FileHeader, r io.Reader) (*DataRef, error) {
-	dataNd, err := ctrl.dataSrc.Add(r)
+// SetReplicas sets the desired amount of replicas of some bucket
+func (ctrl *Controller) SetReplicas(bucketHash string, replicas int, priv libp2pcrypto.PrivKey) error {
+	priv, err := ctrl.signingKey(priv)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	fh.Size, err = dataNd.Size()
+	bucket, err := ctrl.bucketReg.Load(bucketHash)
+	if err != nil {
+		return err
+	}
+	bucket.SetReplicas(replicas)
+	return ctrl.Commit(bucket, priv)
+}
+
+// Upload takes a stream and upload it into some bucket
+func (ctrl *Controller) UploadData(fh FileHeader, r io.Reader) (*DataRef, error) {
+	defer ctrl.writeLock()()
+	start := time.Now()
+	// the size of the DAG includes nodes overhead, therefore the actual data is counted
+	cr := countingReader{r: r}
+	dataNd, err := ctrl.dataSrc.Add(&cr)
 	if err != nil {
 		return nil, err
 	}
+	fh.Size = cr.n
+	metrics.ObserveSince(metrics.UploadDuration, start)
+	metrics.UploadSize.Observe(float64(cr.n))
+	metrics.Uploads.Inc()
+	ctrl.recent.add(dataNd.Cid())
 	return NewDataRef(dataNd.Cid(), ctrl.dataSrc.ID(), fh), nil
 }
 
 // Download fetch the stream/data from the given bucket
 func (ctrl *Controller) Download(bucketHash, fileName string) (io.Reader, *DataRef, error) {
+	reader, ref, err := ctrl.download(bucketHash, fileName)
+	if err != nil {
+		metrics.Downloads.WithLabelValues("error").Inc()
+	} else {
+		metrics.Downloads.WithLabelValues("ok").Inc()
+	}
+	return reader, ref, err
+}
+
+func (ctrl *Controller) download(bucketHash, fileName string) (io.Reader, *DataRef, error) {
+	defer metrics.ObserveSince(metrics.DownloadDuration, time.Now())
+
 	bucket, err := ctrl.bucketReg.Load(bucketHash)
 	if err != nil {
 		return nil, nil, err
@@ -130,6 +392,18 @@ func (ctrl *Controller) ListBuckets(filter BucketFilter) []Bucket {
 	return ListBuckets(ctrl.bucketReg, filter)
 }
 
+// RecentRoots returns the roots of DAGs that were created within the given duration,
+// they might not be referenced by any bucket yet and therefore should be kept by GC
+func (ctrl *Controller) RecentRoots(maxAge time.Duration) []cid.Cid {
+	return ctrl.recent.list(maxAge)
+}
+
+// SubscribeBuckets returns a channel of bucket changes (local or remote) that passed the given filter,
+// the returned function must be called once the subscriber is done
+func (ctrl *Controller) SubscribeBuckets(filter BucketEventFilter) (<-chan BucketEvent, func()) {
+	return ctrl.bucketReg.Subscribe(filter)
+}
+
 // SaveSignedBucket persists the given Bucket
 func (ctrl *Controller) SaveSignedBucket(bucket *Bucket) error {
 	return ctrl.bucketReg.Save(bucket)
@@ -137,9 +411,28 @@ func (ctrl *Controller) SaveSignedBucket(bucket *Bucket) error {
 
 // GetBucketContent returns the content of the given bucket hash
 func (ctrl *Controller) GetBucketContent(hash string) ([]string, error) {
-	b, err := ctrl.bucketReg.Load(hash)
+	return ctrl.GetBucketDirContent(hash, "")
+}
+
+// GetBucketDirContent returns the content of the given directory within the bucket
+// NOTE: large buckets should be iterated with ForEachBucketEntry
+func (ctrl *Controller) GetBucketDirContent(hash, dirPath string) ([]string, error) {
+	names := []string{}
+	err := ctrl.ForEachBucketEntry(hash, dirPath, func(name string) (bool, error) {
+		names = append(names, name)
+		return true, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return ctrl.bucketSrc.GetNames(b.NodeCid())
+	return names, nil
+}
+
+// ForEachBucketEntry loops through the names within the given directory of the bucket
+func (ctrl *Controller) ForEachBucketEntry(hash, dirPath string, iterator NameIterator) error {
+	b, err := ctrl.bucketReg.Load(hash)
+	if err != nil {
+		return err
+	}
+	return ctrl.bucketSrc.ForEachName(b.NodeCid(), dirPath, iterator)
 }
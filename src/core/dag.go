@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/amirylm/cbn/src/commons"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+var (
+	DagTooLargeErr = errors.New("dag exceeds the size limit")
+)
+
+// HasDag returns whether all the blocks of the given DAG are stored locally
+func (ctrl *Controller) HasDag(root cid.Cid) (bool, error) {
+	err := ctrl.checkLocalDag(root, cid.NewSet())
+	if err == commons.NotFoundErr {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkLocalDag checks that all the blocks of the given DAG are stored locally,
+// commons.NotFoundErr is returned for missing blocks
+func (ctrl *Controller) checkLocalDag(root cid.Cid, visited *cid.Set) error {
+	if !visited.Visit(root) {
+		return nil
+	}
+	bstore := ctrl.peer.BlockService().Blockstore()
+	if has, err := bstore.Has(root); err != nil {
+		return err
+	} else if !has {
+		return commons.NotFoundErr
+	}
+	b, err := bstore.Get(root)
+	if err != nil {
+		return err
+	}
+	nd, err := ipld.Decode(b)
+	if err != nil {
+		return err
+	}
+	for _, l := range nd.Links() {
+		if err = ctrl.checkLocalDag(l.Cid, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DagSize returns the actual size (sum of unique blocks) of the given DAGs, missing blocks are fetched from the network.
+// DagTooLargeErr is returned once the size exceeds the given limit (0 for no limit), w/o fetching the rest of the DAGs
+func (ctrl *Controller) DagSize(ctx context.Context, limit uint64, roots ...cid.Cid) (uint64, error) {
+	var size uint64
+	visited := cid.NewSet()
+	for _, root := range roots {
+		err := ctrl.walkDag(ctx, root, visited, func(nd ipld.Node) error {
+			size += uint64(len(nd.RawData()))
+			if limit > 0 && size > limit {
+				return DagTooLargeErr
+			}
+			return nil
+		})
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
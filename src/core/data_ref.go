@@ -3,18 +3,20 @@ package core
 import (
 	"encoding/json"
 	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"io"
 )
 
 // FileHeader represents
 type FileHeader struct {
 	Filename string
 	//Header   textproto.MIMEHeader
-	Size     uint64
-	Type     string
+	Size uint64
+	Type string
 }
 
-func NewFileHeader(name, ctype string) *FileHeader  {
-	fh:=  FileHeader{name, 0 , ctype}
+func NewFileHeader(name, ctype string) *FileHeader {
+	fh := FileHeader{name, 0, ctype}
 	return &fh
 }
 
@@ -24,7 +26,7 @@ type DataRef struct {
 	// Cid of the data
 	Cid []byte
 	// Src is the data source
-	Src  string
+	Src string
 }
 
 func NewDataRef(dataCid cid.Cid, src string, fh FileHeader) *DataRef {
@@ -40,12 +42,38 @@ func (dr *DataRef) NodeCid() cid.Cid {
 	return c
 }
 
+// MarshalDataRef returns the canonical encoding of the given data ref
 func MarshalDataRef(dr *DataRef) ([]byte, error) {
-	return json.Marshal(dr)
+	rec := dataRefRecord{EncodingVersion, dr.Header.Filename, dr.Header.Size, dr.Header.Type, dr.Cid, dr.Src}
+	return cbor.DumpObject(&rec)
 }
 
+// UnmarshalDataRef decodes the given raw data ref, legacy JSON refs are supported
 func UnmarshalDataRef(raw []byte) (*DataRef, error) {
 	var dr DataRef
-	err := json.Unmarshal(raw, &dr)
-	return &dr, err
-}
\ No newline at end of file
+	if isLegacy(raw) {
+		err := json.Unmarshal(raw, &dr)
+		return &dr, err
+	}
+	var rec dataRefRecord
+	if err := cbor.DecodeInto(raw, &rec); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(rec.V); err != nil {
+		return nil, err
+	}
+	dr = DataRef{FileHeader{rec.Filename, rec.Size, rec.Type}, rec.Cid, rec.Src}
+	return &dr, nil
+}
+
+// countingReader counts the bytes that were read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
@@ -0,0 +1,358 @@
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/amirylm/cbn/src/cipher"
+	"github.com/ipfs/go-cid"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"time"
+)
+
+var (
+	DealNotValidErr = errors.New("deal is not valid")
+	DealRejectedErr = errors.New("deal was rejected")
+)
+
+// DealRegistry saves accepted deals
+type DealRegistry interface {
+	Save(d *Deal) error
+	Load(id string) (*Deal, error)
+	ForEach(iterator DealIterator) error
+}
+
+// DealIterator is used to loop through deals
+type DealIterator = func(string, *Deal) (bool, error)
+
+// DealPolicy decides whether a storage node accepts the given proposal, nil error means accepted
+type DealPolicy = func(*DealProposal) error
+
+// DealProposal is made by a client that asks some storage node (provider) to keep a bucket or cids
+type DealProposal struct {
+	// bucket is the hash of the bucket to keep, optional
+	bucket string
+	// cids to keep, optional
+	cids []string
+	// size is the total size (bytes) of the content
+	size uint64
+	// duration (seconds) of the deal, starting once accepted
+	duration int64
+	// price units that the client pays for the deal
+	price uint64
+	// provider is the peer id of the storage node
+	provider string
+	// created is the timestamp of the proposal
+	created int64
+	// pubkey is the marshaled public key of the client
+	pubkey []byte
+	// sig is the signature made with the corresponding private key
+	sig []byte
+}
+
+func NewDealProposal(bucket string, cids []string, size uint64, duration time.Duration, price uint64, provider peer.ID, pubkey libp2pcrypto.PubKey) (*DealProposal, error) {
+	pkraw, err := libp2pcrypto.MarshalPublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	dp := DealProposal{bucket, cids, size, int64(duration / time.Second), price, provider.Pretty(), time.Now().Unix(), pkraw, []byte{}}
+
+	return &dp, nil
+}
+
+func (dp *DealProposal) Sign(priv libp2pcrypto.PrivKey) error {
+	sig, err := cipher.Sign(dp, priv)
+	if err != nil {
+		return err
+	}
+	dpcopy := *dp
+	dpcopy.sig = sig
+	if err = dpcopy.Verify(); err != nil {
+		return err
+	}
+	dp.sig = sig
+	return nil
+}
+
+func (dp *DealProposal) Verify() error {
+	pk, err := libp2pcrypto.UnmarshalPublicKey(dp.pubkey)
+	if err != nil {
+		return err
+	}
+	return cipher.Verify(dp, pk)
+}
+
+// Validate checks that the proposal is well formed
+func (dp *DealProposal) Validate() error {
+	if len(dp.bucket) == 0 && len(dp.cids) == 0 {
+		return DealNotValidErr
+	}
+	if dp.duration <= 0 {
+		return DealNotValidErr
+	}
+	for _, c := range dp.cids {
+		if _, err := cid.Decode(c); err != nil {
+			return DealNotValidErr
+		}
+	}
+	if _, err := peer.Decode(dp.provider); err != nil {
+		return DealNotValidErr
+	}
+	return nil
+}
+
+func (dp *DealProposal) Bucket() string {
+	return dp.bucket
+}
+
+func (dp *DealProposal) Cids() []string {
+	return dp.cids
+}
+
+func (dp *DealProposal) Size() uint64 {
+	return dp.size
+}
+
+func (dp *DealProposal) Duration() time.Duration {
+	return time.Duration(dp.duration) * time.Second
+}
+
+func (dp *DealProposal) Price() uint64 {
+	return dp.price
+}
+
+func (dp *DealProposal) Provider() string {
+	return dp.provider
+}
+
+func (dp *DealProposal) Created() int64 {
+	return dp.created
+}
+
+func (dp *DealProposal) PK() []byte {
+	return dp.pubkey
+}
+
+func (dp *DealProposal) Signature() []byte {
+	return dp.sig
+}
+
+// Data returns the signed data, which is the canonical encoding of the proposal w/o signature
+func (dp *DealProposal) Data() ([]byte, error) {
+	rec := toDealProposalRecord(dp)
+	rec.Sig = nil
+	return signingInput(dealProposalDomain, EncodingVersion, rec)
+}
+
+// Deal is a proposal that was accepted and counter-signed by the storage node
+type Deal struct {
+	proposal *DealProposal
+	// start is the timestamp of acceptance
+	start int64
+	// pubkey is the marshaled public key of the storage node
+	pubkey []byte
+	// sig is the signature made with the private key of the storage node
+	sig []byte
+}
+
+// AcceptDeal creates a deal out of a valid proposal, the deal should be signed by the storage node
+func AcceptDeal(dp *DealProposal, pubkey libp2pcrypto.PubKey) (*Deal, error) {
+	if err := dp.Verify(); err != nil {
+		return nil, err
+	}
+	if err := dp.Validate(); err != nil {
+		return nil, err
+	}
+	pkraw, err := libp2pcrypto.MarshalPublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	d := Deal{dp, time.Now().Unix(), pkraw, []byte{}}
+
+	return &d, nil
+}
+
+func (d *Deal) Sign(priv libp2pcrypto.PrivKey) error {
+	sig, err := cipher.Sign(d, priv)
+	if err != nil {
+		return err
+	}
+	dcopy := *d
+	dcopy.sig = sig
+	if err = dcopy.Verify(); err != nil {
+		return err
+	}
+	d.sig = sig
+	return nil
+}
+
+// Verify checks both signatures, and that the deal was signed by the provider of the proposal
+func (d *Deal) Verify() error {
+	if err := d.proposal.Verify(); err != nil {
+		return err
+	}
+	pk, err := libp2pcrypto.UnmarshalPublicKey(d.pubkey)
+	if err != nil {
+		return err
+	}
+	provider, err := peer.Decode(d.proposal.provider)
+	if err != nil || !provider.MatchesPublicKey(pk) {
+		return DealNotValidErr
+	}
+	return cipher.Verify(d, pk)
+}
+
+// ID is the hash of the signed proposal
+func (d *Deal) ID() string {
+	return DealID(d.proposal)
+}
+
+// DealID returns the id of the deal that is made out of the given proposal
+func DealID(dp *DealProposal) string {
+	data, _ := dp.Data()
+	return hex.EncodeToString(cipher.Hash(append(data, dp.sig...)))
+}
+
+func (d *Deal) Proposal() *DealProposal {
+	return d.proposal
+}
+
+func (d *Deal) Start() int64 {
+	return d.start
+}
+
+// Expires returns the timestamp of the deal expiration
+func (d *Deal) Expires() int64 {
+	return d.start + d.proposal.duration
+}
+
+// Active checks whether the deal is not expired at the given time
+func (d *Deal) Active(t time.Time) bool {
+	return t.Unix() < d.Expires()
+}
+
+func (d *Deal) PK() []byte {
+	return d.pubkey
+}
+
+func (d *Deal) Signature() []byte {
+	return d.sig
+}
+
+// Data returns the signed data, which is the canonical encoding of the deal (including the signed proposal)
+func (d *Deal) Data() ([]byte, error) {
+	rec := dealRecord{*toDealProposalRecord(d.proposal), d.start, d.pubkey}
+	return signingInput(dealDomain, EncodingVersion, &rec)
+}
+
+func ParseDealProposal(raw []byte) (*DealProposal, error) {
+	var dpmsg dealProposalMsg
+	err := json.Unmarshal(raw, &dpmsg)
+	dp := fromDealProposalMsg(&dpmsg)
+	if err == nil {
+		if err := dp.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	return dp, err
+}
+
+func SerializeDealProposal(dp *DealProposal) ([]byte, error) {
+	if err := dp.Verify(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(toDealProposalMsg(dp))
+}
+
+func ParseDeal(raw []byte) (*Deal, error) {
+	var dmsg dealMsg
+	err := json.Unmarshal(raw, &dmsg)
+	d := fromDealMsg(&dmsg)
+	if err == nil {
+		if err := d.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	return d, err
+}
+
+func SerializeDeal(d *Deal) ([]byte, error) {
+	if err := d.Verify(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(ToDealMsg(d))
+}
+
+type dealProposalMsg struct {
+	Bucket   string
+	Cids     []string
+	Size     uint64
+	Duration int64
+	Price    uint64
+	Provider string
+	Created  int64
+	PK       []byte
+	Sig      []byte
+}
+
+type dealMsg struct {
+	ID       string
+	Proposal *dealProposalMsg
+	Start    int64
+	Expires  int64
+	PK       []byte
+	Sig      []byte
+}
+
+func toDealProposalMsg(dp *DealProposal) *dealProposalMsg {
+	return &dealProposalMsg{
+		dp.bucket,
+		dp.cids,
+		dp.size,
+		dp.duration,
+		dp.price,
+		dp.provider,
+		dp.created,
+		dp.pubkey,
+		dp.sig,
+	}
+}
+
+func fromDealProposalMsg(dpmsg *dealProposalMsg) *DealProposal {
+	return &DealProposal{
+		dpmsg.Bucket,
+		dpmsg.Cids,
+		dpmsg.Size,
+		dpmsg.Duration,
+		dpmsg.Price,
+		dpmsg.Provider,
+		dpmsg.Created,
+		dpmsg.PK,
+		dpmsg.Sig,
+	}
+}
+
+func ToDealMsg(d *Deal) *dealMsg {
+	return &dealMsg{
+		d.ID(),
+		toDealProposalMsg(d.proposal),
+		d.start,
+		d.Expires(),
+		d.pubkey,
+		d.sig,
+	}
+}
+
+func fromDealMsg(dmsg *dealMsg) *Deal {
+	dpmsg := dmsg.Proposal
+	if dpmsg == nil {
+		dpmsg = &dealProposalMsg{}
+	}
+	return &Deal{
+		fromDealProposalMsg(dpmsg),
+		dmsg.Start,
+		dmsg.PK,
+		dmsg.Sig,
+	}
+}
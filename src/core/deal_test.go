@@ -0,0 +1,57 @@
+package core
+
+import (
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeal(t *testing.T) {
+	clientPriv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	nodePriv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	nodeID, err := peer.IDFromPrivateKey(nodePriv)
+	assert.Nil(t, err)
+
+	dp, err := NewDealProposal("mybucket", nil, 1024, time.Hour, 10, nodeID, clientPriv.GetPublic())
+	assert.Nil(t, err)
+	assert.NotNil(t, dp.Verify())
+	assert.Nil(t, dp.Sign(clientPriv))
+	assert.Nil(t, dp.Validate())
+
+	raw, err := SerializeDealProposal(dp)
+	assert.Nil(t, err)
+	parsed, err := ParseDealProposal(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), parsed.Price())
+	assert.Equal(t, time.Hour, parsed.Duration())
+
+	tampered := strings.Replace(string(raw), `"Price":10`, `"Price":1`, 1)
+	_, err = ParseDealProposal([]byte(tampered))
+	assert.NotNil(t, err)
+
+	d, err := AcceptDeal(parsed, nodePriv.GetPublic())
+	assert.Nil(t, err)
+	assert.Nil(t, d.Sign(nodePriv))
+	assert.Equal(t, DealID(dp), d.ID())
+	assert.Equal(t, d.Start()+3600, d.Expires())
+	assert.True(t, d.Active(time.Now()))
+	assert.False(t, d.Active(time.Now().Add(2*time.Hour)))
+
+	raw, err = SerializeDeal(d)
+	assert.Nil(t, err)
+	parsedDeal, err := ParseDeal(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, d.ID(), parsedDeal.ID())
+
+	// only the provider of the proposal can accept it
+	other, err := AcceptDeal(parsed, clientPriv.GetPublic())
+	assert.Nil(t, err)
+	assert.NotNil(t, other.Sign(clientPriv))
+
+	invalid, err := NewDealProposal("", nil, 1024, time.Hour, 10, nodeID, clientPriv.GetPublic())
+	assert.Nil(t, err)
+	assert.Equal(t, DealNotValidErr, invalid.Validate())
+}
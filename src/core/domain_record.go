@@ -18,6 +18,8 @@ type DomainRegistry interface {
 // DomainRecord represent a single domain name
 // TODO: use actual domain names for integration with other platforms
 type DomainRecord struct {
+	// version of the encoding, see EncodingVersion
+	version uint64
 	// hash of the corresponding bucket
 	hash string
 	// domain
@@ -29,13 +31,14 @@ type DomainRecord struct {
 }
 
 func NewDomainRecord(hash string, domain string, pubkey []byte) *DomainRecord {
-	dr := DomainRecord{hash, domain, pubkey[:], []byte{}}
+	dr := DomainRecord{EncodingVersion, hash, domain, pubkey[:], []byte{}}
 
 	return &dr
 }
 
 func (b *DomainRecord) Sign(priv libp2pcrypto.PrivKey) error {
 	bcopy := *b
+	bcopy.version = EncodingVersion
 	bcopy.sig = []byte{}
 	sig, err := cipher.Sign(&bcopy, priv)
 	if err != nil {
@@ -45,6 +48,7 @@ func (b *DomainRecord) Sign(priv libp2pcrypto.PrivKey) error {
 	if err = bcopy.Verify(); err != nil {
 		return err
 	}
+	b.version = bcopy.version
 	b.sig = sig
 	return nil
 }
@@ -65,56 +69,75 @@ func (dr *DomainRecord) Hash() string {
 	return dr.hash
 }
 
+// Version returns the version of the encoding
+func (dr *DomainRecord) Version() uint64 {
+	return dr.version
+}
+
 func (dr *DomainRecord) Signature() []byte {
 	return dr.sig
 }
 
+// Data returns the signing input, which is the canonical encoding of the record without the signature
 func (dr *DomainRecord) Data() ([]byte, error) {
-	data := bytes.Join([][]byte{
-		[]byte(dr.hash),
-		[]byte(dr.domain),
-	}, []byte{})
-	return data, nil
+	if dr.version == LegacyEncoding {
+		data := bytes.Join([][]byte{
+			[]byte(dr.hash),
+			[]byte(dr.domain),
+		}, []byte{})
+		return data, nil
+	}
+	if err := checkVersion(dr.version); err != nil {
+		return nil, err
+	}
+	rec := toDomainRecordRecord(dr)
+	rec.Sig = nil
+	return signingInput(domainRecordDomain, dr.version, rec)
 }
 
+// ParseDomainRecord decodes and verifies the given raw record, legacy JSON records are supported
 func ParseDomainRecord(raw []byte) (*DomainRecord, error) {
-	var drmsg domainRecordMsg
-	err := json.Unmarshal(raw, &drmsg)
-	dr := fromDomainRecordMsg(&drmsg)
-	if err == nil {
-		if err := dr.Verify(); err != nil {
-			return nil, err
-		}
+	dr, err := decodeDomainRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := dr.Verify(); err != nil {
+		return nil, err
 	}
-	return dr, err
+	return dr, nil
 }
 
+// SerializeDomainRecord verifies the given record and returns its canonical encoding
 func SerializeDomainRecord(dr *DomainRecord) ([]byte, error) {
 	if err := dr.Verify(); err != nil {
 		return nil, err
 	}
-	drmsg := toDomainRecordMsg(dr)
-	return json.Marshal(drmsg)
+	return encodeDomainRecord(dr)
 }
 
-type domainRecordMsg struct {
-	Hash   string
-	Domain string
-	PK     []byte
-	Sig    []byte
+// decodeLegacyDomainRecord decodes the JSON form of records
+func decodeLegacyDomainRecord(raw []byte) (*DomainRecord, error) {
+	var drmsg domainRecordMsg
+	if err := json.Unmarshal(raw, &drmsg); err != nil {
+		return nil, err
+	}
+	if drmsg.Version > EncodingVersion {
+		return nil, UnsupportedEncodingErr
+	}
+	return fromDomainRecordMsg(&drmsg), nil
 }
 
-func toDomainRecordMsg(dr *DomainRecord) *domainRecordMsg {
-	return &domainRecordMsg{
-		dr.hash,
-		dr.domain,
-		dr.pubkey,
-		dr.sig,
-	}
+type domainRecordMsg struct {
+	Version uint64 `json:",omitempty"`
+	Hash    string
+	Domain  string
+	PK      []byte
+	Sig     []byte
 }
 
 func fromDomainRecordMsg(drmsg *domainRecordMsg) *DomainRecord {
 	return &DomainRecord{
+		drmsg.Version,
 		drmsg.Hash,
 		drmsg.Domain,
 		drmsg.PK,
@@ -0,0 +1,376 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/amirylm/cbn/src/cipher"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"strconv"
+	"time"
+)
+
+// Records (Bucket, DomainRecord and DataRef) are encoded as dag-cbor, following the schema below.
+// map keys are sorted canonically (RFC7049) and empty optional fields are omitted,
+// therefore each record has a single encoding.
+//
+//	type Bucket struct {
+//		v         Int
+//		name      String
+//		node      Bytes
+//		updated   Int
+//		salt      Bytes
+//		pk        Bytes
+//		alg       optional Int
+//		replicas  optional Int
+//		seq       optional Int
+//		rotations optional [KeyRotation]
+//		multisig  optional Multisig
+//		sigs      optional [PartialSignature]
+//		sig       optional Bytes
+//	}
+//
+//	type KeyRotation struct {
+//		hash    String
+//		seq     Int
+//		next    Bytes
+//		created Int
+//		sig     optional Bytes
+//	}
+//
+//	type Multisig struct {
+//		threshold Int
+//		keys      [Bytes]
+//	}
+//
+//	type PartialSignature struct {
+//		pk  Bytes
+//		sig Bytes
+//	}
+//
+//	type DomainRecord struct {
+//		v      Int
+//		hash   String
+//		domain String
+//		pk     Bytes
+//		sig    optional Bytes
+//	}
+//
+//	type DataRef struct {
+//		v        Int
+//		filename String
+//		size     Int
+//		type     String
+//		cid      Bytes
+//		src      String
+//	}
+//
+//	type DealProposal struct {
+//		bucket   String
+//		cids     [String]
+//		size     Int
+//		duration Int
+//		price    Int
+//		provider String
+//		created  Int
+//		pk       Bytes
+//		sig      optional Bytes
+//	}
+//
+//	type Deal struct {
+//		proposal DealProposal
+//		start    Int
+//		pk       Bytes
+//	}
+//
+//	type Receipt struct {
+//		provider String
+//		bytes    Int
+//		created  Int
+//		pk       Bytes
+//		sig      optional Bytes
+//	}
+//
+// deals and receipts are signed with the same (versioned) encoding, but exchanged as JSON.
+// the signing input of a record is its encoding without signatures, prefixed with a domain tag
+// (e.g. 'cbn/bucket/v1') and a zero byte, so a signature can't be used for another kind of record.
+//
+// records that were created before the encoding was versioned (version 0) are JSON,
+// they are still readable and verified with the legacy signing input. legacy records are kept
+// in their JSON form and migrated (to the current version) once they are signed again.
+// only records of existing buckets that were updated before LegacyCutoff are accepted in the legacy form,
+// new versions (and new records) must use the current encoding.
+const (
+	// LegacyEncoding is the version of (JSON) records that were created before the encoding was versioned
+	LegacyEncoding = 0
+	// EncodingVersion is the current version of the encoding
+	EncodingVersion = 1
+
+	bucketDomain       = "cbn/bucket"
+	domainRecordDomain = "cbn/domain-record"
+	dealProposalDomain = "cbn/deal-proposal"
+	dealDomain         = "cbn/deal"
+	keyRotationDomain  = "cbn/key-rotation"
+	receiptDomain      = "cbn/receipt"
+)
+
+var (
+	UnsupportedEncodingErr = errors.New("unsupported encoding version")
+
+	// LegacyCutoff is the (unix) time the encoding was versioned, legacy buckets that were updated later are rejected.
+	// nodes set it from their configuration (LEGACY_CUTOFF)
+	LegacyCutoff = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC).Unix()
+)
+
+func init() {
+	cbor.RegisterCborType(bucketRecord{})
+	cbor.RegisterCborType(keyRotationRecord{})
+	cbor.RegisterCborType(multisigRecord{})
+	cbor.RegisterCborType(partialSignatureRecord{})
+	cbor.RegisterCborType(domainRecordRecord{})
+	cbor.RegisterCborType(dataRefRecord{})
+	cbor.RegisterCborType(dealProposalRecord{})
+	cbor.RegisterCborType(dealRecord{})
+	cbor.RegisterCborType(receiptRecord{})
+}
+
+// isLegacy returns true if the given raw record is (legacy) JSON, dag-cbor records are maps and therefore never start with '{'
+func isLegacy(raw []byte) bool {
+	trimmed := bytes.TrimLeft(raw, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// checkVersion returns an error for versions that are unknown to this node
+func checkVersion(v uint64) error {
+	if v == LegacyEncoding || v > EncodingVersion {
+		return UnsupportedEncodingErr
+	}
+	return nil
+}
+
+// checkHashAlg returns an error for hash algorithms that are unknown to this node,
+// legacy records have only legacy hashes
+func checkHashAlg(v uint64, alg uint64) error {
+	if alg == 0 {
+		return nil
+	}
+	if v == LegacyEncoding || len(cipher.HashAlgName(alg)) == 0 {
+		return cipher.HashNotSupportedErr
+	}
+	return nil
+}
+
+// signingInput returns the domain separated input for signatures
+func signingInput(domain string, v uint64, rec interface{}) ([]byte, error) {
+	raw, err := cbor.DumpObject(rec)
+	if err != nil {
+		return nil, err
+	}
+	prefix := []byte(domain + "/v" + strconv.FormatUint(v, 10))
+	data := make([]byte, 0, len(prefix)+1+len(raw))
+	data = append(data, prefix...)
+	data = append(data, 0)
+	return append(data, raw...), nil
+}
+
+type bucketRecord struct {
+	V         uint64                   `refmt:"v"`
+	Name      string                   `refmt:"name"`
+	Node      []byte                   `refmt:"node"`
+	Updated   int64                    `refmt:"updated"`
+	Salt      []byte                   `refmt:"salt"`
+	PK        []byte                   `refmt:"pk"`
+	HashAlg   uint64                   `refmt:"alg,omitempty"`
+	Replicas  int                      `refmt:"replicas,omitempty"`
+	Seq       uint64                   `refmt:"seq,omitempty"`
+	Rotations []keyRotationRecord      `refmt:"rotations,omitempty"`
+	Multisig  *multisigRecord          `refmt:"multisig,omitempty"`
+	Sigs      []partialSignatureRecord `refmt:"sigs,omitempty"`
+	Sig       []byte                   `refmt:"sig,omitempty"`
+}
+
+type keyRotationRecord struct {
+	Hash    string `refmt:"hash"`
+	Seq     uint64 `refmt:"seq"`
+	Next    []byte `refmt:"next"`
+	Created int64  `refmt:"created"`
+	Sig     []byte `refmt:"sig,omitempty"`
+}
+
+type multisigRecord struct {
+	Threshold int      `refmt:"threshold"`
+	Keys      [][]byte `refmt:"keys"`
+}
+
+type partialSignatureRecord struct {
+	PK  []byte `refmt:"pk"`
+	Sig []byte `refmt:"sig"`
+}
+
+type domainRecordRecord struct {
+	V      uint64 `refmt:"v"`
+	Hash   string `refmt:"hash"`
+	Domain string `refmt:"domain"`
+	PK     []byte `refmt:"pk"`
+	Sig    []byte `refmt:"sig,omitempty"`
+}
+
+type dataRefRecord struct {
+	V        uint64 `refmt:"v"`
+	Filename string `refmt:"filename"`
+	Size     uint64 `refmt:"size"`
+	Type     string `refmt:"type"`
+	Cid      []byte `refmt:"cid"`
+	Src      string `refmt:"src"`
+}
+
+type dealProposalRecord struct {
+	Bucket   string   `refmt:"bucket"`
+	Cids     []string `refmt:"cids"`
+	Size     uint64   `refmt:"size"`
+	Duration int64    `refmt:"duration"`
+	Price    uint64   `refmt:"price"`
+	Provider string   `refmt:"provider"`
+	Created  int64    `refmt:"created"`
+	PK       []byte   `refmt:"pk"`
+	Sig      []byte   `refmt:"sig,omitempty"`
+}
+
+type dealRecord struct {
+	Proposal dealProposalRecord `refmt:"proposal"`
+	Start    int64              `refmt:"start"`
+	PK       []byte             `refmt:"pk"`
+}
+
+type receiptRecord struct {
+	Provider string `refmt:"provider"`
+	Bytes    uint64 `refmt:"bytes"`
+	Created  int64  `refmt:"created"`
+	PK       []byte `refmt:"pk"`
+	Sig      []byte `refmt:"sig,omitempty"`
+}
+
+func toDealProposalRecord(dp *DealProposal) *dealProposalRecord {
+	cids := dp.cids
+	if cids == nil {
+		cids = []string{}
+	}
+	return &dealProposalRecord{dp.bucket, cids, dp.size, dp.duration, dp.price, dp.provider, dp.created, dp.pubkey, dp.sig}
+}
+
+func toBucketRecord(b *Bucket) *bucketRecord {
+	rec := bucketRecord{
+		V:        b.version,
+		Name:     b.name,
+		Node:     b.node,
+		Updated:  b.updated,
+		Salt:     b.salt,
+		PK:       b.pubkey,
+		HashAlg:  b.hashAlg,
+		Replicas: b.replicas,
+		Seq:      b.seq,
+		Sig:      b.sig,
+	}
+	for _, kr := range b.rotations {
+		rec.Rotations = append(rec.Rotations, keyRotationRecord{kr.hash, kr.seq, kr.next, kr.created, kr.sig})
+	}
+	if b.multisig != nil {
+		rec.Multisig = &multisigRecord{b.multisig.Threshold, b.multisig.Keys}
+	}
+	for _, ps := range b.sigs {
+		rec.Sigs = append(rec.Sigs, partialSignatureRecord{ps.PK, ps.Sig})
+	}
+	return &rec
+}
+
+func fromBucketRecord(rec *bucketRecord) *Bucket {
+	b := Bucket{
+		version:   rec.V,
+		name:      rec.Name,
+		node:      rec.Node,
+		updated:   rec.Updated,
+		salt:      rec.Salt,
+		pubkey:    rec.PK,
+		hashAlg:   rec.HashAlg,
+		replicas:  rec.Replicas,
+		seq:       rec.Seq,
+		rotations: []*KeyRotation{},
+		sig:       rec.Sig,
+	}
+	for _, kr := range rec.Rotations {
+		b.rotations = append(b.rotations, &KeyRotation{kr.Hash, kr.Seq, kr.Next, kr.Created, kr.Sig})
+	}
+	if rec.Multisig != nil {
+		b.multisig = &cipher.MultisigOwner{Threshold: rec.Multisig.Threshold, Keys: rec.Multisig.Keys}
+	}
+	for _, ps := range rec.Sigs {
+		b.sigs = append(b.sigs, cipher.PartialSignature{PK: ps.PK, Sig: ps.Sig})
+	}
+	if b.sig == nil {
+		b.sig = []byte{}
+	}
+	return &b
+}
+
+// encodeBucket returns the canonical encoding of the given bucket, legacy buckets are kept as JSON
+func encodeBucket(b *Bucket) ([]byte, error) {
+	if b.version == LegacyEncoding {
+		return json.Marshal(ToBucketMsg(b))
+	}
+	if err := checkVersion(b.version); err != nil {
+		return nil, err
+	}
+	return cbor.DumpObject(toBucketRecord(b))
+}
+
+// decodeBucket decodes the given raw bucket, legacy JSON buckets are supported
+func decodeBucket(raw []byte) (*Bucket, error) {
+	if isLegacy(raw) {
+		return decodeLegacyBucket(raw)
+	}
+	var rec bucketRecord
+	if err := cbor.DecodeInto(raw, &rec); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(rec.V); err != nil {
+		return nil, err
+	}
+	if err := checkHashAlg(rec.V, rec.HashAlg); err != nil {
+		return nil, err
+	}
+	return fromBucketRecord(&rec), nil
+}
+
+func toDomainRecordRecord(dr *DomainRecord) *domainRecordRecord {
+	return &domainRecordRecord{dr.version, dr.hash, dr.domain, dr.pubkey, dr.sig}
+}
+
+// encodeDomainRecord returns the canonical encoding of the given record, legacy records are kept as JSON
+func encodeDomainRecord(dr *DomainRecord) ([]byte, error) {
+	if dr.version == LegacyEncoding {
+		return json.Marshal(&domainRecordMsg{Hash: dr.hash, Domain: dr.domain, PK: dr.pubkey, Sig: dr.sig})
+	}
+	if err := checkVersion(dr.version); err != nil {
+		return nil, err
+	}
+	return cbor.DumpObject(toDomainRecordRecord(dr))
+}
+
+// decodeDomainRecord decodes the given raw record, legacy JSON records are supported
+func decodeDomainRecord(raw []byte) (*DomainRecord, error) {
+	if isLegacy(raw) {
+		return decodeLegacyDomainRecord(raw)
+	}
+	var rec domainRecordRecord
+	if err := cbor.DecodeInto(raw, &rec); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(rec.V); err != nil {
+		return nil, err
+	}
+	dr := DomainRecord{rec.V, rec.Hash, rec.Domain, rec.PK, rec.Sig}
+	if dr.sig == nil {
+		dr.sig = []byte{}
+	}
+	return &dr, nil
+}
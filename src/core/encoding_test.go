@@ -0,0 +1,164 @@
+package core
+
+import (
+	"encoding/json"
+	"github.com/amirylm/cbn/src/cipher"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBucketEncoding(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+	assert.Nil(t, err)
+	assert.Nil(t, bucket.Sign(priv))
+	assert.Equal(t, uint64(EncodingVersion), bucket.Version())
+
+	raw, err := SerializeBucket(bucket)
+	assert.Nil(t, err)
+	assert.False(t, isLegacy(raw))
+	parsed, err := ParseBucket(BucketHashPK("mybucket", priv.GetPublic(), BucketHashAlg), raw)
+	assert.Nil(t, err)
+	// the encoding is canonical
+	raw2, err := SerializeBucket(parsed)
+	assert.Nil(t, err)
+	assert.Equal(t, raw, raw2)
+
+	// the JSON form is parsed as well
+	jsonRaw, err := json.Marshal(ToBucketMsg(bucket))
+	assert.Nil(t, err)
+	parsed, err = ParseBucket("", jsonRaw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(EncodingVersion), parsed.Version())
+
+	// fields are length prefixed, moving bytes between fields invalidates the signature
+	shifted := *bucket
+	shifted.name = bucket.name + string(bucket.node[:1])
+	shifted.node = bucket.node[1:]
+	assert.NotNil(t, shifted.Verify())
+
+	// the signing input is domain separated
+	data, err := bucket.Data()
+	assert.Nil(t, err)
+	assert.Equal(t, "cbn/bucket/v1\x00", string(data[:len(bucketDomain)+4]))
+
+	// unknown versions are rejected
+	unknown := *bucket
+	unknown.version = EncodingVersion + 1
+	_, err = encodeBucket(&unknown)
+	assert.Equal(t, UnsupportedEncodingErr, err)
+}
+
+func TestLegacyBucket(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+	assert.Nil(t, err)
+	// sign the way buckets were signed before the encoding was versioned
+	bucket.version = LegacyEncoding
+	bucket.hashAlg = 0
+	bucket.updated = LegacyCutoff - 1
+	legacySign := func(b *Bucket) []byte {
+		sig, err := cipher.Sign(b, priv)
+		assert.Nil(t, err)
+		b.sig = sig
+		raw, err := json.Marshal(ToBucketMsg(b))
+		assert.Nil(t, err)
+		return raw
+	}
+	legacy := legacySign(bucket)
+	assert.NotContains(t, string(legacy), "Version")
+
+	// legacy records are accepted only before the cutoff, with the fields of legacy buckets
+	later := *bucket
+	later.updated = LegacyCutoff + 1
+	_, err = ParseBucket("", legacySign(&later))
+	assert.Equal(t, UnsupportedEncodingErr, err)
+	withSeq := *bucket
+	withSeq.seq = 1
+	_, err = ParseBucket("", legacySign(&withSeq))
+	assert.Equal(t, UnsupportedEncodingErr, err)
+
+	parsed, err := ParseBucket(BucketHashPK("mybucket", priv.GetPublic(), 0), legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(LegacyEncoding), parsed.Version())
+	// legacy buckets are kept as they are until signed again
+	raw, err := SerializeBucket(parsed)
+	assert.Nil(t, err)
+	assert.Equal(t, legacy, raw)
+
+	// signing again migrates the bucket
+	assert.Nil(t, parsed.Sign(priv))
+	assert.Equal(t, uint64(EncodingVersion), parsed.Version())
+	assert.Equal(t, uint64(1), parsed.Seq())
+	raw, err = SerializeBucket(parsed)
+	assert.Nil(t, err)
+	assert.False(t, isLegacy(raw))
+	migrated, err := ParseBucket("", raw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(EncodingVersion), migrated.Version())
+}
+
+func TestDomainRecordEncoding(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	pkraw, _ := crypto.MarshalPublicKey(priv.GetPublic())
+	rec := NewDomainRecord("hash", "mydomain", pkraw)
+	assert.Nil(t, rec.Sign(priv))
+
+	raw, err := SerializeDomainRecord(rec)
+	assert.Nil(t, err)
+	parsed, err := ParseDomainRecord(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, "mydomain", parsed.Domain())
+	assert.Equal(t, uint64(EncodingVersion), parsed.Version())
+
+	// the signature of a record can't be used for a bucket with the same content
+	bucketData, err := signingInput(bucketDomain, EncodingVersion, toDomainRecordRecord(rec))
+	assert.Nil(t, err)
+	recData, err := rec.Data()
+	assert.Nil(t, err)
+	assert.NotEqual(t, bucketData, recData)
+
+	// legacy JSON records are still readable
+	legacy := NewDomainRecord("hash", "legacy", pkraw)
+	legacy.version = LegacyEncoding
+	sig, err := cipher.Sign(legacy, priv)
+	assert.Nil(t, err)
+	legacyRaw, err := json.Marshal(&domainRecordMsg{Hash: "hash", Domain: "legacy", PK: pkraw, Sig: sig})
+	assert.Nil(t, err)
+	parsed, err = ParseDomainRecord(legacyRaw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(LegacyEncoding), parsed.Version())
+	assert.Equal(t, "legacy", parsed.Domain())
+}
+
+func TestDataRefEncoding(t *testing.T) {
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("data"))
+	assert.Nil(t, err)
+	dr := NewDataRef(c, "src", *NewFileHeader("file.txt", "text/plain"))
+
+	raw, err := MarshalDataRef(dr)
+	assert.Nil(t, err)
+	assert.False(t, isLegacy(raw))
+	parsed, err := UnmarshalDataRef(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, dr, parsed)
+
+	legacy, err := json.Marshal(dr)
+	assert.Nil(t, err)
+	parsed, err = UnmarshalDataRef(legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, dr, parsed)
+	assert.True(t, c.Equals(parsed.NodeCid()))
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"encoding/json"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"sync"
+)
+
+var (
+	// BucketEventsBufferSize is the size of each subscription channel,
+	// events are dropped for subscribers that are not keeping up
+	BucketEventsBufferSize = 64
+)
+
+// BucketEventType describes the change that was made to a bucket
+type BucketEventType string
+
+const (
+	BucketCreated BucketEventType = "created"
+	BucketUpdated BucketEventType = "updated"
+	BucketRemoved BucketEventType = "removed"
+)
+
+// BucketEvent is emitted by the registry whenever a bucket is changed,
+// either locally or by a remote peer (crdt sync)
+type BucketEvent struct {
+	Type BucketEventType
+	// Hash of the changed bucket
+	Hash string
+	// Owner is the marshaled public key of the bucket owner, might be empty for removed buckets
+	Owner []byte
+	// Bucket is the new version of the bucket, nil for removed buckets
+	Bucket *Bucket
+}
+
+// BucketEventFilter is used to select the events of a subscription
+type BucketEventFilter = func(*BucketEvent) bool
+
+// BucketHashFilter accepts events of the given bucket hashes
+func BucketHashFilter(hashes ...string) BucketEventFilter {
+	set := map[string]bool{}
+	for _, h := range hashes {
+		set[h] = true
+	}
+	return func(evt *BucketEvent) bool {
+		return set[evt.Hash]
+	}
+}
+
+// BucketOwnerFilter accepts events of buckets that are owned by the given peer
+func BucketOwnerFilter(owner peer.ID) BucketEventFilter {
+	return func(evt *BucketEvent) bool {
+		if len(evt.Owner) == 0 {
+			return false
+		}
+		pk, err := libp2pcrypto.UnmarshalPublicKey(evt.Owner)
+		if err != nil {
+			return false
+		}
+		return owner.MatchesPublicKey(pk)
+	}
+}
+
+// NewBucketEventFilter creates a filter out of optional hashes and owner (encoded peer id),
+// empty values are not taken into account
+func NewBucketEventFilter(hashes []string, owner string) (BucketEventFilter, error) {
+	filters := []BucketEventFilter{}
+	if len(hashes) > 0 {
+		filters = append(filters, BucketHashFilter(hashes...))
+	}
+	if len(owner) > 0 {
+		pid, err := peer.Decode(owner)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, BucketOwnerFilter(pid))
+	}
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return func(evt *BucketEvent) bool {
+		for _, f := range filters {
+			if !f(evt) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// BucketFeed dispatches bucket events to subscribers
+type BucketFeed struct {
+	lock sync.RWMutex
+
+	subs   map[int64]*bucketSub
+	nextID int64
+}
+
+type bucketSub struct {
+	filter BucketEventFilter
+	ch     chan BucketEvent
+}
+
+func NewBucketFeed() *BucketFeed {
+	f := BucketFeed{subs: map[int64]*bucketSub{}}
+
+	return &f
+}
+
+// Subscribe returns a channel of events that passed the given filter (nil to accept all),
+// and a function that should be called to cancel the subscription
+func (f *BucketFeed) Subscribe(filter BucketEventFilter) (<-chan BucketEvent, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	id := f.nextID
+	f.nextID++
+	sub := bucketSub{filter, make(chan BucketEvent, BucketEventsBufferSize)}
+	f.subs[id] = &sub
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+
+			delete(f.subs, id)
+			close(sub.ch)
+		})
+	}
+}
+
+// Publish sends the given event to all matching subscribers, w/o blocking
+func (f *BucketFeed) Publish(evt BucketEvent) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for _, sub := range f.subs {
+		if sub.filter != nil && !sub.filter(&evt) {
+			continue
+		}
+		select {
+		case sub.ch <- evt:
+		default:
+		}
+	}
+}
+
+func SerializeBucketEvent(evt *BucketEvent) ([]byte, error) {
+	msg := bucketEventMsg{Type: evt.Type, Hash: evt.Hash, Owner: evt.Owner}
+	if evt.Bucket != nil {
+		// the JSON form is embedded, it is parsed (and verified) the same as the canonical encoding
+		if err := evt.Bucket.Verify(); err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(ToBucketMsg(evt.Bucket))
+		if err != nil {
+			return nil, err
+		}
+		msg.Bucket = raw
+	}
+	return json.Marshal(&msg)
+}
+
+func ParseBucketEvent(raw []byte) (*BucketEvent, error) {
+	var msg bucketEventMsg
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, err
+	}
+	evt := BucketEvent{Type: msg.Type, Hash: msg.Hash, Owner: msg.Owner}
+	if len(msg.Bucket) > 0 {
+		b, err := ParseBucket(msg.Hash, msg.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		evt.Bucket = b
+	}
+	return &evt, nil
+}
+
+type bucketEventMsg struct {
+	Type   BucketEventType
+	Hash   string
+	Owner  []byte
+	Bucket json.RawMessage `json:",omitempty"`
+}
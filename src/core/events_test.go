@@ -0,0 +1,54 @@
+package core
+
+import (
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBucketFeed(t *testing.T) {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cb, err := p2pstorage.NewCidBuilder("")
+	assert.Nil(t, err)
+	c, err := cb.Sum([]byte("mybucket"))
+	assert.Nil(t, err)
+	bucket, err := NewBucket("mybucket", priv.GetPublic(), c)
+	assert.Nil(t, err)
+	assert.Nil(t, bucket.Sign(priv))
+	hash := bucket.Hash()
+
+	feed := NewBucketFeed()
+	all, cancelAll := feed.Subscribe(nil)
+	defer cancelAll()
+	byHash, cancelByHash := feed.Subscribe(BucketHashFilter("other"))
+	defer cancelByHash()
+	owner, err := peer.IDFromPublicKey(priv.GetPublic())
+	assert.Nil(t, err)
+	byOwner, err := NewBucketEventFilter(nil, peer.Encode(owner))
+	assert.Nil(t, err)
+	ownerEvents, cancelByOwner := feed.Subscribe(byOwner)
+
+	feed.Publish(BucketEvent{BucketCreated, hash, bucket.PK(), bucket})
+
+	evt := <-all
+	assert.Equal(t, BucketCreated, evt.Type)
+	assert.Equal(t, hash, evt.Hash)
+	evt = <-ownerEvents
+	assert.Equal(t, hash, evt.Hash)
+	assert.Equal(t, 0, len(byHash))
+
+	cancelByOwner()
+	_, open := <-ownerEvents
+	assert.False(t, open)
+	// canceling twice should not panic
+	cancelByOwner()
+
+	raw, err := SerializeBucketEvent(&evt)
+	assert.Nil(t, err)
+	parsed, err := ParseBucketEvent(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, hash, parsed.Hash)
+	assert.Equal(t, bucket.Name(), parsed.Bucket.Name())
+}
@@ -21,6 +21,8 @@ type BucketRegistry interface {
 	Save(dr *Bucket) error
 	Load(hash string) (*Bucket, error)
 	ForEach(iterator BucketIterator) error
+	// Subscribe listens to changes of buckets, the returned function cancels the subscription
+	Subscribe(filter BucketEventFilter) (<-chan BucketEvent, func())
 }
 
 // BucketIterator is used to loop through buckets
@@ -49,16 +51,27 @@ type DataSource interface {
 //////
 
 // BucketReader reads buckets from the underlying storage
+// names are paths within the bucket, segments are separated with '/'
 type BucketReader interface {
 	GetChild(bucketCid cid.Cid, name string) (*DataRef, error)
-	GetNames(bucketCid cid.Cid) ([]string, error)
+	ForEachName(bucketCid cid.Cid, dirPath string, iterator NameIterator) error
+	Walk(bucketCid cid.Cid, walker BucketWalker) error
 }
 
+// NameIterator is used to loop through the names within a bucket directory
+type NameIterator = func(string) (bool, error)
+
+// BucketWalker is used to walk through all the files (recursively) of a bucket,
+// it accepts the full path and the data ref of each file
+type BucketWalker = func(string, *DataRef) (bool, error)
+
 // BucketWriter writes buckets to the underlying storage
+// names are paths within the bucket, intermediate directories are created as needed
 type BucketWriter interface {
 	NewBucket() (ipld.Node, error)
 	AddChild(bucketCid cid.Cid, name string, dr *DataRef) (ipld.Node, error)
 	RemoveChild(bucketCid cid.Cid, name string) (ipld.Node, error)
+	MoveChild(bucketCid cid.Cid, from, to string) (ipld.Node, error)
 }
 
 // BucketSource provides read/write functionality for buckets
@@ -68,3 +81,10 @@ type BucketSource interface {
 	BucketReader
 	BucketWriter
 }
+
+//////
+
+// DomainResolver resolves domains into bucket records
+type DomainResolver interface {
+	Resolve(domain string) (*DomainRecord, error)
+}
@@ -0,0 +1,227 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/amirylm/cbn/src/core"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	auditsPrefix = "/audits"
+)
+
+// AuditResult is the result of a single challenge
+type AuditResult struct {
+	Peer    string        `json:"peer"`
+	Cid     string        `json:"cid"`
+	Index   uint64        `json:"index"`
+	Passed  bool          `json:"passed"`
+	Error   string        `json:"error,omitempty"`
+	Deal    string        `json:"deal,omitempty"`
+	Time    int64         `json:"time"`
+	Latency time.Duration `json:"latency"`
+}
+
+// AuditKey is the local key of some audit result
+func AuditKey(holder string, t time.Time) ds.Key {
+	return ds.NewKey(fmt.Sprintf("%s/%s/%020d", auditsPrefix, holder, t.UnixNano()))
+}
+
+// Auditor challenges holders to prove that they still store data,
+// the storage nodes of the deals made by the local peer are audited periodically.
+// results are recorded in the local store
+type Auditor struct {
+	peer  *p2pstorage.MultiStorePeer
+	ctrl  *core.Controller
+	deals core.DealRegistry
+}
+
+func NewAuditor(ctrl *core.Controller, deals core.DealRegistry) *Auditor {
+	a := Auditor{peer: ctrl.Peer(), ctrl: ctrl, deals: deals}
+
+	return &a
+}
+
+// Start audits the deals periodically until the peer is closed
+func (a *Auditor) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.peer.Context().Done():
+			return
+		case <-ticker.C:
+			if err := a.AuditDeals(); err != nil {
+				log.Println("could not audit deals:", err)
+			}
+		}
+	}
+}
+
+// AuditDeals challenges the storage node of each active deal that was made by the local peer,
+// a random cid of the deal content is challenged
+func (a *Auditor) AuditDeals() error {
+	self := a.peer.Host().ID()
+	now := time.Now()
+	deals := []*core.Deal{}
+	err := a.deals.ForEach(func(id string, d *core.Deal) (bool, error) {
+		if !d.Active(now) {
+			return true, nil
+		}
+		pk, err := libp2pcrypto.UnmarshalPublicKey(d.Proposal().PK())
+		if err == nil && self.MatchesPublicKey(pk) {
+			deals = append(deals, d)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range deals {
+		holder, err := peer.Decode(d.Proposal().Provider())
+		if err != nil {
+			continue
+		}
+		cids, err := a.dealCids(d)
+		if err != nil || len(cids) == 0 {
+			log.Printf("could not get the content of deal %s: %v", d.ID(), err)
+			continue
+		}
+		i, err := randUint64()
+		if err != nil {
+			return err
+		}
+		res, err := a.audit(holder, cids[i%uint64(len(cids))], d.ID())
+		if err != nil {
+			log.Printf("could not audit deal %s: %s", d.ID(), err.Error())
+		} else if !res.Passed {
+			log.Printf("audit of deal %s failed: %s", d.ID(), res.Error)
+		}
+	}
+	return nil
+}
+
+// dealCids returns the cids of the given deal, including the data of the bucket
+func (a *Auditor) dealCids(d *core.Deal) ([]cid.Cid, error) {
+	cids := []cid.Cid{}
+	for _, s := range d.Proposal().Cids() {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		cids = append(cids, c)
+	}
+	if len(d.Proposal().Bucket()) == 0 {
+		return cids, nil
+	}
+	bucket, err := a.ctrl.BucketRegistry().Load(d.Proposal().Bucket())
+	if err != nil {
+		return nil, err
+	}
+	cids = append(cids, bucket.NodeCid())
+	err = a.ctrl.BucketSource().Walk(bucket.NodeCid(), func(p string, dr *core.DataRef) (bool, error) {
+		cids = append(cids, dr.NodeCid())
+		return true, nil
+	})
+	return cids, err
+}
+
+// Audit challenges the given holder with a random block of the given DAG and records the result
+func (a *Auditor) Audit(holder peer.ID, c cid.Cid) (*AuditResult, error) {
+	return a.audit(holder, c, "")
+}
+
+func (a *Auditor) audit(holder peer.ID, c cid.Cid, dealID string) (*AuditResult, error) {
+	index, err := randUint64()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, ChallengeNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ch := Challenge{Cid: c.String(), Index: index, Nonce: nonce}
+	start := time.Now()
+	res := AuditResult{Peer: holder.Pretty(), Cid: ch.Cid, Index: index, Deal: dealID, Time: start.Unix()}
+
+	proof, err := SendChallenge(a.peer, holder, &ch)
+	if err == nil {
+		err = VerifyProof(&ch, proof, a.getBlock)
+	}
+	res.Latency = time.Since(start)
+	res.Passed = err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	raw, err := json.Marshal(&res)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.peer.Store().Put(AuditKey(res.Peer, start), raw); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// getBlock loads the challenged block, from the local blockstore or from the network
+func (a *Auditor) getBlock(c cid.Cid) ([]byte, error) {
+	if b, err := a.peer.BlockService().Blockstore().Get(c); err == nil {
+		return b.RawData(), nil
+	}
+	ctx, cancel := context.WithTimeout(a.peer.Context(), ChallengeTimeout)
+	defer cancel()
+	b, err := a.peer.BlockService().GetBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return b.RawData(), nil
+}
+
+// Results returns the recorded audits of the given holder (all holders if empty), newest first
+func (a *Auditor) Results(holder string) ([]AuditResult, error) {
+	prefix := ds.NewKey(auditsPrefix)
+	if len(holder) > 0 {
+		prefix = prefix.ChildString(holder)
+	}
+	results, err := a.peer.Store().Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	res := []AuditResult{}
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var ar AuditResult
+		if err := json.Unmarshal(r.Value, &ar); err != nil {
+			return nil, err
+		}
+		res = append(res, ar)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time > res[j].Time
+	})
+	return res, nil
+}
+
+func randUint64() (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/amirylm/cbn/src/cipher"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/metrics"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"log"
+	"time"
+)
+
+const (
+	bucketIndexPrefix = "/bucket-index"
+	// bucketIndexVersion is the version of the index entries, the index is rebuilt once the version changes
+	bucketIndexVersion = "1"
+)
+
+// bucketIndexStateKey is the local key that marks a complete index, its value is the version of the index
+var bucketIndexStateKey = ds.NewKey("/bucket-index-state")
+
+// BucketIndexKey is the local key of the indexed metadata of a bucket
+func BucketIndexKey(hash string) ds.Key {
+	return ds.NewKey(bucketIndexPrefix).ChildString(hash)
+}
+
+// BucketIndexEntry is the metadata of the latest accepted version of a bucket, which is kept in a local index.
+// Digest is the digest of the (verified) raw record, so the record is not verified again after restarts
+type BucketIndexEntry struct {
+	Hash     string `json:"hash"`
+	Name     string `json:"name"`
+	Owner    []byte `json:"owner"`
+	Node     string `json:"node"`
+	Updated  int64  `json:"updated"`
+	Seq      uint64 `json:"seq"`
+	Replicas int    `json:"replicas"`
+	Digest   []byte `json:"digest"`
+}
+
+func newBucketIndexEntry(hash string, b *core.Bucket, raw []byte) *BucketIndexEntry {
+	e := BucketIndexEntry{
+		Hash:     hash,
+		Name:     b.Name(),
+		Owner:    b.PK(),
+		Node:     b.NodeCid().String(),
+		Updated:  b.Updated(),
+		Seq:      b.Seq(),
+		Replicas: b.Replicas(),
+		Digest:   cipher.Hash(raw),
+	}
+	return &e
+}
+
+// index saves the metadata of the given (verified and accepted) bucket
+func (br *P2PBucketRegistry) index(hash string, b *core.Bucket, raw []byte) error {
+	val, err := json.Marshal(newBucketIndexEntry(hash, b, raw))
+	if err != nil {
+		return err
+	}
+	return br.peer.Store().Put(BucketIndexKey(hash), val)
+}
+
+// unindex removes the metadata of a removed bucket
+func (br *P2PBucketRegistry) unindex(hash string) error {
+	err := br.peer.Store().Delete(BucketIndexKey(hash))
+	if err == ds.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// IndexEntry returns the indexed metadata of the given bucket
+func (br *P2PBucketRegistry) IndexEntry(hash string) (*BucketIndexEntry, error) {
+	val, err := br.peer.Store().Get(BucketIndexKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	var e BucketIndexEntry
+	if err = json.Unmarshal(val, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// indexed returns true if the given raw record is the indexed version of the bucket, and therefore was already verified
+func (br *P2PBucketRegistry) indexed(hash string, raw []byte) bool {
+	e, err := br.IndexEntry(hash)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(e.Digest, cipher.Hash(raw))
+}
+
+// ForEachIndexed loops through the indexed metadata of buckets, without reading (and parsing) the records
+func (br *P2PBucketRegistry) ForEachIndexed(iterator func(e *BucketIndexEntry) (bool, error)) error {
+	results, err := br.peer.Store().Query(query.Query{Prefix: bucketIndexPrefix})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for res := range results.Next() {
+		if res.Error != nil {
+			return res.Error
+		}
+		var e BucketIndexEntry
+		if err = json.Unmarshal(res.Value, &e); err != nil {
+			return err
+		}
+		cont, err := iterator(&e)
+		if err != nil {
+			return err
+		}
+		if !cont {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Reindex rebuilds the index out of the records in the crdt store, returns the amount of indexed buckets
+func (br *P2PBucketRegistry) Reindex() (int, error) {
+	start := time.Now()
+	stale := map[string]bool{}
+	err := br.ForEachIndexed(func(e *BucketIndexEntry) (bool, error) {
+		stale[e.Hash] = true
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = br.forEachRaw(func(hash string, b *core.Bucket, raw []byte) (bool, error) {
+		delete(stale, hash)
+		count++
+		return true, br.index(hash, b, raw)
+	})
+	if err != nil {
+		return count, err
+	}
+	for hash := range stale {
+		if err = br.unindex(hash); err != nil {
+			return count, err
+		}
+	}
+	if err = br.peer.Store().Put(bucketIndexStateKey, []byte(bucketIndexVersion)); err != nil {
+		return count, err
+	}
+	log.Printf("indexed %d buckets in %s", count, time.Since(start))
+	return count, nil
+}
+
+// loadIndex marks the indexed buckets as known, the index is rebuilt if it is missing or outdated
+func (br *P2PBucketRegistry) loadIndex() error {
+	state, err := br.peer.Store().Get(bucketIndexStateKey)
+	if err == ds.ErrNotFound || (err == nil && string(state) != bucketIndexVersion) {
+		if _, err = br.Reindex(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return br.ForEachIndexed(func(e *BucketIndexEntry) (bool, error) {
+		br.ownersLock.Lock()
+		defer br.ownersLock.Unlock()
+
+		br.owners[e.Hash] = e.Owner
+		metrics.BucketRegistrySize.Set(float64(len(br.owners)))
+		return true, nil
+	})
+}
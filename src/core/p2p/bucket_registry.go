@@ -1,25 +1,42 @@
 package p2p
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/amirylm/cbn/src/cipher"
 	"github.com/amirylm/cbn/src/commons"
 	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/metrics"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	crdt "github.com/ipfs/go-ds-crdt"
 	"log"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 )
 
 var (
 	BucketsCacheSize = 128
+	// VerifiedCacheSize is the amount of records that are known to be verified, which are parsed w/o checking signatures
+	VerifiedCacheSize = 4096
+	// VerifyBatchSize is the amount of buckets that are parsed (and verified) in parallel while iterating buckets
+	VerifyBatchSize = 64
+	// VerifyWorkers is the amount of goroutines that verify a batch of buckets
+	VerifyWorkers = runtime.NumCPU()
 )
 
 const (
-	bucketPrefix       = "/bucket"
-	crdtPSBucketsTopic = "crdt_buckets"
-	crdtBuckets        = "buckets"
+	bucketPrefix          = "/bucket"
+	bucketVersionsPrefix  = "/bucket-versions"
+	bucketRotationsPrefix = "/bucket-rotations"
+	bucketHeadsPrefix     = "/bucket-heads"
+	crdtPSBucketsTopic    = "crdt_buckets"
+	crdtBuckets           = "buckets"
 )
 
 func BucketKey(hash string) ds.Key {
@@ -30,24 +47,60 @@ func BucketKeyToHash(key string) string {
 	return strings.Replace(key, bucketPrefix+"/", "", 1)
 }
 
+// BucketVersionKey is the local key of some version (sequence) of a bucket
+func BucketVersionKey(hash string, seq uint64) ds.Key {
+	return ds.NewKey(fmt.Sprintf("%s/%s/%020d", bucketVersionsPrefix, hash, seq))
+}
+
+// BucketRotationsKey is the local key of the known chain of key rotations of a bucket
+func BucketRotationsKey(hash string) ds.Key {
+	return ds.NewKey(bucketRotationsPrefix).ChildString(hash)
+}
+
+// BucketHeadKey is the local key of the latest accepted version of a bucket
+func BucketHeadKey(hash string) ds.Key {
+	return ds.NewKey(bucketHeadsPrefix).ChildString(hash)
+}
+
 // P2PBucketRegistry
 type P2PBucketRegistry struct {
 	peer *p2pstorage.MultiStorePeer
 
 	cache *lru.Cache
+	// verified holds the (hash, digest) pairs of records that were verified
+	verified *lru.Cache
+
+	feed *core.BucketFeed
+	// owners holds the owner (pubkey) of known buckets, used to distinguish new buckets
+	// and to provide owner of removed buckets
+	owners     map[string][]byte
+	ownersLock sync.RWMutex
+	// rotations holds the longest known (and verified) chain of key rotations of buckets,
+	// buckets that don't extend the known chain were signed by a superseded key
+	rotations     map[string][]*core.KeyRotation
+	rotationsLock sync.Mutex
+	// headsLock protects the latest accepted versions (heads) of buckets, which are used to reject replays
+	headsLock sync.Mutex
 }
 
 func NewP2PBucketRegistry(peer *p2pstorage.MultiStorePeer) *P2PBucketRegistry {
 	c, _ := lru.New(BucketsCacheSize)
+	verified, _ := lru.New(VerifiedCacheSize)
+	bs := P2PBucketRegistry{peer: peer, cache: c, verified: verified, feed: core.NewBucketFeed(), owners: map[string][]byte{}, rotations: map[string][]*core.KeyRotation{}}
+
 	opts := crdt.DefaultOptions()
 	opts.MaxBatchDeltaSize = 10 * 1024 * 1024 // TODO: 10MB might be too much
+	opts.PutHook = bs.onPut
+	opts.DeleteHook = bs.onDelete
 	bucketsCrdt, err := p2pstorage.ConfigureCrdt(peer, crdtPSBucketsTopic, opts)
 	if err != nil {
 		log.Panic("could not create crdt store")
 	}
 	peer.UseCrdt(crdtBuckets, bucketsCrdt)
 
-	bs := P2PBucketRegistry{peer, c}
+	if err := bs.loadIndex(); err != nil {
+		log.Println("could not load existing buckets:", err)
+	}
 
 	return &bs
 }
@@ -56,8 +109,16 @@ func (br *P2PBucketRegistry) ID() string {
 	return P2PSource
 }
 
-// ForEach loops through all available buckets
+// ForEach loops through all available buckets,
+// buckets are read in batches that are parsed (and verified) in parallel
 func (br *P2PBucketRegistry) ForEach(iterator core.BucketIterator) error {
+	return br.forEachRaw(func(hash string, b *core.Bucket, raw []byte) (bool, error) {
+		return iterator(hash, b)
+	})
+}
+
+// forEachRaw loops through all available buckets along with their raw records
+func (br *P2PBucketRegistry) forEachRaw(iterator func(hash string, b *core.Bucket, raw []byte) (bool, error)) error {
 	q := query.Query{
 		Prefix:   bucketPrefix,
 		KeysOnly: false,
@@ -67,29 +128,328 @@ func (br *P2PBucketRegistry) ForEach(iterator core.BucketIterator) error {
 	if err != nil {
 		return err
 	}
-	for entry := range results.Next() {
-		hash := BucketKeyToHash(entry.Key)
-		b, err := core.ParseBucket(hash, entry.Value)
+	entries := results.Next()
+	for {
+		batch := []query.Entry{}
+		for entry := range entries {
+			batch = append(batch, entry.Entry)
+			if len(batch) >= VerifyBatchSize {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		buckets, err := br.parseBatch(batch)
 		if err != nil {
 			return err
 		}
-		cont, err := iterator(hash, b)
+		for i, b := range buckets {
+			hash := BucketKeyToHash(batch[i].Key)
+			if err = br.checkRotations(hash, b); err == core.SupersededKeyErr {
+				continue
+			} else if err != nil {
+				return err
+			}
+			cont, err := iterator(hash, b, batch[i].Value)
+			if err != nil {
+				return err
+			}
+			if !cont {
+				return nil
+			}
+		}
+	}
+}
+
+// parseBatch parses the given entries with VerifyWorkers goroutines, the buckets are returned in the same order
+func (br *P2PBucketRegistry) parseBatch(batch []query.Entry) ([]*core.Bucket, error) {
+	buckets := make([]*core.Bucket, len(batch))
+	errs := make([]error, len(batch))
+	indices := make(chan int, len(batch))
+	for i := range batch {
+		indices <- i
+	}
+	close(indices)
+	var wg sync.WaitGroup
+	for w := 0; w < VerifyWorkers && w < len(batch); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				buckets[i], errs[i] = br.parse(BucketKeyToHash(batch[i].Key), batch[i].Value)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
 		if err != nil {
+			return nil, err
+		}
+	}
+	return buckets, nil
+}
+
+// parse parses the given raw bucket, signatures are verified only once for each record.
+// indexed records were verified before, also by previous runs of the node
+func (br *P2PBucketRegistry) parse(hash string, raw []byte) (*core.Bucket, error) {
+	b, err := core.DecodeBucket(hash, raw)
+	if err != nil {
+		return nil, err
+	}
+	k := verifiedKey(hash, raw)
+	if br.verified.Contains(k) || br.indexed(hash, raw) {
+		br.verified.Add(k, struct{}{})
+		metrics.BucketVerifications.WithLabelValues("cached").Inc()
+		return b, nil
+	}
+	metrics.BucketVerifications.WithLabelValues("verified").Inc()
+	if err = b.Verify(); err != nil {
+		return nil, err
+	}
+	br.verified.Add(k, struct{}{})
+	return b, nil
+}
+
+// verifiedKey returns the key of a record in the cache of verified records, composed of the hash and the digest of the record
+func verifiedKey(hash string, raw []byte) string {
+	return hash + "/" + string(cipher.Hash(raw))
+}
+
+// Subscribe listens to changes of buckets
+func (br *P2PBucketRegistry) Subscribe(filter core.BucketEventFilter) (<-chan core.BucketEvent, func()) {
+	return br.feed.Subscribe(filter)
+}
+
+// onPut is triggered by the crdt store once a bucket was added (locally or by a remote peer)
+func (br *P2PBucketRegistry) onPut(k ds.Key, v []byte) {
+	if !strings.HasPrefix(k.String(), bucketPrefix) {
+		return
+	}
+	metrics.CrdtMerges.WithLabelValues(crdtBuckets).Inc()
+	hash := BucketKeyToHash(k.String())
+	b, err := br.parse(hash, v)
+	if err != nil {
+		log.Printf("could not parse bucket %s: %s", hash, err.Error())
+		return
+	}
+	if err = br.checkRotations(hash, b); err != nil {
+		br.cache.Remove(ds.NewKey(hash))
+		log.Printf("rejected bucket %s: %s", hash, err.Error())
+		return
+	}
+	if err = br.checkSeq(hash, b, v, true); err == core.SeqConflictErr {
+		log.Printf("rejected old version of bucket %s (seq %d)", hash, b.Seq())
+		br.restoreHead(hash)
+		return
+	} else if err != nil {
+		log.Printf("could not check sequence of bucket %s: %s", hash, err.Error())
+	}
+	// remote updates must replace stale cached values
+	br.cache.Add(ds.NewKey(hash), v)
+
+	br.ownersLock.Lock()
+	_, known := br.owners[hash]
+	br.owners[hash] = b.PK()
+	metrics.BucketRegistrySize.Set(float64(len(br.owners)))
+	br.ownersLock.Unlock()
+
+	if err := br.peer.Store().Put(BucketVersionKey(hash, b.Seq()), []byte(b.NodeCid().String())); err != nil {
+		log.Printf("could not save version of bucket %s: %s", hash, err.Error())
+	}
+	if err := br.index(hash, b, v); err != nil {
+		log.Printf("could not index bucket %s: %s", hash, err.Error())
+	}
+
+	evtType := core.BucketUpdated
+	if !known {
+		evtType = core.BucketCreated
+	}
+	br.feed.Publish(core.BucketEvent{Type: evtType, Hash: hash, Owner: b.PK(), Bucket: b})
+}
+
+// onDelete is triggered by the crdt store once a bucket was tombstoned
+func (br *P2PBucketRegistry) onDelete(k ds.Key) {
+	if !strings.HasPrefix(k.String(), bucketPrefix) {
+		return
+	}
+	hash := BucketKeyToHash(k.String())
+	br.cache.Remove(ds.NewKey(hash))
+	// the hook is called within the crdt store,
+	// therefore checking whether the bucket was re-added is done asynchronously
+	go func() {
+		if has, err := br.peer.Crdt(crdtBuckets).Has(BucketKey(hash)); err != nil || has {
+			return
+		}
+		br.ownersLock.Lock()
+		owner := br.owners[hash]
+		delete(br.owners, hash)
+		metrics.BucketRegistrySize.Set(float64(len(br.owners)))
+		br.ownersLock.Unlock()
+
+		if err := br.unindex(hash); err != nil {
+			log.Printf("could not unindex bucket %s: %s", hash, err.Error())
+		}
+		br.feed.Publish(core.BucketEvent{Type: core.BucketRemoved, Hash: hash, Owner: owner})
+	}()
+}
+
+// Versions returns the node cids of the known versions of the given bucket, newest first.
+// versions are recorded locally once they are received
+func (br *P2PBucketRegistry) Versions(hash string) ([]cid.Cid, error) {
+	q := query.Query{
+		Prefix: ds.NewKey(bucketVersionsPrefix).ChildString(hash).String(),
+	}
+	results, err := br.peer.Store().Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key > entries[j].Key
+	})
+	versions := []cid.Cid{}
+	for _, e := range entries {
+		c, err := cid.Decode(string(e.Value))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, c)
+	}
+	return versions, nil
+}
+
+// PruneVersions removes the records of versions of the given bucket, except the newest ones
+func (br *P2PBucketRegistry) PruneVersions(hash string, keep int) error {
+	q := query.Query{
+		Prefix:   ds.NewKey(bucketVersionsPrefix).ChildString(hash).String(),
+		KeysOnly: true,
+	}
+	results, err := br.peer.Store().Query(q)
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key > entries[j].Key
+	})
+	for i := keep; i < len(entries); i++ {
+		if err := br.peer.Store().Delete(ds.NewKey(entries[i].Key)); err != nil {
 			return err
 		}
-		if !cont {
-			break
+	}
+	return nil
+}
+
+// checkRotations rejects buckets that don't extend the known chain of key rotations (signed by a superseded key),
+// a longer chain becomes the known chain
+func (br *P2PBucketRegistry) checkRotations(hash string, b *core.Bucket) error {
+	br.rotationsLock.Lock()
+	defer br.rotationsLock.Unlock()
+
+	known, ok := br.rotations[hash]
+	if !ok {
+		raw, err := br.peer.Store().Get(BucketRotationsKey(hash))
+		if err == ds.ErrNotFound {
+			known = []*core.KeyRotation{}
+		} else if err != nil {
+			return err
+		} else if known, err = core.ParseRotations(raw); err != nil {
+			return err
 		}
+		br.rotations[hash] = known
+	}
+	chain := b.Rotations()
+	if !core.ExtendsRotations(known, chain) {
+		return core.SupersededKeyErr
+	}
+	if len(chain) > len(known) {
+		raw, err := core.SerializeRotations(chain)
+		if err != nil {
+			return err
+		}
+		if err = br.peer.Store().Put(BucketRotationsKey(hash), raw); err != nil {
+			return err
+		}
+		br.rotations[hash] = chain
 	}
 	return nil
 }
 
+// head returns the latest accepted version of a bucket, or the current value if no version was accepted yet
+func (br *P2PBucketRegistry) head(hash string) (*core.Bucket, []byte, error) {
+	raw, err := br.peer.Store().Get(BucketHeadKey(hash))
+	if err == ds.ErrNotFound {
+		raw, err = br.peer.Crdt(crdtBuckets).Get(BucketKey(hash))
+	}
+	if err == ds.ErrNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	b, err := br.parse(hash, raw)
+	return b, raw, err
+}
+
+// checkSeq accepts only versions with a greater sequence than the head of the bucket (rejecting replays and rollbacks).
+// once merged is set (the crdt store merged the value), the head itself is accepted once again,
+// and concurrent versions with the same sequence are ordered by their raw value, so peers agree on the head
+func (br *P2PBucketRegistry) checkSeq(hash string, b *core.Bucket, raw []byte, merged bool) error {
+	br.headsLock.Lock()
+	defer br.headsLock.Unlock()
+
+	head, headRaw, err := br.head(hash)
+	if err != nil {
+		return err
+	}
+	if head != nil {
+		switch {
+		case b.Seq() > head.Seq():
+		case merged && b.Seq() == head.Seq() && bytes.Compare(raw, headRaw) >= 0:
+			if bytes.Equal(raw, headRaw) {
+				return nil
+			}
+		default:
+			return core.SeqConflictErr
+		}
+	}
+	return br.peer.Store().Put(BucketHeadKey(hash), raw)
+}
+
+// restoreHead puts the head of the bucket once an older version was merged into the crdt store.
+// the put is done asynchronously as it is triggered within the crdt store
+func (br *P2PBucketRegistry) restoreHead(hash string) {
+	br.headsLock.Lock()
+	raw, err := br.peer.Store().Get(BucketHeadKey(hash))
+	br.headsLock.Unlock()
+	if err != nil {
+		log.Printf("could not restore bucket %s: %s", hash, err.Error())
+		return
+	}
+	br.cache.Add(ds.NewKey(hash), raw)
+	go func() {
+		metrics.CrdtPuts.WithLabelValues(crdtBuckets).Inc()
+		if err := br.peer.Crdt(crdtBuckets).Put(BucketKey(hash), raw); err != nil {
+			log.Printf("could not restore bucket %s: %s", hash, err.Error())
+		}
+	}()
+}
+
 // get loads a raw value from the crdt store
 func (br *P2PBucketRegistry) get(hash string) ([]byte, error) {
-	if br.cache.Contains(ds.NewKey(hash)) {
-		raw, _ := br.cache.Get(ds.NewKey(hash))
+	if raw, ok := br.cache.Get(ds.NewKey(hash)); ok {
+		metrics.BucketCache.WithLabelValues("hit").Inc()
 		return raw.([]byte), nil
 	}
+	metrics.BucketCache.WithLabelValues("miss").Inc()
 	raw, err := br.peer.Crdt(crdtBuckets).Get(BucketKey(hash))
 	if err == nil {
 		br.cache.Add(ds.NewKey(hash), raw)
@@ -107,15 +467,29 @@ func (br *P2PBucketRegistry) Has(hash string) (bool, error) {
 
 // Save persists the bucket from the crdt store
 func (br *P2PBucketRegistry) Save(dr *core.Bucket) error {
-	if err := dr.Verify(); err != nil {
-		return err
-	}
+	// the bucket is verified while serialized
 	raw, err := core.SerializeBucket(dr)
 	if err != nil {
 		return err
 	}
-	h := core.BucketHash(dr.Name(), dr.PK())
+	// legacy records are only read (as the existing versions), new versions must use the current encoding
+	if dr.Version() == core.LegacyEncoding {
+		return core.UnsupportedEncodingErr
+	}
+	return br.saveRaw(dr.Hash(), dr, raw)
+}
+
+// saveRaw saves the given (verified) raw record of the bucket, as long as it is newer than the known version
+func (br *P2PBucketRegistry) saveRaw(h string, dr *core.Bucket, raw []byte) error {
+	br.verified.Add(verifiedKey(h, raw), struct{}{})
+	if err := br.checkRotations(h, dr); err != nil {
+		return err
+	}
+	if err := br.checkSeq(h, dr, raw, false); err != nil {
+		return err
+	}
 	br.cache.Add(ds.NewKey(h), raw)
+	metrics.CrdtPuts.WithLabelValues(crdtBuckets).Inc()
 	return br.peer.Crdt(crdtBuckets).Put(BucketKey(h), raw)
 }
 
@@ -130,6 +504,12 @@ func (br *P2PBucketRegistry) Load(hash string) (*core.Bucket, error) {
 	if err != nil {
 		return nil, err
 	}
-	b, err := core.ParseBucket(hash, raw)
-	return b, err
+	b, err := br.parse(hash, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err = br.checkRotations(hash, b); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"errors"
+	"github.com/amirylm/cbn/src/car"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/multiformats/go-multihash"
+	"io"
+	"time"
+)
+
+// SnapshotVersion is the version of registry snapshots
+const SnapshotVersion = 1
+
+var (
+	SnapshotNotValidErr = errors.New("car does not contain a valid registry snapshot")
+)
+
+func init() {
+	cbor.RegisterCborType(snapshotManifest{})
+}
+
+// snapshotManifest is the root (dag-cbor) block of a registry snapshot
+type snapshotManifest struct {
+	V       uint64 `refmt:"v"`
+	Created int64  `refmt:"created"`
+}
+
+// RestoreReport describes the result of restoring a snapshot
+type RestoreReport struct {
+	// Restored is the amount of buckets that were saved in the registry
+	Restored int `json:"restored"`
+	// Skipped is the amount of buckets that the registry already has (in the same or a newer version)
+	Skipped int `json:"skipped"`
+}
+
+// Snapshot writes the records of all buckets as a CAR file.
+// the root is a manifest block, followed by a raw block for each (signed) record
+func (br *P2PBucketRegistry) Snapshot(w io.Writer) (int, error) {
+	manifest, err := cbor.DumpObject(&snapshotManifest{SnapshotVersion, time.Now().Unix()})
+	if err != nil {
+		return 0, err
+	}
+	manifestCid, err := cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}.Sum(manifest)
+	if err != nil {
+		return 0, err
+	}
+	cw, err := car.NewWriter(w, []cid.Cid{manifestCid})
+	if err != nil {
+		return 0, err
+	}
+	if err = cw.WriteBlock(manifestCid, manifest); err != nil {
+		return 0, err
+	}
+	count := 0
+	err = br.forEachRaw(func(hash string, b *core.Bucket, raw []byte) (bool, error) {
+		c, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}.Sum(raw)
+		if err != nil {
+			return false, err
+		}
+		count++
+		return true, cw.WriteBlock(c, raw)
+	})
+	return count, err
+}
+
+// Restore reads a snapshot that was created with Snapshot, every record must be validly signed.
+// records are restored as they are (including legacy records), records that are older than the known versions of buckets are skipped
+func (br *P2PBucketRegistry) Restore(r io.Reader) (*RestoreReport, error) {
+	cr, err := car.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(cr.Header.Roots) != 1 {
+		return nil, SnapshotNotValidErr
+	}
+	blk, err := cr.Next()
+	if err == io.EOF || (err == nil && !blk.Cid().Equals(cr.Header.Roots[0])) {
+		return nil, SnapshotNotValidErr
+	} else if err != nil {
+		return nil, err
+	}
+	var manifest snapshotManifest
+	if err = cbor.DecodeInto(blk.RawData(), &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.V != SnapshotVersion {
+		return nil, SnapshotNotValidErr
+	}
+	report := RestoreReport{}
+	for {
+		blk, err = cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return &report, err
+		}
+		b, err := core.ParseBucket("", blk.RawData())
+		if err != nil {
+			return &report, err
+		}
+		err = br.saveRaw(b.Hash(), b, blk.RawData())
+		switch err {
+		case nil:
+			report.Restored++
+		case core.SeqConflictErr, core.SupersededKeyErr:
+			report.Skipped++
+		default:
+			return &report, err
+		}
+	}
+	return &report, nil
+}
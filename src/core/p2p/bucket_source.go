@@ -2,21 +2,36 @@ package p2p
 
 import (
 	"bytes"
-	"context"
+	"errors"
+	"github.com/amirylm/cbn/src/commons"
 	"github.com/amirylm/cbn/src/core"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
 	"github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-unixfs/importer/balanced"
+	ufsio "github.com/ipfs/go-unixfs/io"
 	"io/ioutil"
+	"os"
+	"path"
 )
 
+var (
+	// BucketShardingThreshold is the amount of entries that once exceeded,
+	// the directory is switched to a HAMT sharded directory
+	BucketShardingThreshold = 1000
+)
+
+// stopIterationErr is used to break out of links iteration
+var stopIterationErr = errors.New("stop iteration")
+
 type P2PBucketSource struct {
 	peer *p2pstorage.MultiStorePeer
+	// providers is an optional index that is used to find peers of missing buckets
+	providers *ProviderIndex
 }
 
 func NewP2PBucketSource(peer *p2pstorage.MultiStorePeer) *P2PBucketSource {
-	pbs := P2PBucketSource{peer}
+	pbs := P2PBucketSource{peer: peer}
 
 	return &pbs
 }
@@ -25,17 +40,40 @@ func (pbs *P2PBucketSource) ID() string {
 	return P2PSource
 }
 
+// loadDir loads the root directory of the given bucket, providers are connected if needed
+func (pbs *P2PBucketSource) loadDir(bucketCid cid.Cid) (ufsio.Directory, error) {
+	if pbs.providers != nil {
+		pbs.providers.connect(bucketCid)
+	}
+	return p2pstorage.LoadDir(pbs.peer, bucketCid)
+}
+
 // NewBucket creates a new bucket in the underlying source
 func (pbs *P2PBucketSource) NewBucket() (ipld.Node, error) {
 	_, newDirNode, err := p2pstorage.AddDir(pbs.peer)
 	return newDirNode, err
 }
 
-// AddChild adds an IPLD node to the bucket
+// AddChild adds an IPLD node to the bucket,
+// intermediate directories of the given path are created if needed.
+// an existing file is replaced, while a directory in the given path is not (AlreadyExistsErr)
 func (pbs *P2PBucketSource) AddChild(bucketCid cid.Cid, name string, dr *core.DataRef) (ipld.Node, error) {
-	dir, err := p2pstorage.LoadDir(pbs.peer, bucketCid)
+	segments, err := core.SplitPath(name)
 	if err != nil {
 		return nil, err
+	} else if len(segments) == 0 {
+		return nil, commons.BadInputErr
+	}
+	dir, err := pbs.loadDir(bucketCid)
+	if err != nil {
+		return nil, err
+	}
+	if existing, err := pbs.find(dir, segments); err == nil {
+		if _, err := ufsio.NewDirectoryFromNode(pbs.peer.DagService(), existing); err == nil {
+			return nil, commons.AlreadyExistsErr
+		}
+	} else if err != commons.NotFoundErr {
+		return nil, err
 	}
 
 	raw, err := core.MarshalDataRef(dr)
@@ -48,53 +86,278 @@ func (pbs *P2PBucketSource) AddChild(bucketCid cid.Cid, name string, dr *core.Da
 		return nil, err
 	}
 
-	// upsert
-	p2pstorage.RemoveFromDir(pbs.peer, dir, name)
-	_, newDirNode, err := p2pstorage.AddToDir(pbs.peer, dir, name, nd)
-	return newDirNode, err
+	return pbs.setPath(dir, segments, nd)
 }
 
-// RemoveChild removes the given child from the bucket
+// RemoveChild removes the given child (file or a whole sub directory) from the bucket
 func (pbs *P2PBucketSource) RemoveChild(bucketCid cid.Cid, ref string) (ipld.Node, error) {
-	dir, err := p2pstorage.LoadDir(pbs.peer, bucketCid)
+	segments, err := core.SplitPath(ref)
 	if err != nil {
 		return nil, err
+	} else if len(segments) == 0 {
+		return nil, commons.BadInputErr
 	}
-	_, newDirNode, err := p2pstorage.RemoveFromDir(pbs.peer, dir, ref)
-	return newDirNode, err
+	dir, err := pbs.loadDir(bucketCid)
+	if err != nil {
+		return nil, err
+	}
+	return pbs.setPath(dir, segments, nil)
+}
+
+// MoveChild moves (or renames) the given child (file or a whole sub directory) within the bucket
+func (pbs *P2PBucketSource) MoveChild(bucketCid cid.Cid, from, to string) (ipld.Node, error) {
+	src, err := core.SplitPath(from)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := core.SplitPath(to)
+	if err != nil {
+		return nil, err
+	}
+	if len(src) == 0 || len(dest) == 0 || isSubPath(src, dest) {
+		// a directory can't be moved into its own subtree
+		return nil, commons.BadInputErr
+	}
+	dir, err := pbs.loadDir(bucketCid)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := pbs.find(dir, src)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pbs.find(dir, dest); err == nil {
+		return nil, commons.AlreadyExistsErr
+	} else if err != commons.NotFoundErr {
+		return nil, err
+	}
+	removed, err := pbs.setPath(dir, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	dir, err = ufsio.NewDirectoryFromNode(pbs.peer.DagService(), removed)
+	if err != nil {
+		return nil, err
+	}
+	return pbs.setPath(dir, dest, nd)
 }
 
 // GetChild returns a child node
 func (pbs *P2PBucketSource) GetChild(bucketCid cid.Cid, name string) (*core.DataRef, error) {
-	dir, err := p2pstorage.LoadDir(pbs.peer, bucketCid)
+	segments, err := core.SplitPath(name)
+	if err != nil {
+		return nil, err
+	} else if len(segments) == 0 {
+		return nil, commons.BadInputErr
+	}
+	dir, err := pbs.loadDir(bucketCid)
 	if err != nil {
 		return nil, err
 	}
-	nd, err := dir.Find(context.Background(), name)
+	nd, err := pbs.find(dir, segments)
 	if err != nil {
 		return nil, err
 	}
-	reader, err := p2pstorage.Get(pbs.peer, nd.Cid())
+	return pbs.readDataRef(nd.Cid())
+}
+
+// ForEachName loops through the names within the given directory of the bucket (root for empty path),
+// links are loaded lazily so large (sharded) directories are not materialized
+func (pbs *P2PBucketSource) ForEachName(bucketCid cid.Cid, dirPath string, iterator core.NameIterator) error {
+	dir, err := pbs.loadDir(bucketCid)
+	if err != nil {
+		return err
+	}
+	segments, err := core.SplitPath(dirPath)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		nd, err := pbs.find(dir, segments)
+		if err != nil {
+			return err
+		}
+		dir, err = ufsio.NewDirectoryFromNode(pbs.peer.DagService(), nd)
+		if err == ufsio.ErrNotADir {
+			return commons.BadInputErr
+		} else if err != nil {
+			return err
+		}
+	}
+	err = dir.ForEachLink(pbs.peer.Context(), func(link *ipld.Link) error {
+		cont, err := iterator(link.Name)
+		if err != nil {
+			return err
+		}
+		if !cont {
+			return stopIterationErr
+		}
+		return nil
+	})
+	if err == stopIterationErr {
+		return nil
+	}
+	return err
+}
+
+// Walk loops recursively through all the files in the bucket,
+// core.InvalidPathErr is returned for entries with invalid names
+func (pbs *P2PBucketSource) Walk(bucketCid cid.Cid, walker core.BucketWalker) error {
+	dir, err := pbs.loadDir(bucketCid)
+	if err != nil {
+		return err
+	}
+	_, err = pbs.walk(dir, "", walker)
+	if err == stopIterationErr {
+		return nil
+	}
+	return err
+}
+
+// walk loops through the links of the given dir, sub directories are walked recursively
+func (pbs *P2PBucketSource) walk(dir ufsio.Directory, dirPath string, walker core.BucketWalker) (bool, error) {
+	err := dir.ForEachLink(pbs.peer.Context(), func(link *ipld.Link) error {
+		if !core.ValidName(link.Name) {
+			// might be a remote bucket that was crafted to escape its root
+			return core.InvalidPathErr
+		}
+		nd, err := link.GetNode(pbs.peer.Context(), pbs.peer.DagService())
+		if err != nil {
+			return err
+		}
+		p := path.Join(dirPath, link.Name)
+		child, err := ufsio.NewDirectoryFromNode(pbs.peer.DagService(), nd)
+		if err == nil {
+			if cont, err := pbs.walk(child, p, walker); err != nil {
+				return err
+			} else if !cont {
+				return stopIterationErr
+			}
+			return nil
+		} else if err != ufsio.ErrNotADir {
+			return err
+		}
+		dr, err := pbs.readDataRef(nd.Cid())
+		if err != nil {
+			return err
+		}
+		cont, err := walker(p, dr)
+		if err != nil {
+			return err
+		}
+		if !cont {
+			return stopIterationErr
+		}
+		return nil
+	})
+	if err == stopIterationErr {
+		return false, err
+	}
+	return err == nil, err
+}
+
+// readDataRef reads the data ref stored in the given node
+func (pbs *P2PBucketSource) readDataRef(c cid.Cid) (*core.DataRef, error) {
+	reader, err := p2pstorage.Get(pbs.peer, c)
 	if err != nil {
 		return nil, err
 	}
-	raw, err :=ioutil.ReadAll(reader)
+	raw, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
 	return core.UnmarshalDataRef(raw)
 }
 
-// GetNames returns all the refs within a bucket
-func (pbs *P2PBucketSource) GetNames(bucketCid cid.Cid) ([]string, error) {
-	dir, err := p2pstorage.LoadDir(pbs.peer, bucketCid)
+// isSubPath returns whether the given path is equal to or nested under the given parent
+func isSubPath(parent, p []string) bool {
+	if len(p) < len(parent) {
+		return false
+	}
+	for i, s := range parent {
+		if p[i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+// find walks through the given path and returns the last node
+func (pbs *P2PBucketSource) find(dir ufsio.Directory, segments []string) (ipld.Node, error) {
+	nd, err := dir.Find(pbs.peer.Context(), segments[0])
+	if err == os.ErrNotExist {
+		return nil, commons.NotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+	if len(segments) == 1 {
+		return nd, nil
+	}
+	child, err := ufsio.NewDirectoryFromNode(pbs.peer.DagService(), nd)
+	if err != nil {
+		return nil, err
+	}
+	return pbs.find(child, segments[1:])
+}
+
+// setPath upserts the given node in the given path, or removes the entry in case node is nil.
+// intermediate directories are created when needed, the new (root) directory node is returned
+func (pbs *P2PBucketSource) setPath(dir ufsio.Directory, segments []string, nd ipld.Node) (ipld.Node, error) {
+	name := segments[0]
+	if len(segments) == 1 {
+		if nd == nil {
+			_, newDirNode, err := p2pstorage.RemoveFromDir(pbs.peer, dir, name)
+			if err == os.ErrNotExist {
+				return nil, commons.NotFoundErr
+			}
+			return newDirNode, err
+		}
+		dir, err := pbs.shardIfNeeded(dir)
+		if err != nil {
+			return nil, err
+		}
+		_, newDirNode, err := p2pstorage.AddToDir(pbs.peer, dir, name, nd)
+		return newDirNode, err
+	}
+
+	var child ufsio.Directory
+	childNd, err := dir.Find(pbs.peer.Context(), name)
+	if err == os.ErrNotExist {
+		if nd == nil {
+			return nil, commons.NotFoundErr
+		}
+		child = ufsio.NewDirectory(pbs.peer.DagService())
+		child.SetCidBuilder(dir.GetCidBuilder())
+	} else if err != nil {
+		return nil, err
+	} else if child, err = ufsio.NewDirectoryFromNode(pbs.peer.DagService(), childNd); err != nil {
+		return nil, err
+	}
+
+	newChildNd, err := pbs.setPath(child, segments[1:], nd)
+	if err != nil {
+		return nil, err
+	}
+	if dir, err = pbs.shardIfNeeded(dir); err != nil {
+		return nil, err
+	}
+	_, newDirNode, err := p2pstorage.AddToDir(pbs.peer, dir, name, newChildNd)
+	return newDirNode, err
+}
+
+// shardIfNeeded switches the given directory to a HAMT sharded directory
+// in case it reached BucketShardingThreshold
+func (pbs *P2PBucketSource) shardIfNeeded(dir ufsio.Directory) (ufsio.Directory, error) {
+	basic, ok := dir.(*ufsio.BasicDirectory)
+	if !ok || BucketShardingThreshold <= 0 {
+		return dir, nil
+	}
+	nd, err := basic.GetNode()
 	if err != nil {
 		return nil, err
 	}
-	names := []string{}
-	err = dir.ForEachLink(context.Background(), func(link *ipld.Link) error {
-		names = append(names, link.Name)
-		return nil
-	})
-	return names, err
+	if len(nd.Links()) < BucketShardingThreshold {
+		return dir, nil
+	}
+	return basic.SwitchToSharding(pbs.peer.Context())
 }
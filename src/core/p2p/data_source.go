@@ -9,10 +9,12 @@ import (
 
 type P2PDataSource struct {
 	peer *p2pstorage.MultiStorePeer
+	// providers is an optional index that is used to find peers of missing content
+	providers *ProviderIndex
 }
 
 func NewP2PDataSource(peer *p2pstorage.MultiStorePeer) *P2PDataSource {
-	pds := P2PDataSource{peer}
+	pds := P2PDataSource{peer: peer}
 
 	return &pds
 }
@@ -32,5 +34,8 @@ func (pds *P2PDataSource) Add(r io.Reader) (ipld.Node, error) {
 
 // Get returns a stream by the given cid
 func (pds *P2PDataSource) Get(c cid.Cid) (io.Reader, error) {
+	if pds.providers != nil {
+		pds.providers.connect(c)
+	}
 	return p2pstorage.Get(pds.peer, c)
 }
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"github.com/amirylm/cbn/src/commons"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/metrics"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"log"
+	"strings"
+)
+
+const (
+	dealPrefix       = "/deal"
+	crdtPSDealsTopic = "crdt_deals"
+	crdtDeals        = "deals"
+)
+
+func DealKey(id string) ds.Key {
+	return ds.NewKey(dealPrefix + ds.NewKey(id).String())
+}
+
+// P2PDealRegistry is based on merkle crdt, therefore deals are available to both clients and storage nodes
+type P2PDealRegistry struct {
+	peer *p2pstorage.MultiStorePeer
+}
+
+func NewP2PDealRegistry(peer *p2pstorage.MultiStorePeer) *P2PDealRegistry {
+	dealsCrdt, err := p2pstorage.ConfigureCrdt(peer, crdtPSDealsTopic, crdtMetricsOptions(crdtDeals))
+	if err != nil {
+		log.Panic("could not create crdt store")
+	}
+	peer.UseCrdt(crdtDeals, dealsCrdt)
+	dr := P2PDealRegistry{peer}
+	return &dr
+}
+
+// Save persists the given deal, only valid deals are saved
+func (dr *P2PDealRegistry) Save(d *core.Deal) error {
+	raw, err := core.SerializeDeal(d)
+	if err != nil {
+		return err
+	}
+	metrics.CrdtPuts.WithLabelValues(crdtDeals).Inc()
+	return dr.peer.Crdt(crdtDeals).Put(DealKey(d.ID()), raw)
+}
+
+// Load loads the desired deal
+func (dr *P2PDealRegistry) Load(id string) (*core.Deal, error) {
+	raw, err := dr.peer.Crdt(crdtDeals).Get(DealKey(id))
+	if err == ds.ErrNotFound {
+		return nil, commons.NotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+	return core.ParseDeal(raw)
+}
+
+// ForEach loops through all available deals
+func (dr *P2PDealRegistry) ForEach(iterator core.DealIterator) error {
+	results, err := dr.peer.Crdt(crdtDeals).Query(query.Query{Prefix: dealPrefix})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for entry := range results.Next() {
+		if entry.Error != nil {
+			return entry.Error
+		}
+		d, err := core.ParseDeal(entry.Value)
+		if err != nil {
+			log.Printf("could not parse deal %s: %s", entry.Key, err.Error())
+			continue
+		}
+		cont, err := iterator(strings.Replace(entry.Key, dealPrefix+"/", "", 1), d)
+		if err != nil {
+			return err
+		}
+		if !cont {
+			break
+		}
+	}
+	return nil
+}
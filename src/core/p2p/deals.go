@@ -0,0 +1,248 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/amirylm/cbn/src/core"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+	"log"
+	"time"
+)
+
+var (
+	// DealRequestTimeout limits the time of proposing a deal
+	DealRequestTimeout = 30 * time.Second
+	// DealProposalMaxAge is the max age of proposals that are accepted
+	DealProposalMaxAge = 10 * time.Minute
+)
+
+// dealResponseMsg is the response of a storage node to a proposal
+type dealResponseMsg struct {
+	Deal  json.RawMessage `json:",omitempty"`
+	Error string          `json:",omitempty"`
+}
+
+// NewDealPolicy creates a policy that accepts proposals within the given limits, 0 means no limit
+func NewDealPolicy(maxSize uint64, maxDuration time.Duration, minPrice uint64) core.DealPolicy {
+	return func(dp *core.DealProposal) error {
+		if maxSize > 0 && dp.Size() > maxSize {
+			return errors.New("deal size is too large")
+		}
+		if maxDuration > 0 && dp.Duration() > maxDuration {
+			return errors.New("deal duration is too long")
+		}
+		if dp.Price() < minPrice {
+			return errors.New("deal price is too low")
+		}
+		return nil
+	}
+}
+
+// DealMaker makes storage deals: clients propose deals to storage nodes,
+// which accept them with a counter-signed deal. accepted deals are saved in the deals registry
+// and the content is pinned until the deal expires
+type DealMaker struct {
+	peer *p2pstorage.MultiStorePeer
+	ctrl *core.Controller
+	reg  core.DealRegistry
+	pins *core.PinManager
+
+	// Policy decides which proposals are accepted, nil to reject all
+	Policy core.DealPolicy
+}
+
+func NewDealMaker(ctrl *core.Controller, reg core.DealRegistry, pins *core.PinManager) *DealMaker {
+	dm := DealMaker{peer: ctrl.Peer(), ctrl: ctrl, reg: reg, pins: pins}
+
+	return &dm
+}
+
+// Registry returns the underlying deals registry
+func (dm *DealMaker) Registry() core.DealRegistry {
+	return dm.reg
+}
+
+// ProposalHandler accepts (or rejects) deal proposals of clients
+func (dm *DealMaker) ProposalHandler() network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		res := dealResponseMsg{}
+		mr := msgio.NewReader(bufio.NewReader(stream))
+		msg, err := mr.ReadMsg()
+		if err != nil {
+			log.Println("could not read deal proposal:", err)
+			stream.Reset()
+			return
+		}
+		d, err := dm.Accept(msg)
+		if err != nil {
+			res.Error = err.Error()
+		} else if res.Deal, err = core.SerializeDeal(d); err != nil {
+			res.Error = err.Error()
+		}
+		raw, err := json.Marshal(&res)
+		if err != nil {
+			log.Println("could not marshal deal response:", err)
+			stream.Reset()
+			return
+		}
+		if err = msgio.NewWriter(stream).WriteMsg(raw); err != nil {
+			log.Println("could not send deal response:", err)
+			stream.Reset()
+		}
+	}
+}
+
+// Accept checks the given (serialized) proposal, and once accepted the deal is signed, saved and pinned
+func (dm *DealMaker) Accept(raw []byte) (*core.Deal, error) {
+	dp, err := core.ParseDealProposal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err = dp.Validate(); err != nil {
+		return nil, err
+	}
+	if dp.Provider() != dm.peer.Host().ID().Pretty() {
+		return nil, core.DealNotValidErr
+	}
+	if time.Since(time.Unix(dp.Created(), 0)) > DealProposalMaxAge {
+		return nil, core.DealNotValidErr
+	}
+	if dm.Policy == nil {
+		return nil, core.DealRejectedErr
+	}
+	if err = dm.Policy(dp); err != nil {
+		return nil, err
+	}
+	// the declared size is not trusted, the actual content must fit in it
+	if _, err = dm.contentSize(dp.Bucket(), dp.Cids(), dp.Size()); err != nil {
+		if err == core.DagTooLargeErr {
+			return nil, errors.New("deal size is smaller than the content")
+		}
+		return nil, err
+	}
+	d, err := core.AcceptDeal(dp, dm.peer.PrivKey().GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	if err = d.Sign(dm.peer.PrivKey()); err != nil {
+		return nil, err
+	}
+	if err = dm.reg.Save(d); err != nil {
+		return nil, err
+	}
+	return d, dm.pin(d)
+}
+
+// contentSize returns the actual size of the given bucket and cids (including all the referenced data),
+// core.DagTooLargeErr is returned once the size exceeds the given limit (0 for no limit)
+func (dm *DealMaker) contentSize(hash string, cids []string, limit uint64) (uint64, error) {
+	roots := []cid.Cid{}
+	if len(hash) > 0 {
+		bucket, err := dm.ctrl.BucketRegistry().Load(hash)
+		if err != nil {
+			return 0, err
+		}
+		roots = append(roots, bucket.NodeCid())
+		err = dm.ctrl.BucketSource().Walk(bucket.NodeCid(), func(p string, dr *core.DataRef) (bool, error) {
+			roots = append(roots, dr.NodeCid())
+			return true, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, s := range cids {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return 0, core.DealNotValidErr
+		}
+		roots = append(roots, c)
+	}
+	ctx, cancel := context.WithTimeout(dm.peer.Context(), DealRequestTimeout)
+	defer cancel()
+	return dm.ctrl.DagSize(ctx, limit, roots...)
+}
+
+// pin pins the content of the given deal until it expires
+func (dm *DealMaker) pin(d *core.Deal) error {
+	dp := d.Proposal()
+	if len(dp.Bucket()) > 0 {
+		if err := dm.pins.Pin(core.Pin{Kind: core.PinHash, Value: dp.Bucket(), Expires: d.Expires()}); err != nil {
+			return err
+		}
+	}
+	for _, c := range dp.Cids() {
+		if err := dm.pins.Pin(core.Pin{Kind: core.PinCid, Value: c, Expires: d.Expires()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Propose sends the given signed proposal to the storage node, and returns the accepted deal
+func (dm *DealMaker) Propose(dp *core.DealProposal) (*core.Deal, error) {
+	pid, err := peer.Decode(dp.Provider())
+	if err != nil {
+		return nil, err
+	}
+	raw, err := core.SerializeDealProposal(dp)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(dm.peer.Context(), DealRequestTimeout)
+	defer cancel()
+	stream, err := dm.peer.Host().NewStream(ctx, pid, DealProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(DealRequestTimeout))
+
+	if err = msgio.NewWriter(stream).WriteMsg(raw); err != nil {
+		return nil, err
+	}
+	msg, err := msgio.NewReader(bufio.NewReader(stream)).ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	var res dealResponseMsg
+	if err = json.Unmarshal(msg, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Error) > 0 {
+		return nil, errors.New(res.Error)
+	}
+	d, err := core.ParseDeal(res.Deal)
+	if err != nil {
+		return nil, err
+	}
+	if d.ID() != core.DealID(dp) {
+		return nil, core.DealNotValidErr
+	}
+	return d, dm.reg.Save(d)
+}
+
+// ProposeBucket creates, signs and proposes a deal for the given bucket
+func (dm *DealMaker) ProposeBucket(provider peer.ID, hash string, duration time.Duration, price uint64) (*core.Deal, error) {
+	size, err := dm.contentSize(hash, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	priv := dm.peer.PrivKey()
+	dp, err := core.NewDealProposal(hash, nil, size, duration, price, provider, priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	if err = dp.Sign(priv); err != nil {
+		return nil, err
+	}
+	return dm.Propose(dp)
+}
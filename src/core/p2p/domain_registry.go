@@ -3,6 +3,7 @@ package p2p
 import (
 	"errors"
 	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/metrics"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
 	ds "github.com/ipfs/go-datastore"
 	"log"
@@ -24,7 +25,7 @@ type P2PDomainRegistry struct {
 }
 
 func NewP2PDomainRegistry(peer *p2pstorage.MultiStorePeer) *P2PDomainRegistry {
-	domainsCrdt, err := p2pstorage.ConfigureCrdt(peer, crdtPSDomainsTopic, nil)
+	domainsCrdt, err := p2pstorage.ConfigureCrdt(peer, crdtPSDomainsTopic, crdtMetricsOptions(crdtDomains))
 	if err != nil {
 		log.Panic("could not create crdt store")
 	}
@@ -41,6 +42,10 @@ func (dr *P2PDomainRegistry) Register(rec *core.DomainRecord) error {
 	} else if err != nil {
 		return err
 	}
+	// new records must use the current encoding
+	if rec.Version() == core.LegacyEncoding {
+		return core.UnsupportedEncodingErr
+	}
 	if err := rec.Verify(); err != nil {
 		return err
 	}
@@ -48,6 +53,7 @@ func (dr *P2PDomainRegistry) Register(rec *core.DomainRecord) error {
 	if err != nil {
 		return err
 	}
+	metrics.CrdtPuts.WithLabelValues(crdtDomains).Inc()
 	return ds.Put(k, raw)
 }
 
@@ -0,0 +1,325 @@
+package p2p
+
+import (
+	"github.com/amirylm/cbn/src/core"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// GCGracePeriod is the time that new (unreferenced yet) DAGs are kept
+	GCGracePeriod = time.Hour
+)
+
+// GCRetentionPolicy returns the amount of previous versions to keep for the given bucket
+type GCRetentionPolicy = func(hash string) int
+
+// GCRootsProvider provides additional roots that should be kept by GC
+type GCRootsProvider = func() ([]cid.Cid, error)
+
+// GCReport describes the result of a GC run
+type GCReport struct {
+	DryRun bool
+	// Marked is the amount of reachable blocks
+	Marked int
+	// Removed are the unreachable blocks (that would be removed in dry-run)
+	Removed []cid.Cid
+	// Freed is the total size (bytes) of removed blocks
+	Freed    uint64
+	Duration time.Duration
+}
+
+// GarbageCollector removes blocks that are not reachable from the current buckets (mark and sweep),
+// reachable blocks are:
+//   - DAGs of buckets in the registry (including data of DataRefs) and retained versions
+//   - crdt DAGs
+//   - DAGs that were created within GCGracePeriod
+//   - additional roots of providers
+type GarbageCollector struct {
+	lock sync.Mutex
+
+	peer *p2pstorage.MultiStorePeer
+	ctrl *core.Controller
+
+	// RetainVersions is the amount of previous versions to keep for each bucket
+	RetainVersions int
+
+	providers []GCRootsProvider
+	retention GCRetentionPolicy
+}
+
+func NewGarbageCollector(ctrl *core.Controller) *GarbageCollector {
+	gc := GarbageCollector{peer: ctrl.Peer(), ctrl: ctrl, providers: []GCRootsProvider{}}
+
+	return &gc
+}
+
+// AddRoots registers a provider of additional roots,
+// roots might be buckets nodes or any other DAG
+func (gc *GarbageCollector) AddRoots(provider GCRootsProvider) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	gc.providers = append(gc.providers, provider)
+}
+
+// SetRetention sets a policy for keeping versions of specific buckets (e.g. pins),
+// the max between the policy and RetainVersions is kept
+func (gc *GarbageCollector) SetRetention(policy GCRetentionPolicy) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	gc.retention = policy
+}
+
+// Start runs GC periodically until the peer is closed
+func (gc *GarbageCollector) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gc.peer.Context().Done():
+			return
+		case <-ticker.C:
+			report, err := gc.Run(false)
+			if err != nil {
+				log.Println("could not run gc:", err)
+				continue
+			}
+			log.Printf("gc: removed %d blocks (%d bytes), kept %d blocks", len(report.Removed), report.Freed, report.Marked)
+		}
+	}
+}
+
+// Run collects the garbage, in dry-run mode blocks are reported but not removed
+func (gc *GarbageCollector) Run(dryRun bool) (*GCReport, error) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	// writes of DAGs are blocked while GC runs, otherwise an existing block that is reused by
+	// a concurrent write (e.g. the same data is uploaded again) might be removed before it is referenced
+	defer gc.ctrl.GCLock()()
+
+	start := time.Now()
+	bstore := gc.peer.BlockService().Blockstore()
+	keys, err := bstore.AllKeysChan(gc.peer.Context())
+	if err != nil {
+		return nil, err
+	}
+	candidates := []cid.Cid{}
+	for k := range keys {
+		candidates = append(candidates, k)
+	}
+
+	m := marker{bstore: bstore, marked: map[string]bool{}}
+	if err = gc.mark(&m, dryRun); err != nil {
+		return nil, err
+	}
+
+	report := GCReport{DryRun: dryRun, Marked: len(m.marked), Removed: []cid.Cid{}}
+	for _, c := range candidates {
+		if m.marked[string(c.Hash())] {
+			continue
+		}
+		if size, err := bstore.GetSize(c); err == nil {
+			report.Freed += uint64(size)
+		}
+		if !dryRun {
+			if err := bstore.DeleteBlock(c); err != nil {
+				return nil, err
+			}
+		}
+		report.Removed = append(report.Removed, c)
+	}
+	report.Duration = time.Since(start)
+	return &report, nil
+}
+
+// mark marks the reachable blocks, versions of buckets that are not retained are pruned unless dryRun is set
+func (gc *GarbageCollector) mark(m *marker, dryRun bool) error {
+	reg, _ := gc.ctrl.BucketRegistry().(*P2PBucketRegistry)
+	err := gc.ctrl.BucketRegistry().ForEach(func(hash string, b *core.Bucket) (bool, error) {
+		if err := m.markEntry(b.NodeCid()); err != nil {
+			return false, err
+		}
+		retain := gc.RetainVersions
+		if gc.retention != nil {
+			if r := gc.retention(hash); r > retain {
+				retain = r
+			}
+		}
+		if reg == nil || retain <= 0 {
+			return true, nil
+		}
+		versions, err := reg.Versions(hash)
+		if err != nil {
+			return false, err
+		}
+		// the first version is the current one
+		for i := 1; i < len(versions) && i <= retain; i++ {
+			if err := m.markEntry(versions[i]); err != nil {
+				return false, err
+			}
+		}
+		if dryRun {
+			return true, nil
+		}
+		return true, reg.PruneVersions(hash, retain+1)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{crdtPSBucketsTopic, crdtPSDomainsTopic, crdtPSDealsTopic} {
+		heads, err := crdtHeads(gc.peer.Store(), name)
+		if err != nil {
+			return err
+		}
+		for _, h := range heads {
+			if err := m.markDag(h); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range gc.ctrl.RecentRoots(GCGracePeriod) {
+		if err := m.markEntry(c); err != nil {
+			return err
+		}
+	}
+
+	for _, provider := range gc.providers {
+		roots, err := provider()
+		if err != nil {
+			return err
+		}
+		for _, c := range roots {
+			if err := m.markEntry(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// crdtHeads returns the current heads of the given crdt store
+func crdtHeads(store ds.Datastore, name string) ([]cid.Cid, error) {
+	// heads are stored in '/<name>/h/<multihash>'
+	results, err := store.Query(query.Query{Prefix: ds.NewKey(name).ChildString("h").String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	heads := []cid.Cid{}
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		c, err := dshelp.DsKeyToCidV1(ds.NewKey(ds.RawKey(r.Key).BaseNamespace()), cid.DagProtobuf)
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, c)
+	}
+	return heads, nil
+}
+
+// marker marks reachable blocks, only local blocks are visited
+type marker struct {
+	bstore interface {
+		Get(cid.Cid) (blocks.Block, error)
+		Has(cid.Cid) (bool, error)
+	}
+	// marked blocks by multihash, as the blockstore is keyed by multihash
+	marked map[string]bool
+	// onRef is called with the data root of each DataRef, if set the referenced data is not marked
+	onRef func(cid.Cid) error
+}
+
+// visit marks the given block and returns the decoded node, nil is returned for visited or missing blocks
+func (m *marker) visit(c cid.Cid) (ipld.Node, error) {
+	k := string(c.Hash())
+	if m.marked[k] {
+		return nil, nil
+	}
+	if has, err := m.bstore.Has(c); err != nil || !has {
+		return nil, err
+	}
+	m.marked[k] = true
+	b, err := m.bstore.Get(c)
+	if err != nil {
+		return nil, err
+	}
+	return ipld.Decode(b)
+}
+
+// markDag marks the given DAG
+func (m *marker) markDag(root cid.Cid) error {
+	nd, err := m.visit(root)
+	if err != nil || nd == nil {
+		return err
+	}
+	for _, l := range nd.Links() {
+		if err := m.markDag(l.Cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markEntry marks the given bucket entry: directories are marked recursively,
+// files are DataRefs and therefore the referenced data is marked as well
+func (m *marker) markEntry(c cid.Cid) error {
+	nd, err := m.visit(c)
+	if err != nil || nd == nil {
+		return err
+	}
+	pn, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return m.markLinks(nd)
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return m.markLinks(nd)
+	}
+	switch fsn.Type() {
+	case unixfs.TDirectory, unixfs.THAMTShard:
+		for _, l := range nd.Links() {
+			if err := m.markEntry(l.Cid); err != nil {
+				return err
+			}
+		}
+		return nil
+	case unixfs.TFile:
+		// data refs are small and therefore stored in a single node
+		if len(nd.Links()) == 0 {
+			if dr, err := core.UnmarshalDataRef(fsn.Data()); err == nil && dr.NodeCid().Defined() {
+				if m.onRef != nil {
+					return m.onRef(dr.NodeCid())
+				}
+				if err := m.markDag(dr.NodeCid()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return m.markLinks(nd)
+}
+
+func (m *marker) markLinks(nd ipld.Node) error {
+	for _, l := range nd.Links() {
+		if err := m.markDag(l.Cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/metrics"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-msgio"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ReceiptTimeout limits the time of sending a receipt
+	ReceiptTimeout = 10 * time.Second
+
+	DebtLimitExceededErr = errors.New("debt limit exceeded")
+)
+
+const (
+	ledgerAccountsPrefix = "/ledger/accounts"
+	ledgerReceiptsPrefix = "/ledger/receipts"
+)
+
+// Account is the bandwidth accounting with some remote peer
+type Account struct {
+	Peer string `json:"peer"`
+	// Sent is the amount of bytes that were served to the peer
+	Sent uint64 `json:"sent"`
+	// Received is the amount of bytes that were received from the peer
+	Received uint64 `json:"received"`
+	// Acknowledged is the amount of served bytes that the peer signed receipts for
+	Acknowledged uint64 `json:"acknowledged"`
+	// Receipted is the amount of received bytes that we sent receipts for
+	Receipted uint64 `json:"receipted"`
+	Updated   int64  `json:"updated"`
+}
+
+// Debt is the amount of served bytes that were not acknowledged by the peer
+func (a Account) Debt() uint64 {
+	if a.Sent > a.Acknowledged {
+		return a.Sent - a.Acknowledged
+	}
+	return 0
+}
+
+// ledgerPeer is satisfied by both storage peers (nodes) and base peers (clients)
+type ledgerPeer interface {
+	Context() context.Context
+	Host() host.Host
+	PrivKey() libp2pcrypto.PrivKey
+	Store() ds.Batching
+}
+
+// Ledger accounts the bytes that are exchanged with each peer on data streams,
+// i.e. streams of wrapped handlers (see Handler) and streams that were opened with NewStream.
+// blocks that are exchanged with bitswap are not metered.
+// peers periodically send signed receipts of the bytes they received, which are saved in the local store.
+// peers with a debt (served bytes without receipts) above DebtLimit are throttled
+type Ledger struct {
+	lock sync.RWMutex
+
+	peer ledgerPeer
+
+	accounts map[peer.ID]*Account
+	dirty    map[peer.ID]bool
+
+	// DebtLimit is the max debt (bytes) of a peer before its streams are refused, 0 for no limit
+	DebtLimit uint64
+}
+
+// NewLedger creates a ledger and loads the accounts that were saved in the local store
+func NewLedger(p ledgerPeer) *Ledger {
+	l := Ledger{
+		peer:     p,
+		accounts: map[peer.ID]*Account{},
+		dirty:    map[peer.ID]bool{},
+	}
+	if err := l.load(); err != nil {
+		log.Println("could not load ledger accounts:", err)
+	}
+
+	return &l
+}
+
+func (l *Ledger) load() error {
+	results, err := l.peer.Store().Query(query.Query{Prefix: ledgerAccountsPrefix})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		var a Account
+		if err := json.Unmarshal(r.Value, &a); err != nil {
+			return err
+		}
+		pid, err := peer.Decode(a.Peer)
+		if err != nil {
+			continue
+		}
+		l.accounts[pid] = &a
+	}
+	return nil
+}
+
+// Account returns a copy of the account of the given peer
+func (l *Ledger) Account(p peer.ID) Account {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if a, ok := l.accounts[p]; ok {
+		return *a
+	}
+	return Account{Peer: p.Pretty()}
+}
+
+// Accounts returns a copy of all the accounts, ordered by debt
+func (l *Ledger) Accounts() []Account {
+	l.lock.RLock()
+	res := []Account{}
+	for _, a := range l.accounts {
+		res = append(res, *a)
+	}
+	l.lock.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Debt() > res[j].Debt()
+	})
+	return res
+}
+
+// Throttled checks whether the debt of the given peer exceeds the limit
+func (l *Ledger) Throttled(p peer.ID) bool {
+	if l.DebtLimit == 0 {
+		return false
+	}
+	a := l.Account(p)
+	return a.Debt() > l.DebtLimit
+}
+
+// account returns the account of the given peer, the caller should hold the lock
+func (l *Ledger) account(p peer.ID) *Account {
+	a, ok := l.accounts[p]
+	if !ok {
+		a = &Account{Peer: p.Pretty()}
+		l.accounts[p] = a
+	}
+	l.dirty[p] = true
+	a.Updated = time.Now().Unix()
+	return a
+}
+
+func (l *Ledger) addSent(p peer.ID, n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.account(p).Sent += uint64(n)
+}
+
+func (l *Ledger) addReceived(p peer.ID, n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.account(p).Received += uint64(n)
+}
+
+// Handler wraps a data-serving handler so that the bytes of its streams are accounted,
+// streams of throttled peers are reset
+func (l *Ledger) Handler(h network.StreamHandler) network.StreamHandler {
+	return func(stream network.Stream) {
+		remote := stream.Conn().RemotePeer()
+		if l.Throttled(remote) {
+			log.Printf("stream of %s was refused: %s", remote.Pretty(), DebtLimitExceededErr.Error())
+			stream.Reset()
+			return
+		}
+		h(&meteredStream{stream, l, remote, true})
+	}
+}
+
+// NewStream opens a new stream whose bytes are accounted
+func (l *Ledger) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	stream, err := l.peer.Host().NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredStream{stream, l, p, false}, nil
+}
+
+// Start sends receipts and saves the accounts periodically until the peer is closed
+func (l *Ledger) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.peer.Context().Done():
+			if err := l.Flush(); err != nil {
+				log.Println("could not save ledger accounts:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := l.SendReceipts(); err != nil {
+				log.Println("could not send receipts:", err)
+			}
+			if err := l.Flush(); err != nil {
+				log.Println("could not save ledger accounts:", err)
+			}
+		}
+	}
+}
+
+// Flush saves the accounts that were changed since the last flush
+func (l *Ledger) Flush() error {
+	l.lock.Lock()
+	toSave := map[peer.ID][]byte{}
+	for p := range l.dirty {
+		raw, err := json.Marshal(l.accounts[p])
+		if err != nil {
+			l.lock.Unlock()
+			return err
+		}
+		toSave[p] = raw
+	}
+	l.dirty = map[peer.ID]bool{}
+	l.lock.Unlock()
+
+	for p, raw := range toSave {
+		if err := l.peer.Store().Put(ds.NewKey(ledgerAccountsPrefix).ChildString(p.Pretty()), raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendReceipts sends signed receipts to the peers that served us new bytes since the last receipt
+func (l *Ledger) SendReceipts() error {
+	l.lock.RLock()
+	pending := map[peer.ID]uint64{}
+	for p, a := range l.accounts {
+		if a.Received > a.Receipted {
+			pending[p] = a.Received
+		}
+	}
+	l.lock.RUnlock()
+
+	for p, received := range pending {
+		if err := l.SendReceipt(p, received); err != nil {
+			log.Printf("could not send receipt to %s: %s", p.Pretty(), err.Error())
+		}
+	}
+	return nil
+}
+
+// SendReceipt signs and sends a receipt of the given (total) amount of bytes to the given provider
+func (l *Ledger) SendReceipt(provider peer.ID, received uint64) error {
+	priv := l.peer.PrivKey()
+	r, err := core.NewReceipt(provider, received, priv.GetPublic())
+	if err != nil {
+		return err
+	}
+	if err = r.Sign(priv); err != nil {
+		return err
+	}
+	raw, err := core.SerializeReceipt(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(l.peer.Context(), ReceiptTimeout)
+	defer cancel()
+	stream, err := l.peer.Host().NewStream(ctx, provider, ReceiptProtocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(ReceiptTimeout))
+	if err = msgio.NewWriter(stream).WriteMsg(raw); err != nil {
+		return err
+	}
+	// the response is empty on success, or an error message
+	msg, err := msgio.NewReader(bufio.NewReader(stream)).ReadMsg()
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return errors.New(string(msg))
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if a := l.account(provider); a.Receipted < received {
+		a.Receipted = received
+	}
+	return nil
+}
+
+// ReceiptHandler accepts receipts of the peers that were served by the local peer
+func (l *Ledger) ReceiptHandler() network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		msg, err := msgio.NewReader(bufio.NewReader(stream)).ReadMsg()
+		if err != nil {
+			log.Println("could not read receipt:", err)
+			stream.Reset()
+			return
+		}
+		res := []byte{}
+		if err = l.Acknowledge(stream.Conn().RemotePeer(), msg); err != nil {
+			res = []byte(err.Error())
+		}
+		if err = msgio.NewWriter(stream).WriteMsg(res); err != nil {
+			log.Println("could not send receipt response:", err)
+			stream.Reset()
+		}
+	}
+}
+
+// Acknowledge checks the given (serialized) receipt of the given consumer, and saves it
+func (l *Ledger) Acknowledge(consumer peer.ID, raw []byte) error {
+	r, err := core.ParseReceipt(raw)
+	if err != nil {
+		return err
+	}
+	signer, err := r.Consumer()
+	if err != nil || signer != consumer {
+		return core.ReceiptNotValidErr
+	}
+	if r.Provider() != l.peer.Host().ID().Pretty() {
+		return core.ReceiptNotValidErr
+	}
+
+	l.lock.Lock()
+	a := l.account(consumer)
+	acked := r.Bytes()
+	if acked > a.Sent {
+		// consumers might count bytes that were not accounted locally (e.g. before a restart)
+		acked = a.Sent
+	}
+	if acked > a.Acknowledged {
+		a.Acknowledged = acked
+	}
+	l.lock.Unlock()
+
+	return l.peer.Store().Put(ds.NewKey(ledgerReceiptsPrefix).ChildString(consumer.Pretty()), raw)
+}
+
+// Receipt returns the latest receipt of the given consumer
+func (l *Ledger) Receipt(consumer peer.ID) (*core.Receipt, error) {
+	raw, err := l.peer.Store().Get(ds.NewKey(ledgerReceiptsPrefix).ChildString(consumer.Pretty()))
+	if err != nil {
+		return nil, err
+	}
+	return core.ParseReceipt(raw)
+}
+
+// meteredStream accounts the bytes that are read and written
+type meteredStream struct {
+	network.Stream
+	ledger *Ledger
+	remote peer.ID
+	// serving is true for streams of data-serving handlers
+	serving bool
+}
+
+func (s *meteredStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		s.ledger.addReceived(s.remote, n)
+	}
+	return n, err
+}
+
+func (s *meteredStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	if n > 0 {
+		s.ledger.addSent(s.remote, n)
+		if s.serving {
+			metrics.BytesServed.WithLabelValues("libp2p").Add(float64(n))
+		}
+	}
+	return n, err
+}
@@ -1,15 +1,36 @@
 package p2p
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amirylm/cbn/src/car"
+	"github.com/amirylm/cbn/src/cipher"
+	"github.com/amirylm/cbn/src/commons"
 	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/metrics"
 	p2pfacade "github.com/amirylm/libp2p-facade/core"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	lru "github.com/hashicorp/golang-lru"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ufsio "github.com/ipfs/go-unixfs/io"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 )
@@ -29,8 +50,8 @@ func TestController(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not create bucket: %s", err.Error())
 	}
-	bucketHash := core.BucketHash(bucket.Name(), bucket.PK())
-	assert.Equal(t, bucketHash, core.BucketHashPK(bucketName, peers[0].PrivKey().GetPublic()))
+	bucketHash := bucket.Hash()
+	assert.Equal(t, bucketHash, core.BucketHashPK(bucketName, peers[0].PrivKey().GetPublic(), core.BucketHashAlg))
 
 	ctrl1 := NewP2PController(peers[1])
 	b1, err := ctrl1.CreateBucket(bucketName, nil)
@@ -71,10 +92,1280 @@ func TestController(t *testing.T) {
 	assert.Equal(t, 2, len(all))
 }
 
+func TestBucketSourceNested(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	pbs := NewP2PBucketSource(peer)
+
+	root, err := pbs.NewBucket()
+	assert.Nil(t, err)
+	c, _ := root.Cid().Prefix().Sum([]byte("data"))
+	dr := core.NewDataRef(c, P2PSource, *core.NewFileHeader("c.txt", "text/plain"))
+
+	nd, err := pbs.AddChild(root.Cid(), "a/b/c.txt", dr)
+	assert.Nil(t, err)
+	nd, err = pbs.AddChild(nd.Cid(), "a/d.txt", dr)
+	assert.Nil(t, err)
+
+	names, err := getNames(pbs, nd.Cid(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, names)
+	names, err = getNames(pbs, nd.Cid(), "/a/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "d.txt"}, names)
+	ref, err := pbs.GetChild(nd.Cid(), "a/b/c.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "c.txt", ref.Header.Filename)
+
+	_, err = pbs.AddChild(nd.Cid(), "a/../../x.txt", dr)
+	assert.Equal(t, core.InvalidPathErr, err)
+	// a directory is not replaced by a file, while files are
+	_, err = pbs.AddChild(nd.Cid(), "a/b", dr)
+	assert.Equal(t, commons.AlreadyExistsErr, err)
+	replaced, err := pbs.AddChild(nd.Cid(), "a/d.txt", dr)
+	assert.Nil(t, err)
+	names, err = getNames(pbs, replaced.Cid(), "a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "d.txt"}, names)
+	_, err = pbs.GetChild(nd.Cid(), "a/./d.txt")
+	assert.Equal(t, core.InvalidPathErr, err)
+	_, err = pbs.MoveChild(nd.Cid(), "a/b", "a/d.txt")
+	assert.Equal(t, commons.AlreadyExistsErr, err)
+	_, err = pbs.MoveChild(nd.Cid(), "a", "a/b/f")
+	assert.Equal(t, commons.BadInputErr, err)
+	_, err = pbs.MoveChild(nd.Cid(), "a/b", "a/b")
+	assert.Equal(t, commons.BadInputErr, err)
+
+	nd, err = pbs.MoveChild(nd.Cid(), "a/b", "e")
+	assert.Nil(t, err)
+	_, err = pbs.GetChild(nd.Cid(), "a/b/c.txt")
+	assert.Equal(t, commons.NotFoundErr, err)
+	_, err = pbs.GetChild(nd.Cid(), "e/c.txt")
+	assert.Nil(t, err)
+
+	nd, err = pbs.RemoveChild(nd.Cid(), "a")
+	assert.Nil(t, err)
+	names, err = getNames(pbs, nd.Cid(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e"}, names)
+	_, err = pbs.RemoveChild(nd.Cid(), "a/d.txt")
+	assert.Equal(t, commons.NotFoundErr, err)
+}
+
+func TestBucketSourceSharding(t *testing.T) {
+	threshold := BucketShardingThreshold
+	BucketShardingThreshold = 8
+	defer func() {
+		BucketShardingThreshold = threshold
+	}()
+
+	peer := newOfflinePeer()
+	defer peer.Close()
+	pbs := NewP2PBucketSource(peer)
+
+	nd, err := pbs.NewBucket()
+	assert.Nil(t, err)
+	c, _ := nd.Cid().Prefix().Sum([]byte("data"))
+	n := 20
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		nd, err = pbs.AddChild(nd.Cid(), name, core.NewDataRef(c, P2PSource, *core.NewFileHeader(name, "")))
+		assert.Nil(t, err)
+	}
+	dir, err := ufsio.NewDirectoryFromNode(peer.DagService(), nd)
+	assert.Nil(t, err)
+	_, sharded := dir.(*ufsio.HAMTDirectory)
+	assert.True(t, sharded)
+
+	names, err := getNames(pbs, nd.Cid(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, n, len(names))
+	ref, err := pbs.GetChild(nd.Cid(), "file-7")
+	assert.Nil(t, err)
+	assert.Equal(t, "file-7", ref.Header.Filename)
+
+	count := 0
+	err = pbs.ForEachName(nd.Cid(), "", func(name string) (bool, error) {
+		count++
+		return count < 5, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+}
+
+func TestBatch(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+
+	events, cancel := ctrl.SubscribeBuckets(core.BucketHashFilter(bucketHash))
+	defer cancel()
+
+	batch, err := ctrl.NewBatch(bucketHash)
+	assert.Nil(t, err)
+	_, data := getDummyData()
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/c.txt"} {
+		_, err = batch.Add(*core.NewFileHeader(name, "text/plain"), bytes.NewReader(data))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, batch.Remove("a.txt"))
+	assert.Equal(t, 4, batch.Len())
+
+	// changes are not visible before commit
+	names, err := ctrl.GetBucketContent(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+
+	_, err = batch.Commit(nil)
+	assert.Nil(t, err)
+	names, err = ctrl.GetBucketDirContent(bucketHash, "dir")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b.txt", "c.txt"}, names)
+
+	evt := <-events
+	assert.Equal(t, core.BucketUpdated, evt.Type)
+	select {
+	case <-events:
+		t.Fatal("expected a single update")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestControllerIdentity(t *testing.T) {
+	cipher.ScryptN = 1 << 10
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	dir, err := ioutil.TempDir("", "keystore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ks, err := cipher.NewKeystore(dir, "secret")
+	assert.Nil(t, err)
+	alice, err := ks.Generate("alice", crypto.Ed25519)
+	assert.Nil(t, err)
+
+	assert.Equal(t, cipher.KeyNotFoundErr, ctrl.UseKeystore(ks, "bob"))
+	assert.Nil(t, ctrl.UseKeystore(ks, "alice"))
+
+	// the default identity signs buckets, regardless of the peer id
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	pk, err := crypto.UnmarshalPublicKey(bucket.PK())
+	assert.Nil(t, err)
+	assert.True(t, alice.GetPublic().Equals(pk))
+	assert.True(t, ctrl.Owns(bucket.PK()))
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	assert.Nil(t, ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", "text/plain"), bytes.NewReader(data), nil))
+
+	// the peer key is not the owner of the bucket
+	assert.Nil(t, ctrl.SetIdentity(""))
+	err = ctrl.Remove(bucketHash, "a.txt", nil)
+	assert.Equal(t, cipher.NotVerifiedErr, err)
+	priv, err := ctrl.Identity("alice")
+	assert.Nil(t, err)
+	assert.Nil(t, ctrl.Remove(bucketHash, "a.txt", priv))
+
+	other, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	otherPK, _ := crypto.MarshalPublicKey(other.GetPublic())
+	assert.False(t, ctrl.Owns(otherPK))
+}
+
+func TestBucketKeyRotation(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	stale, err := ctrl.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+
+	next, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	rotated, err := ctrl.RotateKey(bucketHash, next, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rotated.Rotations()))
+
+	// updates that are signed by the superseded key are rejected
+	_, data := getDummyData()
+	err = ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", "text/plain"), bytes.NewReader(data), nil)
+	assert.Equal(t, cipher.NotVerifiedErr, err)
+	stale.SetReplicas(2)
+	assert.Equal(t, core.SupersededKeyErr, ctrl.Commit(stale, nil))
+
+	assert.Nil(t, ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", "text/plain"), bytes.NewReader(data), next))
+	loaded, err := ctrl.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, loaded.Replicas())
+	assert.Equal(t, 1, len(loaded.Rotations()))
+	names, err := ctrl.GetBucketContent(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt"}, names)
+}
+
+func TestMultisigBucket(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	other, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	owner, err := cipher.NewMultisigOwner(2, peer.PrivKey().GetPublic(), other.GetPublic())
+	assert.Nil(t, err)
+
+	// signed offline by the other signer
+	signOffline := func(hash string) *core.Bucket {
+		pending, err := ctrl.Pending(hash)
+		assert.Nil(t, err)
+		raw, err := core.SerializePendingBucket(pending)
+		assert.Nil(t, err)
+		signed, err := core.ParsePendingBucket(hash, raw)
+		assert.Nil(t, err)
+		assert.Nil(t, signed.SignPartial(other))
+		return signed
+	}
+
+	bucket, err := ctrl.CreateMultisigBucket("mybucket", owner, nil)
+	assert.Equal(t, core.PendingSignaturesErr, err)
+	bucketHash := bucket.Hash()
+	has, err := ctrl.BucketRegistry().Has(bucketHash)
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	_, err = ctrl.AddSignatures(bucketHash, signOffline(bucketHash))
+	assert.Nil(t, err)
+	_, err = ctrl.Pending(bucketHash)
+	assert.Equal(t, commons.NotFoundErr, err)
+	loaded, err := ctrl.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+	assert.NotNil(t, loaded.Multisig())
+
+	// updates are visible once the threshold was met
+	_, data := getDummyData()
+	err = ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", "text/plain"), bytes.NewReader(data), nil)
+	assert.Equal(t, core.PendingSignaturesErr, err)
+	names, err := ctrl.GetBucketContent(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+
+	_, err = ctrl.AddSignatures(bucketHash, signOffline(bucketHash))
+	assert.Nil(t, err)
+	names, err = ctrl.GetBucketContent(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt"}, names)
+}
+
+func TestBucketReplay(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	oldRaw, err := core.SerializeBucket(bucket)
+	assert.Nil(t, err)
+
+	_, data := getDummyData()
+	assert.Nil(t, ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", "text/plain"), bytes.NewReader(data), nil))
+	current, err := ctrl.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), current.Seq())
+
+	// replays of older (or the current) versions are rejected
+	old, err := core.ParseBucket(bucketHash, oldRaw)
+	assert.Nil(t, err)
+	assert.Equal(t, core.SeqConflictErr, ctrl.SaveSignedBucket(old))
+	assert.Equal(t, core.SeqConflictErr, ctrl.SaveSignedBucket(current))
+
+	// an older version that is merged by the crdt store is replaced by the latest version
+	assert.Nil(t, peer.Crdt(crdtBuckets).Put(BucketKey(bucketHash), oldRaw))
+	loaded, err := ctrl.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), loaded.Seq())
+	for i := 0; i < 20; i++ {
+		raw, err := peer.Crdt(crdtBuckets).Get(BucketKey(bucketHash))
+		assert.Nil(t, err)
+		if !bytes.Equal(raw, oldRaw) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	raw, err := peer.Crdt(crdtBuckets).Get(BucketKey(bucketHash))
+	assert.Nil(t, err)
+	restored, err := core.ParseBucket(bucketHash, raw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), restored.Seq())
+}
+
+func TestBucketVerifiedCache(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+	reg := ctrl.BucketRegistry().(*P2PBucketRegistry)
+
+	batchSize := VerifyBatchSize
+	VerifyBatchSize = 3
+	defer func() { VerifyBatchSize = batchSize }()
+
+	for i := 0; i < 7; i++ {
+		_, err := ctrl.CreateBucket(fmt.Sprintf("bucket-%d", i), nil)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 7, len(ctrl.ListBuckets(nil)))
+
+	// buckets that were saved or listed are not verified again
+	verified := testutil.ToFloat64(metrics.BucketVerifications.WithLabelValues("verified"))
+	cached := testutil.ToFloat64(metrics.BucketVerifications.WithLabelValues("cached"))
+	buckets := ctrl.ListBuckets(nil)
+	assert.Equal(t, 7, len(buckets))
+	assert.Equal(t, verified, testutil.ToFloat64(metrics.BucketVerifications.WithLabelValues("verified")))
+	assert.Equal(t, cached+7, testutil.ToFloat64(metrics.BucketVerifications.WithLabelValues("cached")))
+
+	// a tampered record has another digest, therefore it is verified
+	bucket := buckets[0]
+	raw, err := core.SerializeBucket(&bucket)
+	assert.Nil(t, err)
+	// the last field of the record is the timestamp
+	tampered := append([]byte{}, raw...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = core.DecodeBucket(bucket.Hash(), tampered)
+	assert.Nil(t, err)
+	_, err = reg.parse(bucket.Hash(), tampered)
+	assert.Equal(t, cipher.NotVerifiedErr, err)
+	_, err = reg.parse(bucket.Hash(), raw)
+	assert.Nil(t, err)
+}
+
+func TestBucketIndex(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+	reg := ctrl.BucketRegistry().(*P2PBucketRegistry)
+
+	for i := 0; i < 5; i++ {
+		_, err := ctrl.CreateBucket(fmt.Sprintf("bucket-%d", i), nil)
+		assert.Nil(t, err)
+	}
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	e, err := reg.IndexEntry(bucket.Hash())
+	assert.Nil(t, err)
+	assert.Equal(t, "mybucket", e.Name)
+	assert.Equal(t, bucket.NodeCid().String(), e.Node)
+
+	// a restarted registry loads the index, w/o verifying records
+	restarted := &P2PBucketRegistry{peer: peer, cache: reg.cache, verified: verifiedCache(t), owners: map[string][]byte{}, rotations: map[string][]*core.KeyRotation{}}
+	verified := testutil.ToFloat64(metrics.BucketVerifications.WithLabelValues("verified"))
+	assert.Nil(t, restarted.loadIndex())
+	assert.Equal(t, 6, len(restarted.owners))
+	_, err = restarted.parse(bucket.Hash(), mustSerialize(t, bucket))
+	assert.Nil(t, err)
+	assert.Equal(t, verified, testutil.ToFloat64(metrics.BucketVerifications.WithLabelValues("verified")))
+
+	// a missing index is rebuilt
+	assert.Nil(t, peer.Store().Delete(BucketIndexKey(bucket.Hash())))
+	assert.Nil(t, peer.Store().Delete(bucketIndexStateKey))
+	restarted.owners = map[string][]byte{}
+	assert.Nil(t, restarted.loadIndex())
+	assert.Equal(t, 6, len(restarted.owners))
+	_, err = reg.IndexEntry(bucket.Hash())
+	assert.Nil(t, err)
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	peer0, peer1 := newOfflinePeer(), newOfflinePeer()
+	defer peer0.Close()
+	defer peer1.Close()
+	ctrl0, ctrl1 := NewP2PController(peer0), NewP2PController(peer1)
+	reg0 := ctrl0.BucketRegistry().(*P2PBucketRegistry)
+	reg1 := ctrl1.BucketRegistry().(*P2PBucketRegistry)
+
+	for i := 0; i < 3; i++ {
+		_, err := ctrl0.CreateBucket(fmt.Sprintf("bucket-%d", i), nil)
+		assert.Nil(t, err)
+	}
+	// legacy records (that are still accepted) are restored as well
+	legacyHash, legacyRaw := legacyBucketRecord(t, "legacy")
+	assert.Nil(t, peer0.Crdt(crdtBuckets).Put(BucketKey(legacyHash), legacyRaw))
+	var buf bytes.Buffer
+	n, err := reg0.Snapshot(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+
+	report, err := reg1.Restore(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Restored)
+	assert.Equal(t, 4, len(ctrl1.ListBuckets(nil)))
+	legacy, err := reg1.Load(legacyHash)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(core.LegacyEncoding), legacy.Version())
+	count := 0
+	assert.Nil(t, reg1.ForEachIndexed(func(e *BucketIndexEntry) (bool, error) {
+		count++
+		return true, nil
+	}))
+	assert.Equal(t, 4, count)
+
+	// restoring again skips the known versions
+	report, err = reg1.Restore(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Restored)
+	assert.Equal(t, 4, report.Skipped)
+
+	// a car of a bucket is not a snapshot
+	var carBuf bytes.Buffer
+	b, err := ctrl0.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, ctrl0.ExportBucket(b.Hash(), &carBuf))
+	_, err = reg1.Restore(&carBuf)
+	assert.Equal(t, SnapshotNotValidErr, err)
+}
+
+// legacyBucketRecord returns a bucket record in the JSON form, signed the way buckets were signed before the encoding was versioned
+func legacyBucketRecord(t *testing.T, name string) (string, []byte) {
+	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	assert.Nil(t, err)
+	pkraw, err := crypto.MarshalPublicKey(priv.GetPublic())
+	assert.Nil(t, err)
+	c, err := cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256}.Sum([]byte(name))
+	assert.Nil(t, err)
+	node := []byte(c.String())
+	updated := core.LegacyCutoff - 1
+	salt := []byte("salt")
+	sig, err := priv.Sign(bytes.Join([][]byte{[]byte(name), node, []byte(fmt.Sprint(updated)), salt, pkraw}, []byte{}))
+	assert.Nil(t, err)
+	hash := core.BucketHash(name, pkraw, 0)
+	raw, err := json.Marshal(map[string]interface{}{
+		"Hash": hash, "Name": name, "Node": node, "Updated": updated, "Salt": salt, "PK": pkraw, "Sig": sig,
+	})
+	assert.Nil(t, err)
+	return hash, raw
+}
+
+func verifiedCache(t *testing.T) *lru.Cache {
+	c, err := lru.New(VerifiedCacheSize)
+	assert.Nil(t, err)
+	return c
+}
+
+func mustSerialize(t *testing.T, b *core.Bucket) []byte {
+	raw, err := core.SerializeBucket(b)
+	assert.Nil(t, err)
+	return raw
+}
+
+func TestCarExportImport(t *testing.T) {
+	peer0, peer1 := newOfflinePeer(), newOfflinePeer()
+	defer peer0.Close()
+	defer peer1.Close()
+	ctrl0, ctrl1 := NewP2PController(peer0), NewP2PController(peer1)
+
+	bucket, err := ctrl0.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	name, data := getDummyData()
+	err = ctrl0.Upload(bucketHash, *core.NewFileHeader("dir/"+name, ""), bytes.NewReader(data), nil)
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, ctrl0.ExportBucket(bucketHash, &buf))
+	raw := buf.Bytes()
+
+	imported, err := ctrl1.ImportBucket(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("could not import: %s", err.Error())
+	}
+	assert.Equal(t, bucketHash, imported.Hash())
+	reader, _, err := ctrl1.Download(bucketHash, "dir/"+name)
+	assert.Nil(t, err)
+	res, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, res))
+
+	// tampered data should be rejected
+	tampered := bytes.Replace(raw, data[10:40], bytes.Repeat([]byte("x"), 30), 1)
+	_, err = NewP2PController(newOfflinePeer()).ImportBucket(bytes.NewReader(tampered))
+	assert.True(t, errors.Is(err, car.BadBlockErr))
+
+	// incomplete DAG should be rejected, and the imported blocks are removed
+	peer2 := newOfflinePeer()
+	defer peer2.Close()
+	ctrl2 := NewP2PController(peer2)
+	cr, err := car.NewReader(bytes.NewReader(raw))
+	assert.Nil(t, err)
+	var incomplete bytes.Buffer
+	cw, err := car.NewWriter(&incomplete, cr.Header.Roots)
+	assert.Nil(t, err)
+	blks := []blocks.Block{}
+	for b, err := cr.Next(); err == nil; b, err = cr.Next() {
+		blks = append(blks, b)
+	}
+	for _, b := range blks[:len(blks)-1] {
+		assert.Nil(t, cw.WriteBlock(b.Cid(), b.RawData()))
+	}
+	_, err = ctrl2.ImportBucket(&incomplete)
+	assert.Equal(t, core.CarNotValidErr, err)
+	has, err := peer2.BlockService().Blockstore().Has(bucket.NodeCid())
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	// forged record should be rejected before any block is stored
+	forged := []byte("not a bucket")
+	recordCid, _ := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}.Sum(forged)
+	junk := blocks.NewBlock([]byte("junk"))
+	incomplete.Reset()
+	cw, err = car.NewWriter(&incomplete, []cid.Cid{recordCid, junk.Cid()})
+	assert.Nil(t, err)
+	assert.Nil(t, cw.WriteBlock(recordCid, forged))
+	assert.Nil(t, cw.WriteBlock(junk.Cid(), junk.RawData()))
+	_, err = ctrl2.ImportBucket(&incomplete)
+	assert.NotNil(t, err)
+	has, err = peer2.BlockService().Blockstore().Has(junk.Cid())
+	assert.Nil(t, err)
+	assert.False(t, has)
+}
+
+func TestArchiveBucket(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	files := map[string][]byte{"a.txt": data, "dir/b.txt": data[:100]}
+	batch, err := ctrl.NewBatch(bucketHash)
+	assert.Nil(t, err)
+	for name, d := range files {
+		dr, err := batch.Add(*core.NewFileHeader(name, "text/plain"), bytes.NewReader(d))
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(len(d)), dr.Header.Size)
+	}
+	_, err = batch.Commit(nil)
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, ctrl.ArchiveBucket(bucketHash, core.ArchiveTarGz, &buf))
+	gr, err := gzip.NewReader(&buf)
+	assert.Nil(t, err)
+	tr := tar.NewReader(gr)
+	count := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+		assert.Equal(t, files[h.Name], content)
+		assert.Equal(t, "text/plain", h.PAXRecords["CBN.content_type"])
+		count++
+	}
+	assert.Equal(t, len(files), count)
+
+	buf.Reset()
+	assert.Nil(t, ctrl.ArchiveBucket(bucketHash, core.ArchiveZip, &buf))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), len(zr.File))
+	for _, f := range zr.File {
+		r, err := f.Open()
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, files[f.Name], content)
+		assert.Equal(t, "text/plain", f.Comment)
+		assert.Equal(t, time.Unix(bucket.Updated(), 0).UTC(), f.Modified.UTC())
+	}
+
+	// archives of the same version are identical
+	var again bytes.Buffer
+	assert.Nil(t, ctrl.ArchiveBucket(bucketHash, core.ArchiveZip, &again))
+	assert.True(t, bytes.Equal(buf.Bytes(), again.Bytes()))
+
+	// names that escape the bucket root are rejected
+	pbs := NewP2PBucketSource(peer)
+	root, err := pbs.NewBucket()
+	assert.Nil(t, err)
+	dir, err := p2pstorage.LoadDir(peer, root.Cid())
+	assert.Nil(t, err)
+	_, nd, err := p2pstorage.AddToDir(peer, dir, "..", root)
+	assert.Nil(t, err)
+	err = pbs.Walk(nd.Cid(), func(p string, dr *core.DataRef) (bool, error) {
+		return true, nil
+	})
+	assert.Equal(t, core.InvalidPathErr, err)
+}
+
+func TestGarbageCollector(t *testing.T) {
+	grace := GCGracePeriod
+	GCGracePeriod = 0
+	defer func() {
+		GCGracePeriod = grace
+	}()
+
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+	gc := NewGarbageCollector(ctrl)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	err = ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", ""), bytes.NewReader(data[:200]), nil)
+	assert.Nil(t, err)
+	err = ctrl.Upload(bucketHash, *core.NewFileHeader("b.txt", ""), bytes.NewReader(data[200:]), nil)
+	assert.Nil(t, err)
+	_, ref, err := ctrl.Download(bucketHash, "a.txt")
+	assert.Nil(t, err)
+	removedCid := ref.NodeCid()
+	assert.Nil(t, ctrl.Remove(bucketHash, "a.txt", nil))
+
+	heads, err := crdtHeads(peer.Store(), crdtPSBucketsTopic)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(heads))
+
+	bstore := peer.BlockService().Blockstore()
+	report, err := gc.Run(true)
+	assert.Nil(t, err)
+	assert.True(t, len(report.Removed) > 0)
+	has, err := bstore.Has(removedCid)
+	assert.Nil(t, err)
+	assert.True(t, has)
+
+	report, err = gc.Run(false)
+	assert.Nil(t, err)
+	assert.True(t, len(report.Removed) > 0)
+	has, err = bstore.Has(removedCid)
+	assert.Nil(t, err)
+	assert.False(t, has)
+
+	reader, _, err := ctrl.Download(bucketHash, "b.txt")
+	assert.Nil(t, err)
+	res, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, data[200:], res)
+
+	// nothing left to collect, crdt is still usable
+	report, err = gc.Run(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(report.Removed))
+	_, err = ctrl.CreateBucket("mybucket2", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ctrl.ListBuckets(nil)))
+}
+
+func TestGarbageCollectorDryRun(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+	gc := NewGarbageCollector(ctrl)
+	gc.RetainVersions = 1
+	reg := ctrl.BucketRegistry().(*P2PBucketRegistry)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	// versions are recorded by their sequence, so versions within the same second are kept
+	_, data := getDummyData()
+	for i := 1; i <= 3; i++ {
+		err = ctrl.Upload(bucketHash, *core.NewFileHeader(fmt.Sprintf("%d.txt", i), ""), bytes.NewReader(data), nil)
+		assert.Nil(t, err)
+	}
+	versions, err := reg.Versions(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(versions))
+
+	// dry-run only reports
+	_, err = gc.Run(true)
+	assert.Nil(t, err)
+	versions, err = reg.Versions(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(versions))
+
+	_, err = gc.Run(false)
+	assert.Nil(t, err)
+	versions, err = reg.Versions(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+}
+
+func TestGarbageCollectorLock(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	_, data := getDummyData()
+
+	// uploads wait for GC
+	unlock := ctrl.GCLock()
+	done := make(chan error)
+	go func() {
+		done <- ctrl.Upload(bucket.Hash(), *core.NewFileHeader("a.txt", ""), bytes.NewReader(data), nil)
+	}()
+	select {
+	case <-done:
+		t.Fatal("upload was not blocked by gc")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	assert.Nil(t, <-done)
+}
+
+func TestPinManager(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+	pins := core.NewPinManager(ctrl, nil)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	err = ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", ""), bytes.NewReader(data), nil)
+	assert.Nil(t, err)
+	_, err = ctrl.CreateBucket("other", nil)
+	assert.Nil(t, err)
+
+	err = pins.Pin(core.Pin{Kind: core.PinHash, Value: bucketHash, Keep: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pins.Pins()))
+	assert.Equal(t, 2, pins.Retention(bucketHash))
+	assert.Nil(t, pins.Fetch(bucketHash))
+	st, ok := pins.StatusOf(bucketHash)
+	assert.True(t, ok)
+	assert.Equal(t, core.PinPinned, st.State)
+	bucket, err = ctrl.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, bucket.NodeCid().String(), st.Node)
+	assert.True(t, st.Blocks > 2)
+	assert.True(t, st.Size > uint64(len(data)))
+	assert.Equal(t, 1, len(pins.Status()))
+
+	// owner pin matches both buckets
+	err = pins.Pin(core.Pin{Kind: core.PinOwner, Value: peer.Host().ID().Pretty()})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(pins.Status()))
+	assert.Equal(t, 2, pins.Retention(bucketHash))
+
+	// pins are persisted
+	assert.Equal(t, 2, len(core.NewPinManager(ctrl, nil).Pins()))
+
+	assert.Nil(t, pins.Unpin(core.PinOwner, peer.Host().ID().Pretty()))
+	assert.Equal(t, 1, len(pins.Status()))
+	assert.Nil(t, pins.Unpin(core.PinHash, bucketHash))
+	_, ok = pins.StatusOf(bucketHash)
+	assert.False(t, ok)
+	assert.Equal(t, 0, pins.Retention(bucketHash))
+}
+
+func TestReplicator(t *testing.T) {
+	peers, err := setupGroup(2, p2pfacade.PNetSecret())
+	assert.Nil(t, err)
+	defer peers[0].Close()
+	defer peers[1].Close()
+	err = peers[0].Host().Connect(context.Background(), peer.AddrInfo{ID: peers[1].Host().ID(), Addrs: peers[1].Host().Addrs()})
+	assert.Nil(t, err)
+
+	replicators := []*Replicator{}
+	for _, p := range peers {
+		ctrl := NewP2PController(p)
+		pins := core.NewPinManager(ctrl, nil)
+		go pins.Start()
+		r := NewReplicator(ctrl, pins)
+		r.Accept = true
+		p.Host().SetStreamHandler(HoldingsProtocol, r.HoldingsHandler())
+		p.Host().SetStreamHandler(ReplicateProtocol, r.ReplicateHandler())
+		replicators = append(replicators, r)
+	}
+	ctrl0 := replicators[0].ctrl
+
+	bucket, err := ctrl0.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	// multiple blocks
+	data = bytes.Repeat(data, 500)
+	err = ctrl0.Upload(bucketHash, *core.NewFileHeader("a.txt", ""), bytes.NewReader(data), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, ctrl0.SetReplicas(bucketHash, 2, nil))
+
+	st, err := replicators[0].Inspect(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, st.Replicas)
+	assert.Equal(t, 1, len(st.Refs))
+	assert.Equal(t, 1, st.UnderReplicated)
+	assert.Equal(t, []string{peers[0].Host().ID().Pretty()}, st.Refs[0].Holders)
+
+	// unknown buckets are not replicated
+	from := peers[0].Host().ID()
+	req := replicationMsg{Bucket: bucketHash, Cids: []string{st.Refs[0].Cid}}
+	assert.Equal(t, 0, len(replicators[1].accept(from, &req)))
+	// the bucket is known once the registry is synced
+	latest, err := ctrl0.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+	assert.Nil(t, replicators[1].ctrl.SaveSignedBucket(latest))
+	// cids must be refs of the bucket, within the limits
+	req.Cids = []string{bucket.NodeCid().String()}
+	assert.Equal(t, 0, len(replicators[1].accept(from, &req)))
+	req.Cids = []string{st.Refs[0].Cid}
+	replicators[1].MaxSize = 100
+	assert.Equal(t, 0, len(replicators[1].accept(from, &req)))
+	replicators[1].MaxSize = 0
+	// partially held DAGs are not reported as holdings
+	assert.Equal(t, 0, len(replicators[1].held(req.Cids)))
+
+	assert.Nil(t, replicators[0].CheckAll())
+	st, err = replicators[0].Status(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{peers[1].Host().ID().Pretty()}, st.Refs[0].Requested)
+
+	dataCid, err := cid.Decode(st.Refs[0].Cid)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		if has, _ := replicators[1].ctrl.HasDag(dataCid); has {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	st, err = replicators[0].Inspect(bucketHash)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, st.UnderReplicated)
+	assert.Equal(t, 2, len(st.Refs[0].Holders))
+
+	// the quota of the peer was used
+	replicators[1].PeerQuota = replicators[1].usage[from]
+	assert.Equal(t, 0, len(replicators[1].accept(from, &req)))
+}
+
+func TestProviderIndex(t *testing.T) {
+	peers, err := setupGroup(2, p2pfacade.PNetSecret())
+	assert.Nil(t, err)
+	defer peers[0].Close()
+	defer peers[1].Close()
+	err = peers[0].Host().Connect(context.Background(), peer.AddrInfo{ID: peers[1].Host().ID(), Addrs: peers[1].Host().Addrs()})
+	assert.Nil(t, err)
+
+	ctrl0, ctrl1 := NewP2PController(peers[0]), NewP2PController(peers[1])
+	idx0, idx1 := NewProviderIndex(ctrl0), NewProviderIndex(ctrl1)
+	go idx0.Start()
+	go idx1.Start()
+	// let the pubsub mesh form
+	time.Sleep(time.Second)
+
+	bucket, err := ctrl0.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	err = ctrl0.Upload(bucketHash, *core.NewFileHeader("a.txt", ""), bytes.NewReader(data), nil)
+	assert.Nil(t, err)
+	_, ref, err := ctrl0.Download(bucketHash, "a.txt")
+	assert.Nil(t, err)
+
+	var provs []peer.AddrInfo
+	for i := 0; i < 50 && len(provs) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		provs = idx1.FindProviders(ref.NodeCid())
+	}
+	assert.Equal(t, 1, len(provs))
+	if len(provs) > 0 {
+		assert.Equal(t, peers[0].Host().ID(), provs[0].ID)
+		assert.True(t, len(provs[0].Addrs) > 0)
+	}
+	assert.Equal(t, 0, len(idx0.FindProviders(ref.NodeCid())))
+
+	// records expire unless re-announced
+	ttl := ProviderTTL
+	ProviderTTL = 50 * time.Millisecond
+	defer func() {
+		ProviderTTL = ttl
+	}()
+	c := ref.NodeCid()
+	idx0.add(peers[1].Host().ID(), &providerMsg{Cids: []string{c.String()}})
+	assert.Equal(t, 1, len(idx0.FindProviders(c)))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(idx0.FindProviders(c)))
+	idx0.expire()
+	assert.Equal(t, 0, len(idx0.records))
+}
+
+func TestDealMaker(t *testing.T) {
+	peers, err := setupGroup(2, p2pfacade.PNetSecret())
+	assert.Nil(t, err)
+	defer peers[0].Close()
+	defer peers[1].Close()
+	err = peers[0].Host().Connect(context.Background(), peer.AddrInfo{ID: peers[1].Host().ID(), Addrs: peers[1].Host().Addrs()})
+	assert.Nil(t, err)
+
+	makers := []*DealMaker{}
+	for _, p := range peers {
+		ctrl := NewP2PController(p)
+		dm := NewDealMaker(ctrl, NewP2PDealRegistry(p), core.NewPinManager(ctrl, nil))
+		dm.Policy = NewDealPolicy(1<<20, 24*time.Hour, 5)
+		p.Host().SetStreamHandler(DealProtocol, dm.ProposalHandler())
+		makers = append(makers, dm)
+	}
+	ctrl0 := makers[0].ctrl
+
+	bucket, err := ctrl0.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	err = ctrl0.Upload(bucketHash, *core.NewFileHeader("a.txt", ""), bytes.NewReader(data), nil)
+	assert.Nil(t, err)
+
+	// the bucket is known once the registry is synced
+	latest, err := ctrl0.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+	assert.Nil(t, makers[1].ctrl.SaveSignedBucket(latest))
+
+	provider := peers[1].Host().ID()
+	// the declared size must cover the actual content
+	priv := peers[0].PrivKey()
+	dp, err := core.NewDealProposal(bucketHash, nil, uint64(len(data))/2, time.Hour, 10, provider, priv.GetPublic())
+	assert.Nil(t, err)
+	assert.Nil(t, dp.Sign(priv))
+	_, err = makers[0].Propose(dp)
+	assert.NotNil(t, err)
+
+	_, err = makers[0].ProposeBucket(provider, bucketHash, time.Hour, 1)
+	assert.NotNil(t, err)
+	_, err = makers[0].ProposeBucket(provider, bucketHash, 48*time.Hour, 10)
+	assert.NotNil(t, err)
+
+	d, err := makers[0].ProposeBucket(provider, bucketHash, time.Hour, 10)
+	if err != nil {
+		t.Fatalf("could not make deal: %s", err.Error())
+	}
+	assert.True(t, d.Proposal().Size() > uint64(len(data)))
+	for _, dm := range makers {
+		saved, err := dm.Registry().Load(d.ID())
+		assert.Nil(t, err)
+		assert.Equal(t, d.Expires(), saved.Expires())
+	}
+	pins := makers[1].pins.Pins()
+	assert.Equal(t, 1, len(pins))
+	assert.Equal(t, core.Pin{Kind: core.PinHash, Value: bucketHash, Expires: d.Expires()}, pins[0])
+
+	// pins are removed once the deal is over
+	err = makers[1].pins.Pin(core.Pin{Kind: core.PinCid, Value: bucket.NodeCid().String(), Expires: time.Now().Unix() - 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(makers[1].pins.Pins()))
+	assert.Nil(t, makers[1].pins.Expire())
+	assert.Equal(t, 1, len(makers[1].pins.Pins()))
+}
+
+func TestStorageProof(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	bucket, err := ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	data = bytes.Repeat(data, 1000)
+	err = ctrl.Upload(bucketHash, *core.NewFileHeader("a.txt", ""), bytes.NewReader(data), nil)
+	assert.Nil(t, err)
+	bucket, err = ctrl.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+
+	bstore := peer.BlockService().Blockstore()
+	getBlock := func(c cid.Cid) ([]byte, error) {
+		b, err := bstore.Get(c)
+		if err != nil {
+			return nil, err
+		}
+		return b.RawData(), nil
+	}
+	err = ctrl.BucketSource().Walk(bucket.NodeCid(), func(p string, dr *core.DataRef) (bool, error) {
+		for i := uint64(0); i < 4; i++ {
+			ch := Challenge{Cid: dr.NodeCid().String(), Index: i, Nonce: []byte(fmt.Sprintf("nonce-%d", i))}
+			proof, err := CreateProof(bstore, &ch)
+			assert.Nil(t, err)
+			assert.True(t, len(proof.Blocks) > 0)
+			assert.Nil(t, VerifyProof(&ch, proof, getBlock))
+
+			other := ch
+			other.Nonce = []byte("other")
+			assert.Equal(t, ProofNotValidErr, VerifyProof(&other, proof, getBlock))
+			other = ch
+			other.Index = i + 1
+			assert.Equal(t, ProofNotValidErr, VerifyProof(&other, proof, getBlock))
+
+			tampered := *proof
+			tampered.Blocks = [][]byte{append([]byte{0}, proof.Blocks[0]...)}
+			assert.Equal(t, ProofNotValidErr, VerifyProof(&ch, &tampered, getBlock))
+
+			// a proof that stops before the leaf (e.g. of the root only) is rejected
+			root, err := getBlock(dr.NodeCid())
+			assert.Nil(t, err)
+			rootOnly := StorageProof{Blocks: [][]byte{}, Digest: proofDigest(ch.Nonce, root)}
+			assert.Equal(t, ProofNotValidErr, VerifyProof(&ch, &rootOnly, getBlock))
+			short := StorageProof{Blocks: proof.Blocks[:len(proof.Blocks)-1], Digest: proof.Digest}
+			assert.Equal(t, ProofNotValidErr, VerifyProof(&ch, &short, getBlock))
+		}
+		return true, nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestAuditor(t *testing.T) {
+	peers, err := setupGroup(2, p2pfacade.PNetSecret())
+	assert.Nil(t, err)
+	defer peers[0].Close()
+	defer peers[1].Close()
+	err = peers[0].Host().Connect(context.Background(), peer.AddrInfo{ID: peers[1].Host().ID(), Addrs: peers[1].Host().Addrs()})
+	assert.Nil(t, err)
+
+	for _, p := range peers {
+		p.Host().SetStreamHandler(ChallengeProtocol, ChallengeHandler(p))
+	}
+	ctrl0 := NewP2PController(peers[0])
+	ctrl1 := NewP2PController(peers[1])
+	aud := NewAuditor(ctrl0, NewP2PDealRegistry(peers[0]))
+
+	bucket, err := ctrl1.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	bucketHash := bucket.Hash()
+	_, data := getDummyData()
+	err = ctrl1.Upload(bucketHash, *core.NewFileHeader("a.txt", ""), bytes.NewReader(bytes.Repeat(data, 1000)), nil)
+	assert.Nil(t, err)
+	bucket, err = ctrl1.BucketRegistry().Load(bucketHash)
+	assert.Nil(t, err)
+
+	holder := peers[1].Host().ID()
+	res, err := aud.Audit(holder, bucket.NodeCid())
+	assert.Nil(t, err)
+	assert.True(t, res.Passed, res.Error)
+
+	// the holder does not have the blocks of the other peer
+	other, err := ctrl0.CreateBucket("other", nil)
+	assert.Nil(t, err)
+	otherHash := other.Hash()
+	err = ctrl0.Upload(otherHash, *core.NewFileHeader("b.txt", ""), bytes.NewReader(bytes.Repeat(data, 10)), nil)
+	assert.Nil(t, err)
+	other, err = ctrl0.BucketRegistry().Load(otherHash)
+	assert.Nil(t, err)
+	res, err = aud.Audit(holder, other.NodeCid())
+	assert.Nil(t, err)
+	assert.False(t, res.Passed)
+
+	results, err := aud.Results(holder.Pretty())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	results, err = aud.Results(peers[0].Host().ID().Pretty())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(results))
+}
+
+func TestLedger(t *testing.T) {
+	peers, err := setupGroup(2, p2pfacade.PNetSecret())
+	assert.Nil(t, err)
+	defer peers[0].Close()
+	defer peers[1].Close()
+	err = peers[0].Host().Connect(context.Background(), peer.AddrInfo{ID: peers[1].Host().ID(), Addrs: peers[1].Host().Addrs()})
+	assert.Nil(t, err)
+
+	ledgers := []*Ledger{}
+	for _, p := range peers {
+		l := NewLedger(p)
+		p.Host().SetStreamHandler(ReceiptProtocol, l.ReceiptHandler())
+		ledgers = append(ledgers, l)
+	}
+	_, data := getDummyData()
+	proto := protocol.ID("/test/ledger/0.0.1")
+	peers[1].Host().SetStreamHandler(proto, ledgers[1].Handler(func(stream network.Stream) {
+		defer stream.Close()
+		stream.Write(data)
+	}))
+	download := func() ([]byte, error) {
+		stream, err := ledgers[0].NewStream(context.Background(), peers[1].Host().ID(), proto)
+		if err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+		return ioutil.ReadAll(stream)
+	}
+	consumer, provider := peers[0].Host().ID(), peers[1].Host().ID()
+
+	res, err := download()
+	assert.Nil(t, err)
+	assert.Equal(t, data, res)
+	n := uint64(len(data))
+	assert.Equal(t, n, ledgers[1].Account(consumer).Sent)
+	assert.Equal(t, n, ledgers[1].Account(consumer).Debt())
+	assert.Equal(t, n, ledgers[0].Account(provider).Received)
+
+	assert.Nil(t, ledgers[0].SendReceipts())
+	assert.Equal(t, n, ledgers[0].Account(provider).Receipted)
+	assert.Equal(t, uint64(0), ledgers[1].Account(consumer).Debt())
+	r, err := ledgers[1].Receipt(consumer)
+	assert.Nil(t, err)
+	assert.Equal(t, n, r.Bytes())
+	// receipts are accepted only from the consumer itself
+	assert.Equal(t, core.ReceiptNotValidErr, ledgers[1].Acknowledge(provider, mustSerializeReceipt(t, peers[0], provider, n)))
+
+	// throttled once the debt exceeds the limit
+	ledgers[1].DebtLimit = n / 2
+	_, err = download()
+	assert.Nil(t, err)
+	assert.True(t, ledgers[1].Throttled(consumer))
+	res, err = download()
+	assert.True(t, err != nil || len(res) == 0)
+
+	assert.Nil(t, ledgers[1].Flush())
+	reloaded := NewLedger(peers[1])
+	assert.Equal(t, ledgers[1].Account(consumer), reloaded.Account(consumer))
+}
+
+func TestLedgerExchange(t *testing.T) {
+	peers, err := setupGroup(2, p2pfacade.PNetSecret())
+	assert.Nil(t, err)
+	defer peers[0].Close()
+	defer peers[1].Close()
+	err = peers[0].Host().Connect(context.Background(), peer.AddrInfo{ID: peers[1].Host().ID(), Addrs: peers[1].Host().Addrs()})
+	assert.Nil(t, err)
+
+	_, data := getDummyData()
+	proto := protocol.ID("/test/ledger/0.0.1")
+	ledgers := []*Ledger{}
+	for _, p := range peers {
+		l := NewLedger(p)
+		l.DebtLimit = uint64(len(data)) * 2
+		p.Host().SetStreamHandler(ReceiptProtocol, l.ReceiptHandler())
+		p.Host().SetStreamHandler(proto, l.Handler(func(stream network.Stream) {
+			defer stream.Close()
+			stream.Write(data)
+		}))
+		ledgers = append(ledgers, l)
+	}
+
+	// both peers download from each other way beyond the limit, and send receipts in between
+	for i := 0; i < 5; i++ {
+		for j, l := range ledgers {
+			remote := peers[1-j].Host().ID()
+			stream, err := l.NewStream(context.Background(), remote, proto)
+			assert.Nil(t, err)
+			res, err := ioutil.ReadAll(stream)
+			stream.Close()
+			assert.Nil(t, err)
+			assert.Equal(t, data, res)
+		}
+		for _, l := range ledgers {
+			assert.Nil(t, l.SendReceipts())
+		}
+	}
+	for j, l := range ledgers {
+		remote := peers[1-j].Host().ID()
+		assert.False(t, l.Throttled(remote))
+		assert.Equal(t, uint64(5*len(data)), l.Account(remote).Sent)
+		assert.Equal(t, uint64(5*len(data)), l.Account(remote).Acknowledged)
+	}
+}
+
+func mustSerializeReceipt(t *testing.T, p *p2pstorage.MultiStorePeer, provider peer.ID, n uint64) []byte {
+	r, err := core.NewReceipt(provider, n, p.PrivKey().GetPublic())
+	assert.Nil(t, err)
+	assert.Nil(t, r.Sign(p.PrivKey()))
+	raw, err := core.SerializeReceipt(r)
+	assert.Nil(t, err)
+	return raw
+}
+
+func TestCrdtSyncStatus(t *testing.T) {
+	peer := newOfflinePeer()
+	defer peer.Close()
+	ctrl := NewP2PController(peer)
+
+	statuses, err := CrdtSyncStatus(peer)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(statuses))
+	assert.Equal(t, 0, len(statuses[0].Heads))
+
+	_, err = ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	statuses, err = CrdtSyncStatus(peer)
+	assert.Nil(t, err)
+	assert.Equal(t, crdtPSBucketsTopic, statuses[0].Name)
+	assert.Equal(t, 1, len(statuses[0].Heads))
+	assert.Equal(t, uint64(1), statuses[0].Height)
+	assert.True(t, statuses[0].Synced())
+
+	// heads that are not available locally are missing
+	head, err := cid.Decode(statuses[0].Heads[0])
+	assert.Nil(t, err)
+	assert.Nil(t, peer.BlockService().Blockstore().DeleteBlock(head))
+	statuses, err = CrdtSyncStatus(peer)
+	assert.Nil(t, err)
+	assert.False(t, statuses[0].Synced())
+}
+
+func TestHeadTracker(t *testing.T) {
+	p := newOfflinePeer()
+	defer p.Close()
+	ctrl := NewP2PController(p)
+	ht, err := NewHeadTracker(p)
+	assert.Nil(t, err)
+
+	_, err = ctrl.CreateBucket("mybucket", nil)
+	assert.Nil(t, err)
+	statuses, err := ht.Status()
+	assert.Nil(t, err)
+	assert.True(t, statuses[0].Synced())
+	assert.Equal(t, int64(0), statuses[0].LastAnnounce)
+
+	// heads that remote peers announced must be available locally
+	local, err := cid.Decode(statuses[0].Heads[0])
+	assert.Nil(t, err)
+	remote, err := cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("remote"))
+	assert.Nil(t, err)
+	other := peer.ID("remote")
+	ht.announce(crdtPSBucketsTopic, other, []cid.Cid{remote})
+	statuses, err = ht.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, statuses[0].Announced)
+	assert.True(t, statuses[0].LastAnnounce > 0)
+	assert.False(t, statuses[0].Synced())
+
+	ht.announce(crdtPSBucketsTopic, other, []cid.Cid{local})
+	statuses, err = ht.Status()
+	assert.Nil(t, err)
+	assert.True(t, statuses[0].Synced())
+	assert.Equal(t, int64(0), statuses[1].LastAnnounce)
+}
+
+func getNames(pbs *P2PBucketSource, c cid.Cid, dirPath string) ([]string, error) {
+	names := []string{}
+	err := pbs.ForEachName(c, dirPath, func(name string) (bool, error) {
+		names = append(names, name)
+		return true, nil
+	})
+	return names, err
+}
+
+func newOfflinePeer() *p2pstorage.MultiStorePeer {
+	priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	cfg := p2pfacade.NewConfig(priv, p2pfacade.PNetSecret(), nil)
+	base := p2pfacade.NewBasePeer(context.Background(), cfg)
+	return p2pstorage.NewMultiStorePeer(p2pstorage.NewStoragePeer(base, true))
+}
+
 func setupGroup(n int, psk pnet.PSK) ([]*p2pstorage.MultiStorePeer, error) {
 	peers := []*p2pstorage.MultiStorePeer{}
 	_, err := p2pfacade.SetupGroup(n, func() p2pfacade.LibP2PPeer {
-		priv, _, _ := crypto.GenerateKeyPair(crypto.RSA, 2048)
+		priv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
 
 		cfg := p2pfacade.NewConfig(priv, psk, nil)
 		base := p2pfacade.NewBasePeer(context.Background(), cfg)
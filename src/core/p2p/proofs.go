@@ -0,0 +1,205 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+	"log"
+	"time"
+)
+
+var (
+	// ChallengeTimeout limits the time of a single challenge
+	ChallengeTimeout = 30 * time.Second
+	// ChallengeNonceSize is the size of random nonces
+	ChallengeNonceSize = 32
+
+	ProofNotValidErr = errors.New("storage proof is not valid")
+)
+
+// Challenge asks a holder to prove that it stores the DAG of the given cid.
+// the challenged block is selected by the index: in each level of the DAG,
+// the child at (index mod links) is selected and the index is divided by the amount of links
+type Challenge struct {
+	Cid   string
+	Index uint64
+	Nonce []byte
+}
+
+// StorageProof is the response of a holder to a challenge
+type StorageProof struct {
+	// Blocks are the raw blocks of the path from the root to the challenged block (excluded)
+	Blocks [][]byte
+	// Digest is the hash of the nonce and the challenged block
+	Digest []byte
+	Error  string `json:",omitempty"`
+}
+
+// blockGetter is satisfied by blockstores
+type blockGetter interface {
+	Get(cid.Cid) (blocks.Block, error)
+}
+
+// proofDigest hashes the given nonce and block data
+func proofDigest(nonce, data []byte) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// CreateProof creates a proof for the given challenge out of the given blocks (usually the local blockstore)
+func CreateProof(bs blockGetter, ch *Challenge) (*StorageProof, error) {
+	c, err := cid.Decode(ch.Cid)
+	if err != nil {
+		return nil, err
+	}
+	proof := StorageProof{Blocks: [][]byte{}}
+	index := ch.Index
+	for {
+		b, err := bs.Get(c)
+		if err != nil {
+			return nil, err
+		}
+		nd, err := ipld.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+		links := nd.Links()
+		if len(links) == 0 {
+			proof.Digest = proofDigest(ch.Nonce, b.RawData())
+			return &proof, nil
+		}
+		proof.Blocks = append(proof.Blocks, b.RawData())
+		c = links[index%uint64(len(links))].Cid
+		index /= uint64(len(links))
+	}
+}
+
+// decodeProofBlock checks that the given raw block matches the cid, and returns its links
+func decodeProofBlock(c cid.Cid, raw []byte) ([]*ipld.Link, error) {
+	expected, err := c.Prefix().Sum(raw)
+	if err != nil || !expected.Equals(c) {
+		return nil, ProofNotValidErr
+	}
+	b, err := blocks.NewBlockWithCid(raw, c)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := ipld.Decode(b)
+	if err != nil {
+		return nil, ProofNotValidErr
+	}
+	return nd.Links(), nil
+}
+
+// VerifyProof checks that the path of the given proof matches the challenge,
+// and that the digest was made out of the challenged block, that is loaded with the given function.
+// the path must lead all the way to a leaf, i.e. the challenged block must have no links
+func VerifyProof(ch *Challenge, proof *StorageProof, getBlock func(cid.Cid) ([]byte, error)) error {
+	c, err := cid.Decode(ch.Cid)
+	if err != nil {
+		return err
+	}
+	index := ch.Index
+	for _, raw := range proof.Blocks {
+		links, err := decodeProofBlock(c, raw)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			return ProofNotValidErr
+		}
+		c = links[index%uint64(len(links))].Cid
+		index /= uint64(len(links))
+	}
+	data, err := getBlock(c)
+	if err != nil {
+		return err
+	}
+	// a shorter path would end in an inner block, which the holder might not store the children of
+	links, err := decodeProofBlock(c, data)
+	if err != nil {
+		return err
+	}
+	if len(links) > 0 {
+		return ProofNotValidErr
+	}
+	if !bytes.Equal(proofDigest(ch.Nonce, data), proof.Digest) {
+		return ProofNotValidErr
+	}
+	return nil
+}
+
+// ChallengeHandler responds to challenges with proofs, only local blocks are used
+func ChallengeHandler(peer *p2pstorage.MultiStorePeer) network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		msg, err := msgio.NewReader(bufio.NewReader(stream)).ReadMsg()
+		if err != nil {
+			log.Println("could not read challenge:", err)
+			stream.Reset()
+			return
+		}
+		var ch Challenge
+		proof := &StorageProof{}
+		if err = json.Unmarshal(msg, &ch); err != nil {
+			proof.Error = err.Error()
+		} else if proof, err = CreateProof(peer.BlockService().Blockstore(), &ch); err != nil {
+			proof = &StorageProof{Error: err.Error()}
+		}
+		raw, err := json.Marshal(proof)
+		if err != nil {
+			log.Println("could not marshal proof:", err)
+			stream.Reset()
+			return
+		}
+		if err = msgio.NewWriter(stream).WriteMsg(raw); err != nil {
+			log.Println("could not send proof:", err)
+			stream.Reset()
+		}
+	}
+}
+
+// SendChallenge sends the given challenge to the holder and returns its proof
+func SendChallenge(p *p2pstorage.MultiStorePeer, holder peer.ID, ch *Challenge) (*StorageProof, error) {
+	raw, err := json.Marshal(ch)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(p.Context(), ChallengeTimeout)
+	defer cancel()
+	stream, err := p.Host().NewStream(ctx, holder, ChallengeProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(ChallengeTimeout))
+
+	if err = msgio.NewWriter(stream).WriteMsg(raw); err != nil {
+		return nil, err
+	}
+	msg, err := msgio.NewReader(bufio.NewReader(stream)).ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	var proof StorageProof
+	if err = json.Unmarshal(msg, &proof); err != nil {
+		return nil, err
+	}
+	if len(proof.Error) > 0 {
+		return nil, errors.New(proof.Error)
+	}
+	return &proof, nil
+}
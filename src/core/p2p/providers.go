@@ -0,0 +1,333 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/amirylm/cbn/src/core"
+	p2pfacade "github.com/amirylm/libp2p-facade/core"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/multiformats/go-multiaddr"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ProviderTTL is the time that provider records are valid, unless they are re-announced
+	ProviderTTL = 24 * time.Hour
+	// ProviderReannounceInterval is the interval of re-announcing the local records
+	ProviderReannounceInterval = 12 * time.Hour
+	// ProviderAnnounceBatchSize is the max amount of cids in a single announcement
+	ProviderAnnounceBatchSize = 1000
+	// ProvidersPerFetch is the max amount of providers to connect before fetching some content
+	ProvidersPerFetch = 3
+	// ProviderConnectTimeout limits the time of connecting to a provider
+	ProviderConnectTimeout = 10 * time.Second
+)
+
+const (
+	providersTopic = "cbn_providers"
+)
+
+// providerMsg is the announcement of a provider, the provider is the sender of the pubsub message
+type providerMsg struct {
+	Addrs []string
+	Cids  []string
+	// TTL in seconds
+	TTL int64
+}
+
+// ProviderIndex is a gossip (pubsub) based index of the peers that hold buckets and data.
+// nodes announce the bucket root cids and DataRef cids that they hold locally,
+// announcements are re-published periodically and expire after the TTL
+type ProviderIndex struct {
+	lock sync.RWMutex
+
+	peer *p2pstorage.MultiStorePeer
+	ctrl *core.Controller
+
+	// records maps a cid to its providers and the expiration of each record
+	records map[string]map[peer.ID]time.Time
+
+	providers []GCRootsProvider
+}
+
+// NewProviderIndex creates a new index, the data and bucket sources of the given controller
+// use the index to connect providers before fetching content.
+// the sources are not synchronized, therefore the index must be created before the controller is used concurrently
+func NewProviderIndex(ctrl *core.Controller) *ProviderIndex {
+	idx := ProviderIndex{
+		peer:      ctrl.Peer(),
+		ctrl:      ctrl,
+		records:   map[string]map[peer.ID]time.Time{},
+		providers: []GCRootsProvider{},
+	}
+	if pds, ok := ctrl.DataSource().(*P2PDataSource); ok {
+		pds.providers = &idx
+	}
+	if pbs, ok := ctrl.BucketSource().(*P2PBucketSource); ok {
+		pbs.providers = &idx
+	}
+
+	return &idx
+}
+
+// AddRoots registers a provider of additional roots that should be announced once they are local (e.g. pins)
+func (idx *ProviderIndex) AddRoots(provider GCRootsProvider) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.providers = append(idx.providers, provider)
+}
+
+// Start listens to announcements and bucket changes, and re-announces local content, until the peer is closed
+func (idx *ProviderIndex) Start() error {
+	sub, err := p2pfacade.Subscribe(idx.peer, providersTopic)
+	if err != nil {
+		return err
+	}
+	defer sub.Cancel()
+	go idx.listen(sub)
+
+	events, cancel := idx.ctrl.SubscribeBuckets(nil)
+	defer cancel()
+
+	if err := idx.AnnounceAll(); err != nil {
+		log.Println("could not announce providers:", err)
+	}
+	ticker := time.NewTicker(ProviderReannounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-idx.peer.Context().Done():
+			return nil
+		case <-ticker.C:
+			idx.expire()
+			if err := idx.AnnounceAll(); err != nil {
+				log.Println("could not announce providers:", err)
+			}
+		case evt, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if evt.Bucket == nil {
+				continue
+			}
+			cids, err := idx.localBucketCids(evt.Bucket)
+			if err != nil {
+				log.Printf("could not collect cids of bucket %s: %s", evt.Hash, err.Error())
+				continue
+			}
+			if err := idx.Announce(cids...); err != nil {
+				log.Println("could not announce providers:", err)
+			}
+		}
+	}
+}
+
+func (idx *ProviderIndex) listen(sub *pubsub.Subscription) {
+	self := idx.peer.Host().ID()
+	for {
+		msg, err := sub.Next(idx.peer.Context())
+		if err != nil {
+			return
+		}
+		from := msg.GetFrom()
+		if from == self {
+			continue
+		}
+		var pmsg providerMsg
+		if err := json.Unmarshal(msg.Data, &pmsg); err != nil {
+			log.Printf("could not parse provider announcement of %s: %s", from.Pretty(), err.Error())
+			continue
+		}
+		idx.add(from, &pmsg)
+	}
+}
+
+// add saves the records of the given announcement
+func (idx *ProviderIndex) add(from peer.ID, pmsg *providerMsg) {
+	ttl := time.Duration(pmsg.TTL) * time.Second
+	if ttl <= 0 || ttl > ProviderTTL {
+		ttl = ProviderTTL
+	}
+	addrs := []multiaddr.Multiaddr{}
+	for _, a := range pmsg.Addrs {
+		if ma, err := multiaddr.NewMultiaddr(a); err == nil {
+			addrs = append(addrs, ma)
+		}
+	}
+	idx.peer.Host().Peerstore().AddAddrs(from, addrs, ttl)
+
+	expires := time.Now().Add(ttl)
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	for _, c := range pmsg.Cids {
+		if _, err := cid.Decode(c); err != nil {
+			continue
+		}
+		if _, ok := idx.records[c]; !ok {
+			idx.records[c] = map[peer.ID]time.Time{}
+		}
+		idx.records[c][from] = expires
+	}
+}
+
+// expire removes expired records
+func (idx *ProviderIndex) expire() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	now := time.Now()
+	for c, provs := range idx.records {
+		for p, expires := range provs {
+			if now.After(expires) {
+				delete(provs, p)
+			}
+		}
+		if len(provs) == 0 {
+			delete(idx.records, c)
+		}
+	}
+}
+
+// FindProviders returns the known (remote) providers of the given cid, freshest records first
+func (idx *ProviderIndex) FindProviders(c cid.Cid) []peer.AddrInfo {
+	idx.lock.RLock()
+	provs := idx.records[c.String()]
+	now := time.Now()
+	type record struct {
+		pid     peer.ID
+		expires time.Time
+	}
+	valid := []record{}
+	for p, expires := range provs {
+		if now.Before(expires) {
+			valid = append(valid, record{p, expires})
+		}
+	}
+	idx.lock.RUnlock()
+
+	sort.Slice(valid, func(i, j int) bool {
+		return valid[i].expires.After(valid[j].expires)
+	})
+	res := []peer.AddrInfo{}
+	for _, r := range valid {
+		res = append(res, idx.peer.Host().Peerstore().PeerInfo(r.pid))
+	}
+	return res
+}
+
+// connect connects to providers of the given cid, if it is not available locally.
+// nothing is done if some provider is already connected, as the block exchange will reach it
+func (idx *ProviderIndex) connect(c cid.Cid) {
+	if has, err := idx.peer.BlockService().Blockstore().Has(c); err != nil || has {
+		return
+	}
+	net := idx.peer.Host().Network()
+	toConnect := []peer.AddrInfo{}
+	for _, pi := range idx.FindProviders(c) {
+		if len(net.ConnsToPeer(pi.ID)) > 0 {
+			// bitswap will ask connected peers
+			return
+		}
+		if len(toConnect) < ProvidersPerFetch {
+			toConnect = append(toConnect, pi)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, pi := range toConnect {
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(idx.peer.Context(), ProviderConnectTimeout)
+			defer cancel()
+			if err := idx.peer.Host().Connect(ctx, pi); err != nil {
+				log.Printf("could not connect provider %s: %s", pi.ID.Pretty(), err.Error())
+			}
+		}(pi)
+	}
+	wg.Wait()
+}
+
+// Announce publishes provider records of the given cids
+func (idx *ProviderIndex) Announce(cids ...cid.Cid) error {
+	addrs := []string{}
+	for _, a := range idx.peer.Host().Addrs() {
+		addrs = append(addrs, a.String())
+	}
+	for len(cids) > 0 {
+		n := len(cids)
+		if n > ProviderAnnounceBatchSize {
+			n = ProviderAnnounceBatchSize
+		}
+		pmsg := providerMsg{Addrs: addrs, Cids: []string{}, TTL: int64(ProviderTTL / time.Second)}
+		for _, c := range cids[:n] {
+			pmsg.Cids = append(pmsg.Cids, c.String())
+		}
+		raw, err := json.Marshal(&pmsg)
+		if err != nil {
+			return err
+		}
+		if err = p2pfacade.Publish(idx.peer, idx.peer.Context(), providersTopic, raw); err != nil {
+			return err
+		}
+		cids = cids[n:]
+	}
+	return nil
+}
+
+// AnnounceAll publishes provider records of all the local buckets, data and additional roots
+func (idx *ProviderIndex) AnnounceAll() error {
+	cids := []cid.Cid{}
+	err := idx.ctrl.BucketRegistry().ForEach(func(hash string, b *core.Bucket) (bool, error) {
+		bcids, err := idx.localBucketCids(b)
+		if err != nil {
+			return false, err
+		}
+		cids = append(cids, bcids...)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.lock.RLock()
+	providers := idx.providers
+	idx.lock.RUnlock()
+	bstore := idx.peer.BlockService().Blockstore()
+	for _, provider := range providers {
+		roots, err := provider()
+		if err != nil {
+			return err
+		}
+		for _, c := range roots {
+			if has, err := bstore.Has(c); err == nil && has {
+				cids = append(cids, c)
+			}
+		}
+	}
+	return idx.Announce(cids...)
+}
+
+// localBucketCids returns the bucket root and DataRef cids of the given bucket that are available locally,
+// only local blocks are visited
+func (idx *ProviderIndex) localBucketCids(b *core.Bucket) ([]cid.Cid, error) {
+	bstore := idx.peer.BlockService().Blockstore()
+	cids := []cid.Cid{}
+	m := marker{bstore: bstore, marked: map[string]bool{}, onRef: func(c cid.Cid) error {
+		if has, err := bstore.Has(c); err == nil && has {
+			cids = append(cids, c)
+		}
+		return nil
+	}}
+	if has, err := bstore.Has(b.NodeCid()); err != nil || !has {
+		return cids, err
+	}
+	cids = append(cids, b.NodeCid())
+	return cids, m.markEntry(b.NodeCid())
+}
@@ -0,0 +1,414 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/amirylm/cbn/src/core"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-msgio"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ReplicationRequestTimeout limits the time of a single request to another node
+	ReplicationRequestTimeout = 30 * time.Second
+)
+
+// ReplicaStatus describes the holders of a single DataRef
+type ReplicaStatus struct {
+	Path string `json:"path"`
+	Cid  string `json:"cid"`
+	// Holders are the peers that currently hold the data (including the local peer)
+	Holders []string `json:"holders"`
+	// Requested are the peers that were asked to replicate the data in the last check
+	Requested []string `json:"requested,omitempty"`
+}
+
+// ReplicationStatus describes the replication of a bucket
+type ReplicationStatus struct {
+	Hash     string          `json:"hash"`
+	Replicas int             `json:"replicas"`
+	Refs     []ReplicaStatus `json:"refs"`
+	// UnderReplicated is the amount of refs with less holders than desired
+	UnderReplicated int   `json:"under_replicated"`
+	Checked         int64 `json:"checked"`
+}
+
+// replicationMsg is used for both requests and responses of the replication protocols,
+// replication requests must specify the bucket of the cids
+type replicationMsg struct {
+	Bucket string `json:",omitempty"`
+	Cids   []string
+}
+
+// Replicator enforces the desired amount of replicas of buckets that are owned by the local peer (or its identities).
+// storage nodes advertise the data they hold (HoldingsProtocol),
+// and under-replicated DataRefs are pinned by additional nodes upon request (ReplicateProtocol).
+// holders that disappear are not counted, and therefore their data is re-replicated in the next check
+type Replicator struct {
+	lock sync.RWMutex
+
+	peer *p2pstorage.MultiStorePeer
+	ctrl *core.Controller
+	pins *core.PinManager
+
+	// Accept determines whether replication requests of other nodes are accepted
+	Accept bool
+	// MaxSize is the max size (bytes) of a single replicated DataRef, 0 for no limit
+	MaxSize uint64
+	// PeerQuota is the max amount of bytes that are replicated on behalf of a single peer, 0 for no limit
+	PeerQuota uint64
+
+	status map[string]*ReplicationStatus
+	// usage is the amount of bytes that were replicated on behalf of each peer
+	usage   map[peer.ID]uint64
+	trigger chan struct{}
+}
+
+func NewReplicator(ctrl *core.Controller, pins *core.PinManager) *Replicator {
+	r := Replicator{
+		peer:    ctrl.Peer(),
+		ctrl:    ctrl,
+		pins:    pins,
+		status:  map[string]*ReplicationStatus{},
+		usage:   map[peer.ID]uint64{},
+		trigger: make(chan struct{}, 1),
+	}
+
+	return &r
+}
+
+// HoldingsHandler returns the cids (out of the requested ones) that are held by the local peer,
+// a cid is considered as held once its entire DAG is available locally
+func (r *Replicator) HoldingsHandler() network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		req, err := readReplicationMsg(stream)
+		if err != nil {
+			log.Println("could not read holdings request:", err)
+			stream.Reset()
+			return
+		}
+		res := replicationMsg{Cids: r.held(req.Cids)}
+		if err := writeReplicationMsg(stream, &res); err != nil {
+			log.Println("could not send holdings response:", err)
+			stream.Reset()
+		}
+	}
+}
+
+// ReplicateHandler pins the requested cids and returns the accepted ones.
+// cids are accepted only if they are DataRefs of the requested (known) bucket,
+// within MaxSize and the PeerQuota of the requesting peer
+func (r *Replicator) ReplicateHandler() network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+
+		req, err := readReplicationMsg(stream)
+		if err != nil {
+			log.Println("could not read replicate request:", err)
+			stream.Reset()
+			return
+		}
+		res := replicationMsg{Bucket: req.Bucket, Cids: []string{}}
+		if r.Accept {
+			res.Cids = r.accept(stream.Conn().RemotePeer(), req)
+		}
+		if err := writeReplicationMsg(stream, &res); err != nil {
+			log.Println("could not send replicate response:", err)
+			stream.Reset()
+		}
+	}
+}
+
+// accept pins the cids of the given request that meet the replication policy
+func (r *Replicator) accept(from peer.ID, req *replicationMsg) []string {
+	accepted := []string{}
+	refs, err := r.refs(req.Bucket)
+	if err != nil {
+		log.Printf("could not replicate bucket %s of %s: %s", req.Bucket, from.Pretty(), err.Error())
+		return accepted
+	}
+	ctx, cancel := context.WithTimeout(r.peer.Context(), ReplicationRequestTimeout)
+	defer cancel()
+	for _, s := range req.Cids {
+		c, ok := refs[s]
+		if !ok {
+			log.Printf("could not replicate %s of %s: not a ref of bucket %s", s, from.Pretty(), req.Bucket)
+			continue
+		}
+		// the actual size is checked, as sizes in data refs are declared by the owner
+		size, err := r.ctrl.DagSize(ctx, r.MaxSize, c)
+		if err != nil {
+			log.Printf("could not replicate %s of %s: %s", s, from.Pretty(), err.Error())
+			continue
+		}
+		r.lock.Lock()
+		within := r.PeerQuota == 0 || r.usage[from]+size <= r.PeerQuota
+		if within {
+			r.usage[from] += size
+		}
+		r.lock.Unlock()
+		if !within {
+			log.Printf("could not replicate %s of %s: quota exceeded", s, from.Pretty())
+			continue
+		}
+		if err := r.pins.Pin(core.Pin{Kind: core.PinCid, Value: s}); err != nil {
+			log.Printf("could not pin %s: %s", s, err.Error())
+			continue
+		}
+		accepted = append(accepted, s)
+	}
+	return accepted
+}
+
+// refs returns the data roots of the DataRefs of the given bucket, by their string form
+func (r *Replicator) refs(hash string) (map[string]cid.Cid, error) {
+	bucket, err := r.ctrl.BucketRegistry().Load(hash)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]cid.Cid{}
+	err = r.ctrl.BucketSource().Walk(bucket.NodeCid(), func(p string, dr *core.DataRef) (bool, error) {
+		refs[dr.NodeCid().String()] = dr.NodeCid()
+		return true, nil
+	})
+	return refs, err
+}
+
+// held returns the given cids whose entire DAG is available locally
+func (r *Replicator) held(cids []string) []string {
+	res := []string{}
+	for _, s := range cids {
+		c, err := cid.Decode(s)
+		if err != nil {
+			continue
+		}
+		if has, err := r.ctrl.HasDag(c); err == nil && has {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// Start checks the owned buckets periodically, and once a peer was disconnected, until the peer is closed
+func (r *Replicator) Start(interval time.Duration) {
+	notifee := network.NotifyBundle{
+		DisconnectedF: func(network.Network, network.Conn) {
+			select {
+			case r.trigger <- struct{}{}:
+			default:
+			}
+		},
+	}
+	r.peer.Host().Network().Notify(&notifee)
+	defer r.peer.Host().Network().StopNotify(&notifee)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.peer.Context().Done():
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+		if err := r.CheckAll(); err != nil {
+			log.Println("could not check replication:", err)
+		}
+	}
+}
+
+// CheckAll checks (and replicates) all the buckets that are owned by the local peer and declare replicas
+func (r *Replicator) CheckAll() error {
+	hashes := []string{}
+	err := r.ctrl.BucketRegistry().ForEach(func(hash string, b *core.Bucket) (bool, error) {
+		if b.Replicas() == 0 {
+			return true, nil
+		}
+		if r.ctrl.Owns(b.Authority()) {
+			hashes = append(hashes, hash)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := r.Check(hash); err != nil {
+			log.Printf("could not check replication of bucket %s: %s", hash, err.Error())
+		}
+	}
+	return nil
+}
+
+// Check looks for the holders of the data of the given bucket,
+// and asks additional nodes to replicate under-replicated data
+func (r *Replicator) Check(hash string) (*ReplicationStatus, error) {
+	return r.check(hash, true)
+}
+
+// Inspect looks for the holders of the data of the given bucket w/o replicating
+func (r *Replicator) Inspect(hash string) (*ReplicationStatus, error) {
+	return r.check(hash, false)
+}
+
+// Status returns the status of the last check, the bucket is inspected if it wasn't checked yet
+func (r *Replicator) Status(hash string) (*ReplicationStatus, error) {
+	r.lock.RLock()
+	st, ok := r.status[hash]
+	r.lock.RUnlock()
+	if ok {
+		return st, nil
+	}
+	return r.Inspect(hash)
+}
+
+func (r *Replicator) check(hash string, replicate bool) (*ReplicationStatus, error) {
+	bucket, err := r.ctrl.BucketRegistry().Load(hash)
+	if err != nil {
+		return nil, err
+	}
+	st := ReplicationStatus{Hash: hash, Replicas: bucket.Replicas(), Refs: []ReplicaStatus{}}
+	cids := []string{}
+	err = r.ctrl.BucketSource().Walk(bucket.NodeCid(), func(p string, dr *core.DataRef) (bool, error) {
+		c := dr.NodeCid().String()
+		st.Refs = append(st.Refs, ReplicaStatus{Path: p, Cid: c, Holders: []string{}})
+		cids = append(cids, c)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	holdings := r.holdings(cids)
+	// candidates are the peers that support the protocol, sorted for deterministic selection
+	candidates := []string{}
+	for p := range holdings {
+		candidates = append(candidates, p)
+	}
+	sort.Strings(candidates)
+
+	requests := map[string][]string{}
+	for i := range st.Refs {
+		ref := &st.Refs[i]
+		missing := []string{}
+		for _, p := range candidates {
+			if holdings[p][ref.Cid] {
+				ref.Holders = append(ref.Holders, p)
+			} else if p != r.peer.Host().ID().Pretty() {
+				missing = append(missing, p)
+			}
+		}
+		need := st.Replicas - len(ref.Holders)
+		if need <= 0 {
+			continue
+		}
+		st.UnderReplicated++
+		if !replicate {
+			continue
+		}
+		for i := 0; i < need && i < len(missing); i++ {
+			ref.Requested = append(ref.Requested, missing[i])
+			requests[missing[i]] = append(requests[missing[i]], ref.Cid)
+		}
+	}
+	for p, cids := range requests {
+		if _, err := r.request(p, ReplicateProtocol, &replicationMsg{hash, cids}); err != nil {
+			log.Printf("could not request replication from %s: %s", p, err.Error())
+		}
+	}
+
+	st.Checked = time.Now().Unix()
+	r.lock.Lock()
+	r.status[hash] = &st
+	r.lock.Unlock()
+	return &st, nil
+}
+
+// holdings returns the given cids that are held by each peer (including the local peer),
+// peers that don't support the protocol are omitted
+func (r *Replicator) holdings(cids []string) map[string]map[string]bool {
+	self := r.peer.Host().ID().Pretty()
+	res := map[string]map[string]bool{self: {}}
+	for _, s := range r.held(cids) {
+		res[self][s] = true
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, pid := range r.peer.Host().Network().Peers() {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			held, err := r.request(pid.Pretty(), HoldingsProtocol, &replicationMsg{Cids: cids})
+			if err != nil {
+				return
+			}
+			set := map[string]bool{}
+			for _, c := range held {
+				set[c] = true
+			}
+			lock.Lock()
+			res[pid.Pretty()] = set
+			lock.Unlock()
+		}(pid)
+	}
+	wg.Wait()
+	return res
+}
+
+// request sends the given request to some peer and returns the cids of the response
+func (r *Replicator) request(p string, proto protocol.ID, req *replicationMsg) ([]string, error) {
+	pid, err := peer.Decode(p)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.peer.Context(), ReplicationRequestTimeout)
+	defer cancel()
+	stream, err := r.peer.Host().NewStream(ctx, pid, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(ReplicationRequestTimeout))
+
+	if err = writeReplicationMsg(stream, req); err != nil {
+		return nil, err
+	}
+	res, err := readReplicationMsg(stream)
+	if err != nil {
+		return nil, err
+	}
+	return res.Cids, nil
+}
+
+func readReplicationMsg(stream network.Stream) (*replicationMsg, error) {
+	mr := msgio.NewReader(bufio.NewReader(stream))
+	raw, err := mr.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	var msg replicationMsg
+	if err = json.Unmarshal(raw, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func writeReplicationMsg(stream network.Stream, msg *replicationMsg) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return msgio.NewWriter(stream).WriteMsg(raw)
+}
@@ -2,7 +2,10 @@ package p2p
 
 import (
 	"github.com/amirylm/cbn/src/core"
+	"github.com/amirylm/cbn/src/metrics"
 	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	ds "github.com/ipfs/go-datastore"
+	crdt "github.com/ipfs/go-ds-crdt"
 )
 
 func NewP2PController(peer *p2pstorage.MultiStorePeer) *core.Controller {
@@ -12,10 +15,25 @@ func NewP2PController(peer *p2pstorage.MultiStorePeer) *core.Controller {
 	return core.NewController(peer, pbr, pbs, pds)
 }
 
+// crdtMetricsOptions returns the default crdt options, with a hook that counts merged values of the given store
+func crdtMetricsOptions(store string) *crdt.Options {
+	opts := crdt.DefaultOptions()
+	opts.PutHook = func(k ds.Key, v []byte) {
+		metrics.CrdtMerges.WithLabelValues(store).Inc()
+	}
+	return opts
+}
+
 const (
-	P2PSource = "p2p"
-	ListBucketsProtocol = "/buckets/p2p/list/0.0.1"
-	SaveBucketProtocol  = "/buckets/p2p/save/0.0.1"
-	GetBucketProtocol   = "/buckets/p2p/read/0.0.1"
-	DownProtocol = "/data/download/p2p/0.0.1"
-)
\ No newline at end of file
+	P2PSource                = "p2p"
+	ListBucketsProtocol      = "/buckets/p2p/list/0.0.1"
+	SaveBucketProtocol       = "/buckets/p2p/save/0.0.1"
+	GetBucketProtocol        = "/buckets/p2p/read/0.0.1"
+	SubscribeBucketsProtocol = "/buckets/p2p/subscribe/0.0.1"
+	DownProtocol             = "/data/download/p2p/0.0.1"
+	HoldingsProtocol         = "/replication/p2p/holdings/0.0.1"
+	ReplicateProtocol        = "/replication/p2p/replicate/0.0.1"
+	DealProtocol             = "/deals/p2p/propose/0.0.1"
+	ChallengeProtocol        = "/storage/p2p/challenge/0.0.1"
+	ReceiptProtocol          = "/ledger/p2p/receipt/0.0.1"
+)
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	p2pstorage "github.com/amirylm/libp2p-facade/storage"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ds-crdt/pb"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+var (
+	// CrdtSyncGracePeriod is the time it takes to receive the heads of remote peers,
+	// which are re-broadcasted every minute (by default)
+	CrdtSyncGracePeriod = 2 * time.Minute
+)
+
+// CrdtStatus describes the sync status of some crdt store
+type CrdtStatus struct {
+	Name  string   `json:"name"`
+	Heads []string `json:"heads"`
+	// Height is the max height of the heads
+	Height uint64 `json:"height"`
+	// Missing is the amount of heads (local or announced) that are not available locally
+	Missing int `json:"missing"`
+	// Announced is the amount of heads that remote peers announced
+	Announced int `json:"announced"`
+	// LastAnnounce is the (unix) time remote heads were last announced, 0 if none were announced
+	LastAnnounce int64 `json:"last_announce"`
+}
+
+// Synced checks whether all the heads are available locally
+func (st CrdtStatus) Synced() bool {
+	return st.Missing == 0
+}
+
+// CrdtSyncStatus returns the status of the crdt stores of the given peer
+func CrdtSyncStatus(peer *p2pstorage.MultiStorePeer) ([]CrdtStatus, error) {
+	res := []CrdtStatus{}
+	bstore := peer.BlockService().Blockstore()
+	for _, name := range []string{crdtPSBucketsTopic, crdtPSDomainsTopic, crdtPSDealsTopic} {
+		st := CrdtStatus{Name: name, Heads: []string{}}
+		// heads are stored in '/<name>/h/<multihash>' with the height as value
+		results, err := peer.Store().Query(query.Query{Prefix: ds.NewKey(name).ChildString("h").String()})
+		if err != nil {
+			return nil, err
+		}
+		entries, err := results.Rest()
+		results.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			c, err := dshelp.DsKeyToCidV1(ds.NewKey(ds.RawKey(e.Key).BaseNamespace()), cid.DagProtobuf)
+			if err != nil {
+				return nil, err
+			}
+			st.Heads = append(st.Heads, c.String())
+			if height, n := binary.Uvarint(e.Value); n > 0 && height > st.Height {
+				st.Height = height
+			}
+			if has, err := bstore.Has(c); err != nil || !has {
+				st.Missing++
+			}
+		}
+		res = append(res, st)
+	}
+	return res, nil
+}
+
+// HeadTracker records the heads that remote peers announce on the crdt topics,
+// so the local heads can be compared with the network
+type HeadTracker struct {
+	lock sync.RWMutex
+
+	peer *p2pstorage.MultiStorePeer
+
+	// heads are the latest announced heads of each remote peer, by store name
+	heads map[string]map[peer.ID][]cid.Cid
+	last  map[string]time.Time
+}
+
+// NewHeadTracker creates a tracker that validates (observes) the broadcasts of the crdt topics of the given peer
+func NewHeadTracker(p *p2pstorage.MultiStorePeer) (*HeadTracker, error) {
+	ht := HeadTracker{
+		peer:  p,
+		heads: map[string]map[peer.ID][]cid.Cid{},
+		last:  map[string]time.Time{},
+	}
+	for _, name := range []string{crdtPSBucketsTopic, crdtPSDomainsTopic, crdtPSDealsTopic} {
+		ht.heads[name] = map[peer.ID][]cid.Cid{}
+		if err := p.PubSub().RegisterTopicValidator(name, ht.validator(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ht, nil
+}
+
+// validator records the heads of remote broadcasts, all the messages are accepted
+func (ht *HeadTracker) validator(name string) func(context.Context, peer.ID, *pubsub.Message) bool {
+	self := ht.peer.Host().ID()
+	return func(ctx context.Context, from peer.ID, msg *pubsub.Message) bool {
+		if from == self {
+			return true
+		}
+		var bcast pb.CRDTBroadcast
+		if err := proto.Unmarshal(msg.GetData(), &bcast); err != nil {
+			return true
+		}
+		heads := []cid.Cid{}
+		for _, h := range bcast.Heads {
+			if c, err := cid.Cast(h.Cid); err == nil {
+				heads = append(heads, c)
+			}
+		}
+		ht.announce(name, msg.GetFrom(), heads)
+		return true
+	}
+}
+
+// announce records the heads that the given peer announced for the given store
+func (ht *HeadTracker) announce(name string, from peer.ID, heads []cid.Cid) {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+
+	if len(heads) > 0 {
+		ht.heads[name][from] = heads
+	}
+	ht.last[name] = time.Now()
+}
+
+// Status returns the status of the crdt stores, including the heads that were announced by remote peers
+func (ht *HeadTracker) Status() ([]CrdtStatus, error) {
+	statuses, err := CrdtSyncStatus(ht.peer)
+	if err != nil {
+		return nil, err
+	}
+	bstore := ht.peer.BlockService().Blockstore()
+
+	ht.lock.RLock()
+	defer ht.lock.RUnlock()
+	for i, st := range statuses {
+		if last, ok := ht.last[st.Name]; ok {
+			statuses[i].LastAnnounce = last.Unix()
+		}
+		announced := cid.NewSet()
+		for _, heads := range ht.heads[st.Name] {
+			for _, c := range heads {
+				announced.Add(c)
+			}
+		}
+		statuses[i].Announced = announced.Len()
+		err = announced.ForEach(func(c cid.Cid) error {
+			if has, err := bstore.Has(c); err != nil || !has {
+				statuses[i].Missing++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// PathSeparator separates the segments of a path within a bucket
+	PathSeparator = "/"
+)
+
+var (
+	// InvalidPathErr is returned for paths with relative ('.' or '..') segments
+	InvalidPathErr = errors.New("invalid path")
+)
+
+// ValidName returns whether the given name can be used as a single segment of a path within a bucket
+func ValidName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.Contains(name, PathSeparator)
+}
+
+// SplitPath returns the non-empty segments of the given path within a bucket,
+// paths with relative segments are rejected
+func SplitPath(p string) ([]string, error) {
+	segments := []string{}
+	for _, s := range strings.Split(p, PathSeparator) {
+		if len(s) == 0 {
+			continue
+		}
+		if !ValidName(s) {
+			return nil, InvalidPathErr
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// CleanPath returns the canonical form of the given path within a bucket
+func CleanPath(p string) (string, error) {
+	segments, err := SplitPath(p)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(segments, PathSeparator), nil
+}
@@ -0,0 +1,555 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// PinFetchTimeout limits the time of fetching a single version of a pinned bucket
+	PinFetchTimeout = 10 * time.Minute
+	// PinExpiryInterval is the interval of removing expired pins
+	PinExpiryInterval = time.Minute
+
+	PinNotValidErr = errors.New("pin is not valid")
+)
+
+const (
+	pinsPrefix = "/pins"
+)
+
+// PinKind is the kind of value that a pin matches
+type PinKind string
+
+const (
+	PinHash   PinKind = "hash"
+	PinOwner  PinKind = "owner"
+	PinDomain PinKind = "domain"
+	// PinCid pins a single DAG (e.g. the data of a DataRef) regardless of buckets
+	PinCid PinKind = "cid"
+)
+
+// Pin declares buckets that the node must fully replicate and keep
+type Pin struct {
+	Kind PinKind `json:"kind"`
+	// Value is the bucket hash, owner peer id, domain name or cid
+	Value string `json:"value"`
+	// Keep is the amount of previous versions to keep in addition to the current one
+	Keep int `json:"keep"`
+	// Expires is the timestamp after which the pin is removed (e.g. once a deal is over), 0 for no expiry
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// ParsePin parses a pin in the format '<kind>:<value>[:<keep>]'
+func ParsePin(s string) (*Pin, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, PinNotValidErr
+	}
+	p := Pin{Kind: PinKind(parts[0]), Value: parts[1]}
+	if len(parts) == 3 {
+		keep, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, PinNotValidErr
+		}
+		p.Keep = keep
+	}
+	return &p, p.Validate()
+}
+
+// Validate checks that the pin is well formed
+func (p *Pin) Validate() error {
+	if len(p.Value) == 0 || p.Keep < 0 || strings.Contains(p.Value, "/") {
+		return PinNotValidErr
+	}
+	switch p.Kind {
+	case PinHash, PinDomain:
+		return nil
+	case PinOwner:
+		if _, err := peer.Decode(p.Value); err != nil {
+			return PinNotValidErr
+		}
+		return nil
+	case PinCid:
+		if _, err := cid.Decode(p.Value); err != nil {
+			return PinNotValidErr
+		}
+		return nil
+	}
+	return PinNotValidErr
+}
+
+func (p *Pin) String() string {
+	return fmt.Sprintf("%s:%s:%d", p.Kind, p.Value, p.Keep)
+}
+
+// Active checks whether the pin is not expired at the given time
+func (p *Pin) Active(t time.Time) bool {
+	return p.Expires == 0 || t.Unix() < p.Expires
+}
+
+func (p *Pin) key() ds.Key {
+	return ds.NewKey(pinsPrefix).ChildString(string(p.Kind)).ChildString(p.Value)
+}
+
+// PinState is the state of a pinned bucket
+type PinState string
+
+const (
+	PinQueued   PinState = "queued"
+	PinFetching PinState = "fetching"
+	PinPinned   PinState = "pinned"
+	PinFailed   PinState = "failed"
+)
+
+// PinStatus describes the replication of a single pinned bucket (or cid)
+type PinStatus struct {
+	// Hash is the bucket hash, or the cid of cid pins
+	Hash string `json:"hash"`
+	// Node is the cid of the bucket version that was fetched
+	Node  string   `json:"node"`
+	State PinState `json:"state"`
+	// Blocks and Size are the amount of blocks and bytes of the bucket (including data)
+	Blocks  int    `json:"blocks"`
+	Size    uint64 `json:"size"`
+	Error   string `json:"error,omitempty"`
+	Updated int64  `json:"updated"`
+}
+
+// PinManager keeps pinned buckets fully replicated on the local node,
+// new versions (local or received over crdt) of pinned buckets are fetched proactively.
+// pins are persisted in the local store of the peer
+type PinManager struct {
+	lock sync.RWMutex
+
+	ctrl    *Controller
+	domains DomainResolver
+
+	pins   map[string]*Pin
+	status map[string]*PinStatus
+
+	// pending are the buckets (or cids) that should be fetched
+	pending map[string]PinKind
+	notify  chan struct{}
+}
+
+// NewPinManager creates a new pin manager and loads the existing pins,
+// domains resolver is optional and needed only for domain pins
+func NewPinManager(ctrl *Controller, domains DomainResolver) *PinManager {
+	pm := PinManager{
+		ctrl:    ctrl,
+		domains: domains,
+		pins:    map[string]*Pin{},
+		status:  map[string]*PinStatus{},
+		pending: map[string]PinKind{},
+		notify:  make(chan struct{}, 1),
+	}
+	if err := pm.load(); err != nil {
+		log.Println("could not load pins:", err)
+	}
+
+	return &pm
+}
+
+func (pm *PinManager) load() error {
+	results, err := pm.ctrl.peer.Store().Query(query.Query{Prefix: pinsPrefix})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		var p Pin
+		if err := json.Unmarshal(r.Value, &p); err != nil {
+			return err
+		}
+		pm.pins[p.key().String()] = &p
+	}
+	return nil
+}
+
+// Pin adds (or updates) the given pin and queues the matching buckets,
+// the expiry of an existing pin is only extended
+func (pm *PinManager) Pin(p Pin) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	pm.lock.RLock()
+	if existing, ok := pm.pins[p.key().String()]; ok && p.Expires > 0 {
+		if existing.Expires == 0 || existing.Expires > p.Expires {
+			p.Expires = existing.Expires
+		}
+	}
+	pm.lock.RUnlock()
+	raw, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	if err = pm.ctrl.peer.Store().Put(p.key(), raw); err != nil {
+		return err
+	}
+	pm.lock.Lock()
+	pm.pins[p.key().String()] = &p
+	pm.lock.Unlock()
+
+	return pm.Sync()
+}
+
+// Declare adds the pins of the given specs (see ParsePin), e.g. pins that were declared in config.
+// invalid specs are skipped
+func (pm *PinManager) Declare(specs []string) {
+	for _, spec := range specs {
+		if len(spec) == 0 {
+			continue
+		}
+		p, err := ParsePin(spec)
+		if err != nil {
+			log.Printf("could not parse pin %s: %s", spec, err.Error())
+			continue
+		}
+		if err = pm.Pin(*p); err != nil {
+			log.Printf("could not pin %s: %s", spec, err.Error())
+		}
+	}
+}
+
+// Unpin removes the given pin, the blocks of buckets that are no longer pinned might be removed by GC
+func (pm *PinManager) Unpin(kind PinKind, value string) error {
+	p := Pin{Kind: kind, Value: value}
+	if err := pm.ctrl.peer.Store().Delete(p.key()); err != nil {
+		return err
+	}
+	pm.lock.Lock()
+	delete(pm.pins, p.key().String())
+	pm.lock.Unlock()
+
+	pm.lock.RLock()
+	hashes := []string{}
+	for h := range pm.status {
+		hashes = append(hashes, h)
+	}
+	pm.lock.RUnlock()
+	for _, h := range hashes {
+		if _, ok := pm.match(h, nil); !ok {
+			pm.lock.Lock()
+			delete(pm.status, h)
+			pm.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+// Expire removes the pins that are expired
+func (pm *PinManager) Expire() error {
+	pm.lock.RLock()
+	expired := []Pin{}
+	now := time.Now()
+	for _, p := range pm.pins {
+		if !p.Active(now) {
+			expired = append(expired, *p)
+		}
+	}
+	pm.lock.RUnlock()
+	for _, p := range expired {
+		if err := pm.Unpin(p.Kind, p.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pins returns the current pins
+func (pm *PinManager) Pins() []Pin {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	res := []Pin{}
+	for _, p := range pm.pins {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].String() < res[j].String()
+	})
+	return res
+}
+
+// Status returns the status of all pinned buckets
+func (pm *PinManager) Status() []PinStatus {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	res := []PinStatus{}
+	for _, st := range pm.status {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Hash < res[j].Hash
+	})
+	return res
+}
+
+// StatusOf returns the status of the given bucket, false is returned if the bucket is not pinned
+func (pm *PinManager) StatusOf(hash string) (PinStatus, bool) {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	st, ok := pm.status[hash]
+	if !ok {
+		return PinStatus{}, false
+	}
+	return *st, true
+}
+
+// Roots returns the roots of cid pins, used to keep them in GC
+func (pm *PinManager) Roots() ([]cid.Cid, error) {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	roots := []cid.Cid{}
+	now := time.Now()
+	for _, p := range pm.pins {
+		if p.Kind != PinCid || !p.Active(now) {
+			continue
+		}
+		c, err := cid.Decode(p.Value)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, c)
+	}
+	return roots, nil
+}
+
+// Retention returns the amount of previous versions to keep for the given bucket
+func (pm *PinManager) Retention(hash string) int {
+	keep, _ := pm.match(hash, nil)
+	return keep
+}
+
+// match checks whether the given bucket is pinned and returns the max versions to keep,
+// the bucket is loaded from the registry if not provided
+func (pm *PinManager) match(hash string, bucket *Bucket) (int, bool) {
+	pm.lock.RLock()
+	pins := make([]Pin, 0, len(pm.pins))
+	now := time.Now()
+	for _, p := range pm.pins {
+		if p.Active(now) {
+			pins = append(pins, *p)
+		}
+	}
+	pm.lock.RUnlock()
+
+	keep, matched := 0, false
+	for _, p := range pins {
+		if !pm.matchPin(&p, hash, &bucket) {
+			continue
+		}
+		matched = true
+		if p.Keep > keep {
+			keep = p.Keep
+		}
+	}
+	return keep, matched
+}
+
+func (pm *PinManager) matchPin(p *Pin, hash string, bucket **Bucket) bool {
+	switch p.Kind {
+	case PinHash, PinCid:
+		return p.Value == hash
+	case PinDomain:
+		if pm.domains == nil {
+			return false
+		}
+		rec, err := pm.domains.Resolve(p.Value)
+		return err == nil && rec.Hash() == hash
+	case PinOwner:
+		if *bucket == nil {
+			b, err := pm.ctrl.bucketReg.Load(hash)
+			if err != nil {
+				return false
+			}
+			*bucket = b
+		}
+		pid, err := peer.Decode(p.Value)
+		if err != nil {
+			return false
+		}
+		pk, err := libp2pcrypto.UnmarshalPublicKey((*bucket).PK())
+		return err == nil && pid.MatchesPublicKey(pk)
+	}
+	return false
+}
+
+// Sync queues all the pinned buckets in the registry and the cid pins
+func (pm *PinManager) Sync() error {
+	roots, err := pm.Roots()
+	if err != nil {
+		return err
+	}
+	for _, c := range roots {
+		pm.enqueue(c.String(), PinCid)
+	}
+	return pm.ctrl.bucketReg.ForEach(func(hash string, b *Bucket) (bool, error) {
+		if _, ok := pm.match(hash, b); ok {
+			pm.enqueue(hash, PinHash)
+		}
+		return true, nil
+	})
+}
+
+func (pm *PinManager) enqueue(hash string, kind PinKind) {
+	pm.lock.Lock()
+	pm.pending[hash] = kind
+	if _, ok := pm.status[hash]; !ok {
+		pm.status[hash] = &PinStatus{Hash: hash, State: PinQueued, Updated: time.Now().Unix()}
+	}
+	pm.lock.Unlock()
+
+	select {
+	case pm.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Start syncs the pinned buckets and listens to bucket changes until the peer is closed
+func (pm *PinManager) Start() {
+	events, cancel := pm.ctrl.SubscribeBuckets(nil)
+	defer cancel()
+
+	ctx := pm.ctrl.peer.Context()
+	go pm.work(ctx)
+
+	if err := pm.Sync(); err != nil {
+		log.Println("could not sync pins:", err)
+	}
+	ticker := time.NewTicker(PinExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pm.Expire(); err != nil {
+				log.Println("could not remove expired pins:", err)
+			}
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			if evt.Type == BucketRemoved {
+				pm.lock.Lock()
+				delete(pm.status, evt.Hash)
+				pm.lock.Unlock()
+				continue
+			}
+			if _, ok := pm.match(evt.Hash, evt.Bucket); ok {
+				pm.enqueue(evt.Hash, PinHash)
+			}
+		}
+	}
+}
+
+// work fetches the queued buckets, a bucket that was updated multiple times is fetched once
+func (pm *PinManager) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pm.notify:
+		}
+		for {
+			pm.lock.Lock()
+			hash, kind := "", PinHash
+			for h, k := range pm.pending {
+				hash, kind = h, k
+				break
+			}
+			delete(pm.pending, hash)
+			pm.lock.Unlock()
+			if len(hash) == 0 {
+				break
+			}
+			var err error
+			if kind == PinCid {
+				var c cid.Cid
+				if c, err = cid.Decode(hash); err == nil {
+					err = pm.FetchDag(c)
+				}
+			} else {
+				err = pm.Fetch(hash)
+			}
+			if err != nil {
+				log.Printf("could not fetch pinned %s %s: %s", kind, hash, err.Error())
+			}
+		}
+	}
+}
+
+// Fetch fetches all the blocks of the current version of the given bucket, including the referenced data
+func (pm *PinManager) Fetch(hash string) error {
+	bucket, err := pm.ctrl.bucketReg.Load(hash)
+	if err != nil {
+		return err
+	}
+	return pm.fetch(hash, bucket.NodeCid(), func(ctx context.Context, visited *cid.Set, count func(ipld.Node) error) error {
+		// the bucket DAG is local at this point
+		return pm.ctrl.bucketSrc.Walk(bucket.NodeCid(), func(p string, dr *DataRef) (bool, error) {
+			return true, pm.ctrl.walkDag(ctx, dr.NodeCid(), visited, count)
+		})
+	})
+}
+
+// FetchDag fetches all the blocks of the given DAG
+func (pm *PinManager) FetchDag(c cid.Cid) error {
+	return pm.fetch(c.String(), c, nil)
+}
+
+// fetch fetches the DAG of the given root and then the optional referenced DAGs, status is updated accordingly
+func (pm *PinManager) fetch(hash string, root cid.Cid, refs func(context.Context, *cid.Set, func(ipld.Node) error) error) error {
+	st := PinStatus{Hash: hash, Node: root.String(), State: PinFetching}
+	pm.setStatus(st)
+
+	ctx, cancel := context.WithTimeout(pm.ctrl.peer.Context(), PinFetchTimeout)
+	defer cancel()
+	visited := cid.NewSet()
+	count := func(nd ipld.Node) error {
+		st.Blocks++
+		st.Size += uint64(len(nd.RawData()))
+		return nil
+	}
+	err := pm.ctrl.walkDag(ctx, root, visited, count)
+	if err == nil && refs != nil {
+		err = refs(ctx, visited, count)
+	}
+	st.State = PinPinned
+	if err != nil {
+		st.State = PinFailed
+		st.Error = err.Error()
+	}
+	pm.setStatus(st)
+	return err
+}
+
+func (pm *PinManager) setStatus(st PinStatus) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	st.Updated = time.Now().Unix()
+	pm.status[st.Hash] = &st
+}
@@ -0,0 +1,20 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParsePin(t *testing.T) {
+	p, err := ParsePin("hash:abc:3")
+	assert.Nil(t, err)
+	assert.Equal(t, Pin{Kind: PinHash, Value: "abc", Keep: 3}, *p)
+	p, err = ParsePin("domain:example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, p.Keep)
+
+	for _, s := range []string{"", "hash", "hash:", "foo:abc", "owner:notapeer", "hash:abc:x", "hash:a/b"} {
+		_, err = ParsePin(s)
+		assert.Equal(t, PinNotValidErr, err, s)
+	}
+}
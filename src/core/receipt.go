@@ -0,0 +1,122 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/amirylm/cbn/src/cipher"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"time"
+)
+
+var (
+	ReceiptNotValidErr = errors.New("receipt is not valid")
+)
+
+// Receipt is signed by a consumer to acknowledge the amount of bytes that it received from some provider.
+// the amount is cumulative, therefore newer receipts replace older ones
+type Receipt struct {
+	// provider is the peer id of the peer that served the data
+	provider string
+	// bytes is the total amount of bytes that were received from the provider
+	bytes uint64
+	// created is the timestamp of the receipt
+	created int64
+	// pubkey is the marshaled public key of the consumer
+	pubkey []byte
+	// sig is the signature made with the corresponding private key
+	sig []byte
+}
+
+func NewReceipt(provider peer.ID, bytes uint64, pubkey libp2pcrypto.PubKey) (*Receipt, error) {
+	pkraw, err := libp2pcrypto.MarshalPublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	r := Receipt{provider.Pretty(), bytes, time.Now().Unix(), pkraw, []byte{}}
+
+	return &r, nil
+}
+
+func (r *Receipt) Sign(priv libp2pcrypto.PrivKey) error {
+	sig, err := cipher.Sign(r, priv)
+	if err != nil {
+		return err
+	}
+	rcopy := *r
+	rcopy.sig = sig
+	if err = rcopy.Verify(); err != nil {
+		return err
+	}
+	r.sig = sig
+	return nil
+}
+
+func (r *Receipt) Verify() error {
+	pk, err := libp2pcrypto.UnmarshalPublicKey(r.pubkey)
+	if err != nil {
+		return err
+	}
+	return cipher.Verify(r, pk)
+}
+
+// Consumer returns the peer id of the signer
+func (r *Receipt) Consumer() (peer.ID, error) {
+	pk, err := libp2pcrypto.UnmarshalPublicKey(r.pubkey)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pk)
+}
+
+func (r *Receipt) Provider() string {
+	return r.provider
+}
+
+func (r *Receipt) Bytes() uint64 {
+	return r.bytes
+}
+
+func (r *Receipt) Created() int64 {
+	return r.created
+}
+
+func (r *Receipt) PK() []byte {
+	return r.pubkey
+}
+
+func (r *Receipt) Signature() []byte {
+	return r.sig
+}
+
+func (r *Receipt) Data() ([]byte, error) {
+	rec := receiptRecord{r.provider, r.bytes, r.created, r.pubkey, nil}
+	return signingInput(receiptDomain, EncodingVersion, &rec)
+}
+
+func ParseReceipt(raw []byte) (*Receipt, error) {
+	var rmsg receiptMsg
+	err := json.Unmarshal(raw, &rmsg)
+	r := Receipt{rmsg.Provider, rmsg.Bytes, rmsg.Created, rmsg.PK, rmsg.Sig}
+	if err == nil {
+		if err := r.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	return &r, err
+}
+
+func SerializeReceipt(r *Receipt) ([]byte, error) {
+	if err := r.Verify(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&receiptMsg{r.provider, r.bytes, r.created, r.pubkey, r.sig})
+}
+
+type receiptMsg struct {
+	Provider string
+	Bytes    uint64
+	Created  int64
+	PK       []byte
+	Sig      []byte
+}
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestReceipt(t *testing.T) {
+	consumerPriv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	providerPriv, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	providerID, err := peer.IDFromPrivateKey(providerPriv)
+	assert.Nil(t, err)
+
+	r, err := NewReceipt(providerID, 1024, consumerPriv.GetPublic())
+	assert.Nil(t, err)
+	assert.NotNil(t, r.Verify())
+	assert.Nil(t, r.Sign(consumerPriv))
+	_, err = SerializeReceipt(&Receipt{r.provider, r.bytes, r.created, r.pubkey, []byte{}})
+	assert.NotNil(t, err)
+
+	raw, err := SerializeReceipt(r)
+	assert.Nil(t, err)
+	parsed, err := ParseReceipt(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1024), parsed.Bytes())
+	assert.Equal(t, providerID.Pretty(), parsed.Provider())
+	consumer, err := parsed.Consumer()
+	assert.Nil(t, err)
+	assert.True(t, consumer.MatchesPrivateKey(consumerPriv))
+
+	tampered := strings.Replace(string(raw), `"Bytes":1024`, `"Bytes":4096`, 1)
+	_, err = ParseReceipt([]byte(tampered))
+	assert.NotNil(t, err)
+
+	// the signing input is domain separated
+	data, err := r.Data()
+	assert.Nil(t, err)
+	assert.Equal(t, "cbn/receipt/v1\x00", string(data[:len(receiptDomain)+4]))
+}
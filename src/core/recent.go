@@ -0,0 +1,44 @@
+package core
+
+import (
+	"github.com/ipfs/go-cid"
+	"sync"
+	"time"
+)
+
+// recentRoots tracks DAG roots that were created lately and might not be referenced yet,
+// e.g. data that was uploaded and waits to be added to some bucket or changes staged in a batch
+type recentRoots struct {
+	lock sync.Mutex
+
+	items map[cid.Cid]time.Time
+}
+
+func newRecentRoots() *recentRoots {
+	rr := recentRoots{items: map[cid.Cid]time.Time{}}
+
+	return &rr
+}
+
+func (rr *recentRoots) add(c cid.Cid) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	rr.items[c] = time.Now()
+}
+
+// list returns the roots that were added within the given duration, older roots are dropped
+func (rr *recentRoots) list(maxAge time.Duration) []cid.Cid {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	res := []cid.Cid{}
+	for c, t := range rr.items {
+		if time.Since(t) > maxAge {
+			delete(rr.items, c)
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
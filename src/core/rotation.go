@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/amirylm/cbn/src/cipher"
+	libp2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"time"
+)
+
+var (
+	RotationNotValidErr = errors.New("key rotation is not valid")
+	SupersededKeyErr    = errors.New("bucket was signed by a superseded key")
+)
+
+// KeyRotation delegates the signing authority of some bucket to a new public key.
+// rotations form a chain that starts with the owner key of the bucket (which is part of the bucket hash),
+// each rotation is signed by the key that was delegated by the previous rotation (or by the owner key)
+type KeyRotation struct {
+	// hash of the corresponding bucket
+	hash string
+	// seq is the position of the rotation in the chain, starting with 1
+	seq uint64
+	// next is the marshaled public key that signs the bucket from now on
+	next []byte
+	// created is the timestamp of the rotation
+	created int64
+	// sig is the signature made with the current (previous) key
+	sig []byte
+}
+
+func NewKeyRotation(hash string, seq uint64, next libp2pcrypto.PubKey) (*KeyRotation, error) {
+	if next == nil || seq == 0 {
+		return nil, RotationNotValidErr
+	}
+	nextraw, err := libp2pcrypto.MarshalPublicKey(next)
+	if err != nil {
+		return nil, err
+	}
+	kr := KeyRotation{hash, seq, nextraw, time.Now().Unix(), []byte{}}
+
+	return &kr, nil
+}
+
+func (kr *KeyRotation) Hash() string {
+	return kr.hash
+}
+
+func (kr *KeyRotation) Seq() uint64 {
+	return kr.seq
+}
+
+// Next returns the marshaled public key that was delegated
+func (kr *KeyRotation) Next() []byte {
+	return kr.next
+}
+
+func (kr *KeyRotation) Created() int64 {
+	return kr.created
+}
+
+// Sign signs the rotation with the current key of the bucket
+func (kr *KeyRotation) Sign(priv libp2pcrypto.PrivKey) error {
+	krcopy := *kr
+	sig, err := cipher.Sign(&krcopy, priv)
+	if err != nil {
+		return err
+	}
+	krcopy.sig = sig
+	if err = krcopy.Verify(priv.GetPublic()); err != nil {
+		return err
+	}
+	kr.sig = sig
+	return nil
+}
+
+// Verify verifies the rotation with the key that was the authority before it
+func (kr *KeyRotation) Verify(pk libp2pcrypto.PubKey) error {
+	return cipher.Verify(kr, pk)
+}
+
+func (kr *KeyRotation) Signature() []byte {
+	return kr.sig
+}
+
+func (kr *KeyRotation) Data() ([]byte, error) {
+	rec := keyRotationRecord{kr.hash, kr.seq, kr.next, kr.created, nil}
+	return signingInput(keyRotationDomain, EncodingVersion, &rec)
+}
+
+// VerifyRotations follows the given chain of rotations (of the given bucket hash) that starts with the owner key,
+// and returns the (marshaled) key that is the current authority
+func VerifyRotations(hash string, owner []byte, chain []*KeyRotation) ([]byte, error) {
+	authority := owner
+	for i, kr := range chain {
+		if kr.hash != hash || kr.seq != uint64(i+1) {
+			return nil, RotationNotValidErr
+		}
+		pk, err := libp2pcrypto.UnmarshalPublicKey(authority)
+		if err != nil {
+			return nil, err
+		}
+		if err = kr.Verify(pk); err != nil {
+			return nil, RotationNotValidErr
+		}
+		authority = kr.next
+	}
+	return authority, nil
+}
+
+// ExtendsRotations returns true if the given chain is a prefix of the other chain
+func ExtendsRotations(chain, other []*KeyRotation) bool {
+	if len(other) < len(chain) {
+		return false
+	}
+	for i, kr := range chain {
+		if !bytes.Equal(kr.sig, other[i].sig) {
+			return false
+		}
+	}
+	return true
+}
+
+func ParseRotations(raw []byte) ([]*KeyRotation, error) {
+	var msgs []*keyRotationMsg
+	if err := json.Unmarshal(raw, &msgs); err != nil {
+		return nil, err
+	}
+	return fromKeyRotationMsgs(msgs), nil
+}
+
+func SerializeRotations(chain []*KeyRotation) ([]byte, error) {
+	return json.Marshal(toKeyRotationMsgs(chain))
+}
+
+type keyRotationMsg struct {
+	Hash    string
+	Seq     uint64
+	Next    []byte
+	Created int64
+	Sig     []byte
+}
+
+func toKeyRotationMsgs(chain []*KeyRotation) []*keyRotationMsg {
+	msgs := []*keyRotationMsg{}
+	for _, kr := range chain {
+		msgs = append(msgs, &keyRotationMsg{kr.hash, kr.seq, kr.next, kr.created, kr.sig})
+	}
+	return msgs
+}
+
+func fromKeyRotationMsgs(msgs []*keyRotationMsg) []*KeyRotation {
+	chain := []*KeyRotation{}
+	for _, msg := range msgs {
+		chain = append(chain, &KeyRotation{msg.Hash, msg.Seq, msg.Next, msg.Created, msg.Sig})
+	}
+	return chain
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const (
+	namespace = "cbn"
+)
+
+var (
+	Uploads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_total",
+		Help:      "Amount of uploaded files",
+	})
+	UploadSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_size_bytes",
+		Help:      "Size of uploaded files",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	UploadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Time of adding uploaded files",
+		Buckets:   prometheus.DefBuckets,
+	})
+	Downloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Amount of downloads by result",
+	}, []string{"result"})
+	DownloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_duration_seconds",
+		Help:      "Time of resolving downloaded files, before the content is streamed",
+		Buckets:   prometheus.DefBuckets,
+	})
+	BytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "served_bytes_total",
+		Help:      "Amount of bytes that were served by api",
+	}, []string{"api"})
+	CrdtPuts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "crdt_puts_total",
+		Help:      "Amount of local puts to crdt stores",
+	}, []string{"store"})
+	CrdtMerges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "crdt_merges_total",
+		Help:      "Amount of values that were merged into crdt stores (local and remote)",
+	}, []string{"store"})
+	BucketRegistrySize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bucket_registry_size",
+		Help:      "Amount of known buckets",
+	})
+	BucketCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bucket_cache_requests_total",
+		Help:      "Requests to the buckets cache by result (hit or miss)",
+	}, []string{"result"})
+	BucketVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bucket_verifications_total",
+		Help:      "Signature checks of parsed buckets by result (verified or cached)",
+	}, []string{"result"})
+	StreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_handler_duration_seconds",
+		Help:      "Time of handling libp2p streams by protocol",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"protocol"})
+	StreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_handler_errors_total",
+		Help:      "Amount of libp2p stream handlers that failed (panicked or reset the stream) by protocol",
+	}, []string{"protocol"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Uploads,
+		UploadSize,
+		UploadDuration,
+		Downloads,
+		DownloadDuration,
+		BytesServed,
+		CrdtPuts,
+		CrdtMerges,
+		BucketRegistrySize,
+		BucketCache,
+		BucketVerifications,
+		StreamDuration,
+		StreamErrors,
+	)
+}
+
+// Handler returns the http handler of the metrics endpoint
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterPeers exposes the amount of connected peers of the given host
+func RegisterPeers(h host.Host) error {
+	return prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_peers",
+		Help:      "Amount of connected peers",
+	}, func() float64 {
+		return float64(len(h.Network().Peers()))
+	}))
+}
+
+// StreamHandler measures the latency of the given handler,
+// panics and streams that were reset by the handler (its error paths) are counted as errors
+func StreamHandler(pid protocol.ID, h network.StreamHandler) network.StreamHandler {
+	return func(stream network.Stream) {
+		start := time.Now()
+		rs := resetRecorder{Stream: stream}
+		defer func() {
+			StreamDuration.WithLabelValues(string(pid)).Observe(time.Since(start).Seconds())
+			if r := recover(); r != nil {
+				StreamErrors.WithLabelValues(string(pid)).Inc()
+				panic(r)
+			}
+			if rs.reset {
+				StreamErrors.WithLabelValues(string(pid)).Inc()
+			}
+		}()
+		h(&rs)
+	}
+}
+
+// resetRecorder records whether the stream was reset
+type resetRecorder struct {
+	network.Stream
+	reset bool
+}
+
+func (s *resetRecorder) Reset() error {
+	s.reset = true
+	if s.Stream == nil {
+		return nil
+	}
+	return s.Stream.Reset()
+}
+
+// ObserveSince observes the time since start in the given histogram
+func ObserveSince(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStreamHandler(t *testing.T) {
+	pid := protocol.ID("/test/metrics/0.0.1")
+	ok := StreamHandler(pid, func(stream network.Stream) {})
+	failing := StreamHandler(pid, func(stream network.Stream) {
+		panic("failed")
+	})
+	reset := StreamHandler(pid, func(stream network.Stream) {
+		stream.Reset()
+	})
+
+	ok(nil)
+	assert.Equal(t, float64(0), testutil.ToFloat64(StreamErrors.WithLabelValues(string(pid))))
+	assert.Panics(t, func() {
+		failing(nil)
+	})
+	assert.Equal(t, float64(1), testutil.ToFloat64(StreamErrors.WithLabelValues(string(pid))))
+	reset(nil)
+	assert.Equal(t, float64(2), testutil.ToFloat64(StreamErrors.WithLabelValues(string(pid))))
+	assert.Equal(t, 1, testutil.CollectAndCount(StreamDuration))
+}